@@ -2,12 +2,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"order_process/process/backup"
 	"order_process/process/db"
 	"order_process/process/env"
+	"order_process/process/model/order"
 	"order_process/process/service"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -17,11 +22,91 @@ var join string
 func init() {
 	flag.StringVar(&join, "join", "", "host:port of leader to join")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [arguments]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [arguments] [command]\n", os.Args[0])
 		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  migrate\trewrite all stored orders in current schema version")
+		fmt.Fprintln(os.Stderr, "  backup <file>\tsave all orders and ownership entries into file, the services should be stopped")
+		fmt.Fprintln(os.Stderr, "  restore [-force] [-remap-service old=new]... <file>\tload the orders saved by backup into empty database")
 	}
 }
 
+// The service id mapping of restore command
+type serviceRemap map[string]string
+
+func (this serviceRemap) String() string {
+	return fmt.Sprint(map[string]string(this))
+}
+
+func (this serviceRemap) Set(value string) error {
+	ids := strings.SplitN(value, "=", 2)
+	if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+		return errors.New("service id mapping should be in old=new format")
+	}
+	this[ids[0]] = ids[1]
+	return nil
+}
+
+// Save all orders into the file specified by args
+func backupOrders(database db.IDatabase, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: backup <file>")
+	}
+
+	// Write into temporary file, so the existing backup is kept if failed
+	tmpPath := args[0] + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	count, err := backup.Backup(database, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, args[0]); err != nil {
+		return err
+	}
+	logrus.Printf("Backup [%d] entries into [%s]", count, args[0])
+	return nil
+}
+
+// Load the orders from the file specified by args
+func restoreOrders(database db.IDatabase, args []string) error {
+	remap := serviceRemap{}
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Var(remap, "remap-service", "old=new, replace service id old with new, can be repeated")
+	force := flags.Bool("force", false, "overwrite the entries of database which is not empty")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: restore [-force] [-remap-service old=new]... <file>")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Verify the whole file before writing anything
+	if _, err = backup.Verify(file); err != nil {
+		return err
+	}
+	if _, err = file.Seek(0, 0); err != nil {
+		return err
+	}
+	count, err := backup.Restore(database, file, remap, *force)
+	if err != nil {
+		return err
+	}
+	logrus.Printf("Restored [%d] entries from [%s]", count, flags.Arg(0))
+	return nil
+}
+
 // The entry of service
 func main() {
 	// Parse arguments
@@ -37,14 +122,53 @@ func main() {
 	}
 
 	// Initialize database
-	err = db.InitDatabase(env.RedisConfig.Host, env.RedisConfig.Port)
+	redisOptions := db.RedisOptions{
+		Host:             env.RedisConfig.Host,
+		Port:             env.RedisConfig.Port,
+		Password:         env.RedisConfig.Password,
+		DB:               env.RedisConfig.DB,
+		PoolSize:         env.RedisConfig.PoolSize,
+		Timeout:          time.Duration(env.RedisConfig.Timeout) * time.Second,
+		TLS:              env.RedisConfig.TLS,
+		TLSCAFile:        env.RedisConfig.TLSCAFile,
+		TLSServerName:    env.RedisConfig.TLSServerName,
+		SentinelAddrs:    env.RedisConfig.SentinelAddr,
+		SentinelMaster:   env.RedisConfig.SentinelMaster,
+		SentinelPassword: env.RedisConfig.SentinelPassword,
+	}
+	database, err := db.New(env.RedisConfig.Backend, &redisOptions, env.ServiceConfig.Path)
 	if err != nil {
 		logrus.Fatal(err)
 		return
 	}
 
+	// Perform the command instead of starting service if specified
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		count, err := order.MigrateAll(database)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Printf("Migrated [%d] orders to schema version [%d] and their indexes", count, order.CurrentSchemaVersion)
+		return
+	case "backup":
+		if err = backupOrders(database, flag.Args()[1:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	case "restore":
+		if err = restoreOrders(database, flag.Args()[1:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Create OrderProcessService instance and start.
-	service := service.NewOrderProcessService(&env.ServiceConfig)
+	service := service.NewOrderProcessService(&env.ServiceConfig, database)
 	err = service.Start(join)
 	if err != nil {
 		logrus.Fatal(err)
@@ -0,0 +1,285 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/model/order"
+)
+
+// The format of backup archive.
+// Every line is a json object: one header line, the entry lines and one trailer line,
+// the trailer carries the count and sha256 of all the entry lines.
+const (
+	BackupFormat  = "order_process-backup"
+	BackupVersion = 1
+	MaxLineLength = 16 * 1024 * 1024
+	// The count of entries written in one transaction when restoring
+	RestoreBatchSize = 100
+)
+
+var (
+	ErrBackupNotQuiescent = errors.New("Orders are changed during backup, the services should be stopped before backup")
+	ErrTargetNotEmpty     = errors.New("Target database is not empty, restore with -force to overwrite the entries")
+)
+
+// The type of lines
+const (
+	HeaderLine  = "header"
+	EntryLine   = "entry"
+	TrailerLine = "trailer"
+)
+
+// The definition of one line in backup archive
+type backupLine struct {
+	Type string `json:"type"`
+
+	// Header
+	Format    string `json:"format,omitempty"`
+	Version   int    `json:"version,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+
+	// Entry, the field of hash
+	Key     string `json:"key,omitempty"`
+	HashKey string `json:"hashkey,omitempty"`
+	Value   string `json:"value,omitempty"`
+
+	// Trailer
+	Count  int    `json:"count,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// The hashes included in backup
+func backupKeys(database db.IDatabase) ([]string, error) {
+	keys := []string{order.OrderTableName, order.OrderVersionTable}
+	for _, prefix := range []string{order.OrderStateInServiceTable + ":", order.OrderIndexTable + ":", order.OrderEventTable + ":"} {
+		prefixKeys, err := database.Keys(prefix)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, prefixKeys...)
+	}
+	return keys, nil
+}
+
+// Stream all the orders and their ownership entries into writer, the archived orders are kept in the archive files.
+// The hashes are read one by one rather than in a snapshot, so the services should be stopped before backup.
+// Fails if any order is saved during backup. Returns the count of entries.
+func Backup(database db.IDatabase, writer io.Writer) (int, error) {
+	keys, err := backupKeys(database)
+	if err != nil {
+		return 0, err
+	}
+	versions, err := db.QueryHash(database, order.OrderVersionTable)
+	if err != nil {
+		return 0, err
+	}
+
+	checksum := sha256.New()
+	writeLine := func(line *backupLine, h hash.Hash) error {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if h != nil {
+			h.Write(data)
+		}
+		_, err = writer.Write(data)
+		return err
+	}
+
+	err = writeLine(&backupLine{
+		Type:      HeaderLine,
+		Format:    BackupFormat,
+		Version:   BackupVersion,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range keys {
+		hash, err := db.QueryHash(database, key)
+		if err != nil {
+			return count, err
+		}
+		for hashkey, value := range hash {
+			err = writeLine(&backupLine{Type: EntryLine, Key: key, HashKey: hashkey, Value: value}, checksum)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	after, err := db.QueryHash(database, order.OrderVersionTable)
+	if err != nil {
+		return count, err
+	}
+	if !reflect.DeepEqual(versions, after) {
+		return count, ErrBackupNotQuiescent
+	}
+
+	err = writeLine(&backupLine{
+		Type:   TrailerLine,
+		Count:  count,
+		SHA256: hex.EncodeToString(checksum.Sum(nil)),
+	}, nil)
+	return count, err
+}
+
+// Verify the integrity of backup archive, returns the count of entries
+func Verify(reader io.Reader) (int, error) {
+	return scan(reader, nil)
+}
+
+// Restore the entries of backup archive into database, which should be empty unless force is specified.
+// The service ids are replaced according to remap if specified.
+// The archive should be verified before restoring, since the entries are written in batches while reading.
+// Without force, every entry is written only if it does not exist, so nothing is overwritten by restore.
+func Restore(database db.IDatabase, reader io.Reader, remap map[string]string, force bool) (int, error) {
+	if !force {
+		keys, err := backupKeys(database)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			hash, err := db.QueryHash(database, key)
+			if err != nil {
+				return 0, err
+			}
+			if len(hash) > 0 {
+				return 0, ErrTargetNotEmpty
+			}
+		}
+	}
+
+	var conditions []db.Condition
+	var mutations []db.Mutation
+	flush := func() error {
+		if len(mutations) == 0 {
+			return nil
+		}
+		err := database.Transact(conditions, mutations)
+		if err == db.ErrConditionFailed {
+			return ErrTargetNotEmpty
+		}
+		conditions, mutations = nil, nil
+		return err
+	}
+
+	count, err := scan(reader, func(line *backupLine) error {
+		key, value, err := remapEntry(line, remap)
+		if err != nil {
+			return err
+		}
+		if !force {
+			conditions = append(conditions, db.Condition{Key: key, HashKey: line.HashKey, Absent: true})
+		}
+		mutations = append(mutations, db.Mutation{Key: key, HashKey: line.HashKey, Value: value})
+		if len(mutations) >= RestoreBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, flush()
+}
+
+// Read all the lines and verify them, the entries are passed to fn
+func scan(reader io.Reader, fn func(line *backupLine) error) (int, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, MaxLineLength)
+	checksum := sha256.New()
+
+	count := 0
+	headerFound := false
+	for scanner.Scan() {
+		line := backupLine{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return count, err
+		}
+
+		switch {
+		case !headerFound:
+			if line.Type != HeaderLine || line.Format != BackupFormat {
+				return count, errors.New("Not an order backup archive")
+			}
+			if line.Version != BackupVersion {
+				return count, fmt.Errorf("Unsupported backup version [%d]", line.Version)
+			}
+			headerFound = true
+		case line.Type == EntryLine:
+			checksum.Write(scanner.Bytes())
+			checksum.Write([]byte{'\n'})
+			if fn != nil {
+				if err := fn(&line); err != nil {
+					return count, err
+				}
+			}
+			count++
+		case line.Type == TrailerLine:
+			if line.Count != count {
+				return count, fmt.Errorf("Entries count mismatch: expected [%d], found [%d]", line.Count, count)
+			}
+			if line.SHA256 != hex.EncodeToString(checksum.Sum(nil)) {
+				return count, errors.New("Backup checksum mismatch")
+			}
+			if scanner.Scan() {
+				return count, errors.New("Unexpected data after trailer")
+			}
+			return count, scanner.Err()
+		default:
+			return count, fmt.Errorf("Unknown line type [%s]", line.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	return count, errors.New("Backup archive is truncated")
+}
+
+// Replace the service ids in the hash name and order record of entry
+func remapEntry(line *backupLine, remap map[string]string) (string, string, error) {
+	key, value := line.Key, line.Value
+	if len(remap) == 0 {
+		return key, value, nil
+	}
+
+	prefix := order.OrderStateInServiceTable + ":"
+	if strings.HasPrefix(key, prefix) {
+		if serviceID, found := remap[strings.TrimPrefix(key, prefix)]; found {
+			key = prefix + serviceID
+		}
+	}
+
+	if key == order.OrderTableName {
+		t := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(value), &t); err != nil {
+			return "", "", err
+		}
+		if serviceID, found := remap[fmt.Sprint(t["service_id"])]; found {
+			t["service_id"] = serviceID
+			data, err := json.Marshal(t)
+			if err != nil {
+				return "", "", err
+			}
+			value = string(data)
+		}
+	}
+	return key, value, nil
+}
@@ -0,0 +1,133 @@
+package backup
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"order_process/process/db"
+	"order_process/process/model/order"
+)
+
+// The in-memory database which calls the interleave function once when the hash is queried
+type interleavedDatabase struct {
+	*db.MemoryDatabase
+	key        string
+	interleave func()
+}
+
+func (this *interleavedDatabase) Query(stmt string, args ...interface{}) ([]map[string]interface{}, error) {
+	if interleave := this.interleave; interleave != nil && args[0] == this.key {
+		this.interleave = nil
+		interleave()
+	}
+	return this.MemoryDatabase.Query(stmt, args...)
+}
+
+// Dump the hashes included in backup
+func dump(t *testing.T, database db.IDatabase) map[string]map[string]string {
+	keys, err := backupKeys(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[string]map[string]string)
+	for _, key := range keys {
+		hash, err := db.QueryHash(database, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hash) > 0 {
+			hashes[key] = hash
+		}
+	}
+	return hashes
+}
+
+// Create the orders of service
+func newOrders(t *testing.T, database db.IDatabase, count int) []*order.OrderRecord {
+	records := []*order.OrderRecord{}
+	for index := 0; index < count; index++ {
+		record, err := order.New(database, map[string]interface{}{"user_id": "user", "service_id": "service"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestBackupRestore(t *testing.T) {
+	source := db.NewMemoryDatabase()
+	newOrders(t, source, 3)
+
+	var buffer bytes.Buffer
+	count, err := Backup(source, &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified, err := Verify(bytes.NewReader(buffer.Bytes())); err != nil || verified != count {
+		t.Fatalf("verified %d of %d entries [%v]", verified, count, err)
+	}
+
+	target := db.NewMemoryDatabase()
+	if restored, err := Restore(target, bytes.NewReader(buffer.Bytes()), nil, false); err != nil || restored != count {
+		t.Fatalf("restored %d of %d entries [%v]", restored, count, err)
+	}
+	if expected, restored := dump(t, source), dump(t, target); !reflect.DeepEqual(expected, restored) {
+		t.Errorf("restored hashes differ\nexpected %v\nrestored %v", expected, restored)
+	}
+
+	// The database which is not empty is overwritten only with force
+	if _, err = Restore(target, bytes.NewReader(buffer.Bytes()), nil, false); err != ErrTargetNotEmpty {
+		t.Errorf("restore into database not empty got [%v]", err)
+	}
+	if _, err = Restore(target, bytes.NewReader(buffer.Bytes()), nil, true); err != nil {
+		t.Errorf("forced restore got [%v]", err)
+	}
+}
+
+func TestRestoreNeverOverwrites(t *testing.T) {
+	source := db.NewMemoryDatabase()
+	records := newOrders(t, source, 3)
+	var buffer bytes.Buffer
+	if _, err := Backup(source, &buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The order is written by others after the orders hash is checked empty
+	target := &interleavedDatabase{MemoryDatabase: db.NewMemoryDatabase(), key: order.OrderVersionTable}
+	target.interleave = func() {
+		target.MemoryDatabase.Write("taken", order.OrderTableName, records[0].OrderID)
+	}
+	if _, err := Restore(target, bytes.NewReader(buffer.Bytes()), nil, false); err != ErrTargetNotEmpty {
+		t.Errorf("restore got [%v]", err)
+	}
+	restored, err := db.QueryHash(target, order.OrderTableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, map[string]string{records[0].OrderID: "taken"}) {
+		t.Errorf("orders restored over the taken one %v", restored)
+	}
+}
+
+func TestBackupNotQuiescent(t *testing.T) {
+	database := &interleavedDatabase{MemoryDatabase: db.NewMemoryDatabase(), key: order.OrderTableName}
+	records := newOrders(t, database.MemoryDatabase, 2)
+
+	// The order is saved by the running service during backup
+	database.interleave = func() {
+		record, err := order.Get(database.MemoryDatabase, records[0].OrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record.Priority = order.OP_High.String()
+		if err = record.SaveToDB(order.OSS_Active.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buffer bytes.Buffer
+	if _, err := Backup(database, &buffer); err != ErrBackupNotQuiescent {
+		t.Errorf("backup got [%v]", err)
+	}
+}
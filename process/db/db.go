@@ -1,77 +1,96 @@
 package db
 
 import (
-	"github.com/Sirupsen/logrus"
-	"github.com/alphazero/Go-Redis"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// The supported database backends
+const (
+	BackendRedis  = "redis"
+	BackendFile   = "file"
+	BackendMemory = "memory"
 )
 
 // The database operation interface
 type IDatabase interface {
+	// Write the value(stmt) into the field(args[1]) of hash(args[0])
 	Write(stmt string, args ...interface{}) error
-	Read(stmt string, recordMap *map[string]interface{}, args ...interface{}) error
+	// Read the field(args[1]) of hash(args[0]) into recordMap
+	Read(stmt string, recordMap map[string]interface{}, args ...interface{}) error
+	// Query all the fields and values of hash(args[0])
 	Query(stmt string, args ...interface{}) ([]map[string]interface{}, error)
+	// Apply all the mutations atomically if all the conditions are matched
+	Transact(conditions []Condition, mutations []Mutation) error
+	// List the names of hashes starting with prefix
+	Keys(prefix string) ([]string, error)
 }
 
-// The definition of redis database client
-type RedisDatabase struct {
-	client redis.Client
+// The definition of transaction condition.
+// The field must hold exactly Value, or must not exist if Absent is set.
+type Condition struct {
+	Key     string
+	HashKey string
+	Value   string
+	Absent  bool
 }
 
-// The instance of redis database
-var redisDB RedisDatabase
+// The definition of transaction mutation, which writes Value into the field,
+// or removes the field if Delete is set.
+type Mutation struct {
+	Key     string
+	HashKey string
+	Value   string
+	Delete  bool
+}
 
-// Initialize database
-func InitDatabase(addr string, port int) error {
-	spec := redis.DefaultSpec().Host(addr).Port(port)
-	client, err := redis.NewSynchClientWithSpec(spec)
-	if err != nil {
-		return err
+// The error returned when any transaction condition is not matched
+var ErrConditionFailed = errors.New("Transaction condition not matched")
+
+// Create the database of specified backend, the file database is placed under path.
+func New(backend string, redisOptions *RedisOptions, path string) (IDatabase, error) {
+	switch backend {
+	case "", BackendRedis:
+		return NewRedisDatabase(redisOptions)
+	case BackendFile:
+		return NewFileDatabase(filepath.Join(path, FileDatabaseName))
+	case BackendMemory:
+		return NewMemoryDatabase(), nil
 	}
-	redisDB.client = client
-	return nil
+	return nil, fmt.Errorf("Unknown database backend: [%s]", backend)
 }
 
-// Write operation
-func Write(stmt string, args ...interface{}) error {
-	key := args[0].(string)
-	hashkey := args[1].(string)
-	err := redisDB.client.Hset(key, hashkey, []byte(stmt))
-	if err != nil {
-		return err
+// Pack the flat field/value list of a hash into query records,
+// every record is keyed by its index in the list.
+func toQueryRecords(result [][]byte) []map[string]interface{} {
+	var maps []map[string]interface{}
+	for index, bytes := range result {
+		record := map[string]interface{}{
+			QueryRecordKey(index): string(bytes),
+		}
+		maps = append(maps, record)
 	}
-	return nil
+	return maps
 }
 
-// Read operation
-func Read(stmt string, recordMap map[string]interface{}, args ...interface{}) error {
-	key := args[0].(string)
-	hashkey := args[1].(string)
-	result, err := redisDB.client.Hget(key, hashkey)
-	if err != nil {
-		logrus.Error(err)
-		return err
-	}
-	recordMap[hashkey] = result
-	return nil
+// The key of the query record at specified index
+func QueryRecordKey(index int) string {
+	return strconv.Itoa(index)
 }
 
-// Query operation
-func Query(stmt string, args ...interface{}) ([]map[string]interface{}, error) {
-	key := args[0].(string)
-	result, err := redisDB.client.Hgetall(key)
+// Query all the fields of hash(key) as field/value map
+func QueryHash(database IDatabase, key string) (map[string]string, error) {
+	records, err := database.Query("", key)
 	if err != nil {
-		logrus.Error(err)
 		return nil, err
 	}
 
-	var maps []map[string]interface{}
-	index := 0
-	for _, bytes := range result {
-		record := map[string]interface{}{
-			string(index): string(bytes),
-		}
-		maps = append(maps, record)
-		index++
+	hash := make(map[string]string)
+	for index := 0; index+1 < len(records); index += 2 {
+		field := records[index][QueryRecordKey(index)].(string)
+		hash[field] = records[index+1][QueryRecordKey(index+1)].(string)
 	}
-	return maps, nil
+	return hash, nil
 }
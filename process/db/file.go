@@ -0,0 +1,282 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The file name of file database, and the suffix of its lock file
+const (
+	FileDatabaseName = "order_process.db"
+	FileLockSuffix   = ".lock"
+)
+
+// The error returned when the file database is opened by other process
+var ErrDatabaseLocked = errors.New("File database is used by other process")
+
+// The definition of one field written by the log entry of file database
+type fileLogEntry struct {
+	Key     string `json:"key"`
+	HashKey string `json:"hashkey"`
+	Value   string `json:"value"`
+	Delete  bool   `json:"delete,omitempty"`
+}
+
+// The log file written by file database
+type logFile interface {
+	WriteString(s string) (int, error)
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Close() error
+}
+
+// The definition of embedded file database.
+// Every write is appended to a log file and synced to disk before it becomes
+// visible, the log is replayed into memory when the database is opened.
+// The database is opened by one process at a time, which holds the lock file next to the log.
+type FileDatabase struct {
+	path     string
+	file     logFile
+	lockFile *os.File
+	memory   *MemoryDatabase
+	lock     sync.Mutex
+}
+
+// The constructor of file database, ErrDatabaseLocked is returned if it is opened by other process
+func NewFileDatabase(path string) (*FileDatabase, error) {
+	database := FileDatabase{
+		path:   path,
+		memory: NewMemoryDatabase(),
+	}
+
+	// The log is replaced by compaction, so the lock is held on a separate file
+	var err error
+	database.lockFile, err = lockFile(path + FileLockSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Open file database [%s] failed [%v]", path, err)
+	}
+
+	entriesCount, err := database.replay()
+	if err == nil && entriesCount > 2*database.memory.fieldsCount() {
+		// Compact the log if it mostly contains overwritten entries
+		err = database.compact()
+	}
+	if err == nil {
+		database.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		database.lockFile.Close()
+		return nil, err
+	}
+	return &database, nil
+}
+
+// Write operation
+func (this *FileDatabase) Write(stmt string, args ...interface{}) error {
+	key := args[0].(string)
+	hashkey := args[1].(string)
+	return this.Transact(nil, []Mutation{{Key: key, HashKey: hashkey, Value: stmt}})
+}
+
+// Read operation
+func (this *FileDatabase) Read(stmt string, recordMap map[string]interface{}, args ...interface{}) error {
+	return this.memory.Read(stmt, recordMap, args...)
+}
+
+// Query operation
+func (this *FileDatabase) Query(stmt string, args ...interface{}) ([]map[string]interface{}, error) {
+	return this.memory.Query(stmt, args...)
+}
+
+// Keys operation
+func (this *FileDatabase) Keys(prefix string) ([]string, error) {
+	return this.memory.Keys(prefix)
+}
+
+// Transact operation, the mutations are appended as one log entry,
+// so they are either all replayed or all discarded after crash.
+// The log is truncated back if the entry fails to be appended, so it is never replayed.
+func (this *FileDatabase) Transact(conditions []Condition, mutations []Mutation) error {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+
+	defer this.memory.lock.Unlock()
+	this.memory.lock.Lock()
+
+	if !this.memory.matchConditions(conditions) {
+		return ErrConditionFailed
+	}
+
+	line, err := encodeFileLogEntry(mutations)
+	if err != nil {
+		return err
+	}
+	info, err := this.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = this.file.WriteString(line); err == nil {
+		err = this.file.Sync()
+	}
+	if err != nil {
+		if e := this.file.Truncate(info.Size()); e != nil {
+			logrus.Errorf("Truncate file database [%s] at offset [%d] failed [%v]", this.path, info.Size(), e)
+		}
+		return err
+	}
+	this.memory.applyMutations(mutations)
+	return nil
+}
+
+// Close the file database and release its lock
+func (this *FileDatabase) Close() error {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+	err := this.file.Close()
+	if e := this.lockFile.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Replay the log into memory, the torn entry left by a crash at the end of log is truncated.
+// The corrupted entry followed by others fails the replay, since the entries after it cannot be trusted.
+func (this *FileDatabase) replay() (int, error) {
+	file, err := os.OpenFile(this.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var offset int64
+	entriesCount := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		mutations, err := decodeFileLogEntry(line)
+		if err != nil {
+			if _, e := reader.Peek(1); e != io.EOF {
+				return 0, fmt.Errorf("Corrupted entry at offset [%d] of file database [%s] [%v]", offset, this.path, err)
+			}
+			break
+		}
+		this.memory.Transact(nil, mutations)
+		offset += int64(len(line))
+		entriesCount += len(mutations)
+	}
+
+	if info, err := file.Stat(); err == nil && info.Size() > offset {
+		logrus.Errorf("Truncate the corrupted tail of file database [%s] at offset [%d]", this.path, offset)
+		if err = file.Truncate(offset); err != nil {
+			return 0, err
+		}
+		if err = file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return entriesCount, nil
+}
+
+// Rewrite the log with the live entries only
+func (this *FileDatabase) compact() error {
+	tmpPath := this.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = this.memory.forEach(func(key string, hashkey string, value []byte) error {
+		line, err := encodeFileLogEntry([]Mutation{{Key: key, HashKey: hashkey, Value: string(value)}})
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString(line)
+		return err
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, this.path); err != nil {
+		return err
+	}
+
+	// Persist the rename
+	dir, err := os.Open(filepath.Dir(this.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Encode the mutations as one log entry line, prefixed with its checksum
+func encodeFileLogEntry(mutations []Mutation) (string, error) {
+	entry := []fileLogEntry{}
+	for _, mutation := range mutations {
+		entry = append(entry, fileLogEntry{
+			Key:     mutation.Key,
+			HashKey: mutation.HashKey,
+			Value:   mutation.Value,
+			Delete:  mutation.Delete,
+		})
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data), nil
+}
+
+// Decode the mutations from one log entry line and verify its checksum
+func decodeFileLogEntry(line string) ([]Mutation, error) {
+	line = strings.TrimSuffix(line, "\n")
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return nil, errors.New("Invalid log entry")
+	}
+
+	data := []byte(fields[1])
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)) != fields[0] {
+		return nil, errors.New("Log entry checksum mismatch")
+	}
+
+	entry := []fileLogEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	var mutations []Mutation
+	for _, field := range entry {
+		mutations = append(mutations, Mutation{
+			Key:     field.Key,
+			HashKey: field.HashKey,
+			Value:   field.Value,
+			Delete:  field.Delete,
+		})
+	}
+	return mutations, nil
+}
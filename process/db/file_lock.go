@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// Open the lock file and hold the exclusive lock of it until the file is closed,
+// ErrDatabaseLocked is returned if the lock is held by other process.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
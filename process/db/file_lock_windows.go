@@ -0,0 +1,27 @@
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// The error returned by windows when the file is opened by other process without sharing
+const errorSharingViolation syscall.Errno = 32
+
+// Open the lock file without sharing it until the file is closed,
+// ErrDatabaseLocked is returned if the file is opened by other process.
+func lockFile(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, ErrDatabaseLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
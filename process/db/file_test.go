@@ -0,0 +1,175 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Read the field of hash, empty if it does not exist
+func readField(t *testing.T, database IDatabase, key string, hashkey string) string {
+	recordMap := make(map[string]interface{})
+	if err := database.Read("", recordMap, key, hashkey); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := recordMap[hashkey].([]byte)
+	return string(value)
+}
+
+func TestFileDatabaseReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileDatabaseName)
+	database, err := NewFileDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Write("1", "hash", "a")
+	database.Transact([]Condition{{Key: "hash", HashKey: "a", Value: "1"}},
+		[]Mutation{{Key: "hash", HashKey: "a", Delete: true}, {Key: "hash", HashKey: "b", Value: "2"}})
+	if err = database.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err = NewFileDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if readField(t, database, "hash", "a") != "" || readField(t, database, "hash", "b") != "2" {
+		t.Errorf("replayed hash is %v", database.memory.hashes)
+	}
+}
+
+func TestFileDatabaseLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileDatabaseName)
+	database, err := NewFileDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewFileDatabase(path); err == nil || !strings.Contains(err.Error(), ErrDatabaseLocked.Error()) {
+		t.Fatalf("second open got [%v]", err)
+	}
+
+	database.Close()
+	database, err = NewFileDatabase(path)
+	if err != nil {
+		t.Fatalf("open after close got [%v]", err)
+	}
+	database.Close()
+}
+
+func TestFileDatabaseTruncatesTornTail(t *testing.T) {
+	for _, tail := range []string{"0badc0de [{\"key\":", "0badc0de [{\"key\":\"hash\"}]\n"} {
+		path := filepath.Join(t.TempDir(), FileDatabaseName)
+		database, err := NewFileDatabase(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		database.Write("1", "hash", "a")
+		database.Close()
+
+		file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		file.WriteString(tail)
+		file.Close()
+
+		database, err = NewFileDatabase(path)
+		if err != nil {
+			t.Fatalf("replay with tail [%s] got [%v]", tail, err)
+		}
+		if readField(t, database, "hash", "a") != "1" {
+			t.Errorf("entry before tail [%s] is lost", tail)
+		}
+		database.Write("2", "hash", "b")
+		database.Close()
+
+		// The new entries are appended after the truncated tail
+		database, err = NewFileDatabase(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readField(t, database, "hash", "b") != "2" {
+			t.Errorf("entry after tail [%s] is lost", tail)
+		}
+		database.Close()
+	}
+}
+
+func TestFileDatabaseRejectsCorruptedEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileDatabaseName)
+	database, err := NewFileDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Write("1", "hash", "a")
+	database.Write("2", "hash", "b")
+	database.Close()
+
+	// Corrupt the first entry, which is followed by a valid one
+	data, _ := os.ReadFile(path)
+	data[len(data)/4] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	if _, err = NewFileDatabase(path); err == nil || !strings.Contains(err.Error(), "Corrupted entry at offset [0]") {
+		t.Fatalf("replay got [%v]", err)
+	}
+	if after, _ := os.ReadFile(path); len(after) != len(data) {
+		t.Errorf("corrupted log is truncated")
+	}
+}
+
+// The log file which fails the append after writing part of the entry, or fails the sync after writing it
+type faultyLogFile struct {
+	*os.File
+	partial bool
+}
+
+func (this *faultyLogFile) WriteString(s string) (int, error) {
+	if this.partial {
+		n, _ := this.File.WriteString(s[:len(s)/2])
+		return n, errors.New("no space left on device")
+	}
+	return this.File.WriteString(s)
+}
+
+func (this *faultyLogFile) Sync() error {
+	return errors.New("input/output error")
+}
+
+func TestFileDatabaseTruncatesFailedAppend(t *testing.T) {
+	for _, partial := range []bool{true, false} {
+		path := filepath.Join(t.TempDir(), FileDatabaseName)
+		database, err := NewFileDatabase(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		database.Write("1", "hash", "a")
+		before, _ := os.ReadFile(path)
+
+		file := database.file.(*os.File)
+		database.file = &faultyLogFile{File: file, partial: partial}
+		if err = database.Write("2", "hash", "b"); err == nil {
+			t.Errorf("failed append with partial [%v] succeeded", partial)
+		}
+		if readField(t, database, "hash", "b") != "" {
+			t.Errorf("failed append with partial [%v] is visible", partial)
+		}
+		if after, _ := os.ReadFile(path); string(after) != string(before) {
+			t.Errorf("failed append with partial [%v] is left in log", partial)
+		}
+
+		// The next entry is appended after the truncated one
+		database.file = file
+		database.Write("3", "hash", "c")
+		database.Close()
+		database, err = NewFileDatabase(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readField(t, database, "hash", "a") != "1" || readField(t, database, "hash", "b") != "" || readField(t, database, "hash", "c") != "3" {
+			t.Errorf("replayed hash with partial [%v] is %v", partial, database.memory.hashes)
+		}
+		database.Close()
+	}
+}
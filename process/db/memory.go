@@ -0,0 +1,160 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The definition of in-memory database, which keeps the same hash
+// semantics as redis database. It is used when no redis server is available.
+type MemoryDatabase struct {
+	hashes map[string]map[string][]byte
+	lock   sync.RWMutex
+}
+
+// The constructor of in-memory database
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		hashes: make(map[string]map[string][]byte),
+	}
+}
+
+// Write operation
+func (this *MemoryDatabase) Write(stmt string, args ...interface{}) error {
+	key := args[0].(string)
+	hashkey := args[1].(string)
+
+	defer this.lock.Unlock()
+	this.lock.Lock()
+
+	this.applyMutations([]Mutation{{Key: key, HashKey: hashkey, Value: stmt}})
+	return nil
+}
+
+// Read operation, the result is nil if the field does not exist
+func (this *MemoryDatabase) Read(stmt string, recordMap map[string]interface{}, args ...interface{}) error {
+	key := args[0].(string)
+	hashkey := args[1].(string)
+
+	defer this.lock.RUnlock()
+	this.lock.RLock()
+
+	var result []byte
+	if value, found := this.hashes[key][hashkey]; found {
+		result = append([]byte{}, value...)
+	}
+	recordMap[hashkey] = result
+	return nil
+}
+
+// Query operation
+func (this *MemoryDatabase) Query(stmt string, args ...interface{}) ([]map[string]interface{}, error) {
+	key := args[0].(string)
+
+	defer this.lock.RUnlock()
+	this.lock.RLock()
+
+	hash := this.hashes[key]
+	hashkeys := make([]string, 0, len(hash))
+	for hashkey := range hash {
+		hashkeys = append(hashkeys, hashkey)
+	}
+	sort.Strings(hashkeys)
+
+	// Flatten as field/value list like HGETALL
+	var result [][]byte
+	for _, hashkey := range hashkeys {
+		result = append(result, []byte(hashkey), hash[hashkey])
+	}
+	return toQueryRecords(result), nil
+}
+
+// Transact operation
+func (this *MemoryDatabase) Transact(conditions []Condition, mutations []Mutation) error {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+
+	if !this.matchConditions(conditions) {
+		return ErrConditionFailed
+	}
+	this.applyMutations(mutations)
+	return nil
+}
+
+// Keys operation
+func (this *MemoryDatabase) Keys(prefix string) ([]string, error) {
+	defer this.lock.RUnlock()
+	this.lock.RLock()
+
+	keys := []string{}
+	for key := range this.hashes {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Check whether all the conditions are matched, the lock must be held by caller
+func (this *MemoryDatabase) matchConditions(conditions []Condition) bool {
+	for _, condition := range conditions {
+		value, found := this.hashes[condition.Key][condition.HashKey]
+		if condition.Absent {
+			if found {
+				return false
+			}
+		} else if !found || string(value) != condition.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply all the mutations, the lock must be held by caller
+func (this *MemoryDatabase) applyMutations(mutations []Mutation) {
+	for _, mutation := range mutations {
+		hash, found := this.hashes[mutation.Key]
+		if mutation.Delete {
+			// The hash disappears with its last field
+			delete(hash, mutation.HashKey)
+			if found && len(hash) == 0 {
+				delete(this.hashes, mutation.Key)
+			}
+			continue
+		}
+		if !found {
+			hash = make(map[string][]byte)
+			this.hashes[mutation.Key] = hash
+		}
+		hash[mutation.HashKey] = []byte(mutation.Value)
+	}
+}
+
+// Count the fields of all the hashes
+func (this *MemoryDatabase) fieldsCount() int {
+	defer this.lock.RUnlock()
+	this.lock.RLock()
+
+	count := 0
+	for _, hash := range this.hashes {
+		count += len(hash)
+	}
+	return count
+}
+
+// Loop all the fields of all the hashes
+func (this *MemoryDatabase) forEach(fn func(key string, hashkey string, value []byte) error) error {
+	defer this.lock.RUnlock()
+	this.lock.RLock()
+
+	for key, hash := range this.hashes {
+		for hashkey, value := range hash {
+			if err := fn(key, hashkey, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Create the in-memory database with the fields of hash
+func newMemoryHash(fields map[string]string) *MemoryDatabase {
+	database := NewMemoryDatabase()
+	for hashkey, value := range fields {
+		database.Write(value, "hash", hashkey)
+	}
+	return database
+}
+
+func TestMemoryTransactConditions(t *testing.T) {
+	cases := []struct {
+		name       string
+		conditions []Condition
+		matched    bool
+	}{
+		{name: "none", matched: true},
+		{name: "value matched", conditions: []Condition{{Key: "hash", HashKey: "a", Value: "1"}}, matched: true},
+		{name: "value mismatched", conditions: []Condition{{Key: "hash", HashKey: "a", Value: "2"}}},
+		{name: "value of missing field", conditions: []Condition{{Key: "hash", HashKey: "b", Value: ""}}},
+		{name: "value of missing hash", conditions: []Condition{{Key: "other", HashKey: "a", Value: "1"}}},
+		{name: "absent", conditions: []Condition{{Key: "hash", HashKey: "b", Absent: true}}, matched: true},
+		{name: "absent of missing hash", conditions: []Condition{{Key: "other", HashKey: "a", Absent: true}}, matched: true},
+		{name: "absent of existing field", conditions: []Condition{{Key: "hash", HashKey: "a", Absent: true}}},
+		{name: "empty value is present", conditions: []Condition{{Key: "hash", HashKey: "empty", Absent: true}}},
+		{name: "empty value matched", conditions: []Condition{{Key: "hash", HashKey: "empty", Value: ""}}, matched: true},
+		{
+			name: "all matched",
+			conditions: []Condition{
+				{Key: "hash", HashKey: "a", Value: "1"},
+				{Key: "hash", HashKey: "b", Absent: true},
+			},
+			matched: true,
+		},
+		{
+			name: "one mismatched",
+			conditions: []Condition{
+				{Key: "hash", HashKey: "a", Value: "1"},
+				{Key: "hash", HashKey: "a", Absent: true},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		database := newMemoryHash(map[string]string{"a": "1", "empty": ""})
+		err := database.Transact(c.conditions, []Mutation{{Key: "hash", HashKey: "c", Value: "3"}})
+		if c.matched && err != nil {
+			t.Errorf("%s: transact got [%v]", c.name, err)
+		}
+		if !c.matched && err != ErrConditionFailed {
+			t.Errorf("%s: transact got [%v], want [%v]", c.name, err, ErrConditionFailed)
+		}
+		if applied := readField(t, database, "hash", "c") == "3"; applied != c.matched {
+			t.Errorf("%s: mutation applied [%v]", c.name, applied)
+		}
+	}
+}
+
+func TestMemoryTransactMutations(t *testing.T) {
+	database := newMemoryHash(map[string]string{"a": "1", "b": "2"})
+
+	// The mutations are applied in order, and all or nothing
+	err := database.Transact([]Condition{{Key: "hash", HashKey: "a", Value: "1"}}, []Mutation{
+		{Key: "hash", HashKey: "a", Value: "10"},
+		{Key: "hash", HashKey: "a", Value: "11"},
+		{Key: "hash", HashKey: "b", Delete: true},
+		{Key: "hash", HashKey: "missing", Delete: true},
+		{Key: "other", HashKey: "x", Value: "y"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := QueryHash(database, "hash"); !reflect.DeepEqual(hash, map[string]string{"a": "11"}) {
+		t.Errorf("hash is %v", hash)
+	}
+	err = database.Transact([]Condition{{Key: "hash", HashKey: "a", Value: "1"}}, []Mutation{
+		{Key: "hash", HashKey: "a", Delete: true},
+		{Key: "other", HashKey: "x", Delete: true},
+	})
+	if err != ErrConditionFailed {
+		t.Errorf("stale transact got [%v]", err)
+	}
+	if readField(t, database, "hash", "a") != "11" || readField(t, database, "other", "x") != "y" {
+		t.Errorf("failed transact is applied")
+	}
+
+	// The hash disappears with its last field
+	if err = database.Transact(nil, []Mutation{{Key: "hash", HashKey: "a", Delete: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := database.Keys(""); !reflect.DeepEqual(keys, []string{"other"}) {
+		t.Errorf("keys are %v", keys)
+	}
+	if err = database.Transact([]Condition{{Key: "hash", HashKey: "a", Absent: true}}, nil); err != nil {
+		t.Errorf("deleted field is present [%v]", err)
+	}
+}
+
+func TestMemoryReadCopies(t *testing.T) {
+	database := newMemoryHash(map[string]string{"a": "1"})
+
+	// The value read is not shared with the database
+	recordMap := make(map[string]interface{})
+	database.Read("", recordMap, "hash", "a")
+	recordMap["a"].([]byte)[0] = '2'
+	if readField(t, database, "hash", "a") != "1" {
+		t.Errorf("stored value is changed by reader")
+	}
+
+	// The missing field is read as nil
+	database.Read("", recordMap, "hash", "missing")
+	if value, found := recordMap["missing"]; !found || value.([]byte) != nil {
+		t.Errorf("missing field is read as %#v", value)
+	}
+}
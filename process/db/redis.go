@@ -0,0 +1,429 @@
+package db
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The default options of redis connection pool
+const (
+	DefaultRedisPoolSize = 10
+	DefaultRedisTimeout  = 5 // in seconds
+)
+
+// The definition of redis connection options
+type RedisOptions struct {
+	Host     string
+	Port     int
+	Password string
+	// The index of logical database
+	DB int
+	// The max count of connections
+	PoolSize int
+	// The deadline of every call
+	Timeout time.Duration
+
+	// Connect over TLS, the server certificate is verified by CAFile if specified,
+	// or by system roots otherwise
+	TLS           bool
+	TLSCAFile     string
+	TLSServerName string
+
+	// Discover the master from sentinels ("host:port") instead of Host and Port
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+}
+
+// The error returned when redis server cannot be reached or the connection is broken
+type ConnectionError struct {
+	Addr string
+	Err  error
+}
+
+func (this *ConnectionError) Error() string {
+	return fmt.Sprintf("Redis connection [%s] failed: %v", this.Addr, this.Err)
+}
+
+// The definition of redis database client, backed by a pool of connections
+type RedisDatabase struct {
+	options   RedisOptions
+	tlsConfig *tls.Config
+	// The idle connections
+	idle chan *respConn
+	// The slots limiting the count of connections
+	slots chan bool
+}
+
+// The script applying the mutations if all the conditions are matched.
+// KEYS: the keys of conditions, then the keys of mutations
+// ARGV: the count of conditions, then (hashkey, absent, value) of every condition,
+// then (hashkey, delete, value) of every mutation
+const transactScript = `
+local count = tonumber(ARGV[1])
+local index = 2
+for i = 1, count do
+	local value = redis.call('HGET', KEYS[i], ARGV[index])
+	if ARGV[index + 1] == '1' then
+		if value then
+			return 0
+		end
+	elseif value ~= ARGV[index + 2] then
+		return 0
+	end
+	index = index + 3
+end
+for i = count + 1, #KEYS do
+	if ARGV[index + 1] == '1' then
+		redis.call('HDEL', KEYS[i], ARGV[index])
+	else
+		redis.call('HSET', KEYS[i], ARGV[index], ARGV[index + 2])
+	end
+	index = index + 3
+end
+return 1
+`
+
+// The constructor of redis database, the server is checked before return
+func NewRedisDatabase(options *RedisOptions) (*RedisDatabase, error) {
+	database := RedisDatabase{
+		options: *options,
+	}
+	if database.options.PoolSize <= 0 {
+		database.options.PoolSize = DefaultRedisPoolSize
+	}
+	if database.options.Timeout <= 0 {
+		database.options.Timeout = DefaultRedisTimeout * time.Second
+	}
+	database.idle = make(chan *respConn, database.options.PoolSize)
+	database.slots = make(chan bool, database.options.PoolSize)
+
+	if database.options.TLS {
+		database.tlsConfig = &tls.Config{ServerName: database.options.TLSServerName}
+		if database.options.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(database.options.TLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			database.tlsConfig.RootCAs = x509.NewCertPool()
+			if !database.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificate found in [%s]", database.options.TLSCAFile)
+			}
+		}
+	}
+	if len(database.options.SentinelAddrs) > 0 && database.options.SentinelMaster == "" {
+		return nil, errors.New("The name of sentinel master is required")
+	}
+
+	if _, err := database.do(false, "PING"); err != nil {
+		return nil, err
+	}
+	return &database, nil
+}
+
+// Write operation
+func (this *RedisDatabase) Write(stmt string, args ...interface{}) error {
+	key := args[0].(string)
+	hashkey := args[1].(string)
+	_, err := this.do(true, "HSET", key, hashkey, stmt)
+	return err
+}
+
+// Read operation
+func (this *RedisDatabase) Read(stmt string, recordMap map[string]interface{}, args ...interface{}) error {
+	key := args[0].(string)
+	hashkey := args[1].(string)
+	reply, err := this.do(true, "HGET", key, hashkey)
+	if err != nil {
+		return err
+	}
+	result, _ := reply.([]byte)
+	recordMap[hashkey] = result
+	return nil
+}
+
+// Query operation
+func (this *RedisDatabase) Query(stmt string, args ...interface{}) ([]map[string]interface{}, error) {
+	key := args[0].(string)
+	reply, err := this.do(true, "HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected reply of HGETALL")
+	}
+	var result [][]byte
+	for _, bytes := range replies {
+		value, _ := bytes.([]byte)
+		result = append(result, value)
+	}
+	return toQueryRecords(result), nil
+}
+
+// Transact operation, performed by server-side script
+func (this *RedisDatabase) Transact(conditions []Condition, mutations []Mutation) error {
+	keys := []string{}
+	argv := []string{strconv.Itoa(len(conditions))}
+	for _, condition := range conditions {
+		absent := "0"
+		if condition.Absent {
+			absent = "1"
+		}
+		keys = append(keys, condition.Key)
+		argv = append(argv, condition.HashKey, absent, condition.Value)
+	}
+	for _, mutation := range mutations {
+		remove := "0"
+		if mutation.Delete {
+			remove = "1"
+		}
+		keys = append(keys, mutation.Key)
+		argv = append(argv, mutation.HashKey, remove, mutation.Value)
+	}
+
+	// The script is not retried, since it may have been applied before the connection broke
+	args := append([]string{"EVAL", transactScript, strconv.Itoa(len(keys))}, keys...)
+	reply, err := this.do(false, append(args, argv...)...)
+	if err != nil {
+		return err
+	}
+	if applied, ok := reply.(int64); !ok || applied != 1 {
+		return ErrConditionFailed
+	}
+	return nil
+}
+
+// Keys operation, performed by SCAN to avoid blocking server
+func (this *RedisDatabase) Keys(prefix string) ([]string, error) {
+	// Escape the glob characters
+	pattern := ""
+	for _, c := range prefix {
+		if strings.ContainsRune(`*?[]\`, c) {
+			pattern += `\`
+		}
+		pattern += string(c)
+	}
+	pattern += "*"
+
+	found := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply, err := this.do(true, "SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		replies, _ := reply.([]interface{})
+		if len(replies) != 2 {
+			return nil, errors.New("Unexpected reply of SCAN")
+		}
+		names, _ := replies[1].([]interface{})
+		for _, name := range names {
+			found[string(toBytes(name))] = true
+		}
+
+		// The keys may be returned more than once during a full iteration
+		cursor = string(toBytes(replies[0]))
+		if cursor == "0" {
+			break
+		}
+	}
+
+	keys := []string{}
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Close all the idle connections
+func (this *RedisDatabase) Close() error {
+	for {
+		select {
+		case conn := <-this.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Perform the command on a pooled connection within the deadline.
+// The broken connection is dropped, and the idempotent command is retried once on a new connection.
+// The idle connection is checked before performing the command which cannot be retried.
+func (this *RedisDatabase) do(idempotent bool, args ...string) (interface{}, error) {
+	reply, err := this.doOnce(!idempotent, args...)
+	if _, ok := err.(*ConnectionError); ok && idempotent {
+		reply, err = this.doOnce(false, args...)
+	}
+	return reply, err
+}
+
+// Perform the command once
+func (this *RedisDatabase) doOnce(checkIdle bool, args ...string) (interface{}, error) {
+	// Wait for a free slot of pool
+	timer := time.NewTimer(this.options.Timeout)
+	defer timer.Stop()
+	select {
+	case this.slots <- true:
+	case <-timer.C:
+		return nil, &ConnectionError{Addr: this.masterName(), Err: errors.New("Wait for free connection timeout")}
+	}
+	defer func() { <-this.slots }()
+
+	var conn *respConn
+	select {
+	case conn = <-this.idle:
+		if checkIdle {
+			conn.SetDeadline(time.Now().Add(this.options.Timeout))
+			if _, err := conn.Do("PING"); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+	default:
+	}
+	if conn == nil {
+		var err error
+		conn, err = this.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(this.options.Timeout))
+	reply, err := conn.Do(args...)
+	if respErr, ok := err.(*RespError); err != nil && (!ok || isReadOnlyError(respErr)) {
+		// The server is unreachable, or demoted to replica by failover
+		conn.Close()
+		return nil, &ConnectionError{Addr: conn.addr, Err: err}
+	}
+	this.idle <- conn
+	return reply, err
+}
+
+// Connect to the master, authenticate and select the database
+func (this *RedisDatabase) dial() (*respConn, error) {
+	addr := net.JoinHostPort(this.options.Host, strconv.Itoa(this.options.Port))
+	if len(this.options.SentinelAddrs) > 0 {
+		var err error
+		addr, err = this.discoverMaster()
+		if err != nil {
+			return nil, &ConnectionError{Addr: this.masterName(), Err: err}
+		}
+	}
+
+	conn, err := dialResp(addr, this.tlsConfig, this.options.Timeout)
+	if err != nil {
+		return nil, &ConnectionError{Addr: addr, Err: err}
+	}
+	conn.SetDeadline(time.Now().Add(this.options.Timeout))
+
+	err = this.setupConn(conn)
+	if _, ok := err.(*RespError); err != nil && !ok {
+		err = &ConnectionError{Addr: addr, Err: err}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Authenticate and select the database on new connection
+func (this *RedisDatabase) setupConn(conn *respConn) error {
+	if this.options.Password != "" {
+		if _, err := conn.Do("AUTH", this.options.Password); err != nil {
+			return err
+		}
+	}
+	if this.options.DB != 0 {
+		if _, err := conn.Do("SELECT", strconv.Itoa(this.options.DB)); err != nil {
+			return err
+		}
+	}
+	if len(this.options.SentinelAddrs) > 0 {
+		// The master discovered may be demoted during connecting
+		reply, err := conn.Do("ROLE")
+		if err != nil {
+			return err
+		}
+		role, _ := reply.([]interface{})
+		if len(role) == 0 || string(toBytes(role[0])) != "master" {
+			return fmt.Errorf("Server [%s] is not master", conn.addr)
+		}
+	}
+	return nil
+}
+
+// Ask the sentinels for the address of master
+func (this *RedisDatabase) discoverMaster() (string, error) {
+	var lastErr error
+	for _, sentinelAddr := range this.options.SentinelAddrs {
+		addr, err := this.askSentinel(sentinelAddr)
+		if err == nil {
+			return addr, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// Ask one sentinel for the address of master
+func (this *RedisDatabase) askSentinel(sentinelAddr string) (string, error) {
+	conn, err := dialResp(sentinelAddr, this.tlsConfig, this.options.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(this.options.Timeout))
+
+	if this.options.SentinelPassword != "" {
+		if _, err := conn.Do("AUTH", this.options.SentinelPassword); err != nil {
+			return "", err
+		}
+	}
+	reply, err := conn.Do("SENTINEL", "get-master-addr-by-name", this.options.SentinelMaster)
+	if err != nil {
+		return "", err
+	}
+	master, _ := reply.([]interface{})
+	if len(master) != 2 {
+		return "", fmt.Errorf("Sentinel [%s] does not know master [%s]", sentinelAddr, this.options.SentinelMaster)
+	}
+	return net.JoinHostPort(string(toBytes(master[0])), string(toBytes(master[1]))), nil
+}
+
+// The name of master used in error
+func (this *RedisDatabase) masterName() string {
+	if len(this.options.SentinelAddrs) > 0 {
+		return "sentinel:" + this.options.SentinelMaster
+	}
+	return net.JoinHostPort(this.options.Host, strconv.Itoa(this.options.Port))
+}
+
+// Check whether the error is replied by a replica for write command
+func isReadOnlyError(err *RespError) bool {
+	return strings.HasPrefix(err.Message, "READONLY")
+}
+
+// Convert the bulk or simple string reply to bytes
+func toBytes(reply interface{}) []byte {
+	switch value := reply.(type) {
+	case []byte:
+		return value
+	case string:
+		return []byte(value)
+	}
+	return nil
+}
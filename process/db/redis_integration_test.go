@@ -0,0 +1,261 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"order_process/process/util"
+)
+
+// The integration tests run against the real redis servers specified by the environment variables,
+// and are skipped if they are not set:
+//
+//	REDIS_TEST_ADDR                 the "host:port" of redis server
+//	REDIS_TEST_PASSWORD             the password of redis servers, empty if AUTH is not required
+//	REDIS_TEST_TLS_ADDR             the "host:port" of redis server serving TLS
+//	REDIS_TEST_TLS_CA               the CA file verifying the TLS server, system roots if empty
+//	REDIS_TEST_TLS_SERVER_NAME      the name of TLS server, the host of address if empty
+//	REDIS_TEST_SENTINELS            the "host:port" of sentinels separated by comma
+//	REDIS_TEST_SENTINEL_MASTER      the name of master monitored by sentinels
+//	REDIS_TEST_SENTINEL_PASSWORD    the password of sentinels
+//	REDIS_TEST_FAILOVER             "1" to fail over the master of sentinels
+
+// The seconds waiting for the master promoted by failover
+const IntegrationFailoverTimeout = 60
+
+// Get the environment variable, or skip the test if it is not set
+func requireEnv(t *testing.T, name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		t.Skipf("%s is not set", name)
+	}
+	return value
+}
+
+// The options connecting to the redis server of address
+func integrationOptions(t *testing.T, addr string) *RedisOptions {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := &RedisOptions{Host: host, Password: os.Getenv("REDIS_TEST_PASSWORD"), Timeout: 5 * time.Second}
+	if options.Port, err = strconv.Atoi(port); err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+// The options discovering the master from sentinels
+func sentinelOptions(t *testing.T) *RedisOptions {
+	return &RedisOptions{
+		Password:         os.Getenv("REDIS_TEST_PASSWORD"),
+		Timeout:          5 * time.Second,
+		SentinelAddrs:    strings.Split(requireEnv(t, "REDIS_TEST_SENTINELS"), ","),
+		SentinelMaster:   requireEnv(t, "REDIS_TEST_SENTINEL_MASTER"),
+		SentinelPassword: os.Getenv("REDIS_TEST_SENTINEL_PASSWORD"),
+	}
+}
+
+// Connect to the redis server, the keys written by test are removed when the test is finished
+func connectIntegration(t *testing.T, options *RedisOptions) (*RedisDatabase, string) {
+	database, err := NewRedisDatabase(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "IntegrationTest:" + util.NewUUID()
+	t.Cleanup(func() {
+		database.do(false, "DEL", key)
+		database.Close()
+	})
+	return database, key
+}
+
+// Check the commands of database are performed by the server
+func checkRoundTrip(t *testing.T, database *RedisDatabase, key string) {
+	if err := database.Write("1", key, "a"); err != nil {
+		t.Fatalf("write got [%v]", err)
+	}
+	err := database.Transact([]Condition{{Key: key, HashKey: "a", Value: "1"}, {Key: key, HashKey: "b", Absent: true}},
+		[]Mutation{{Key: key, HashKey: "a", Delete: true}, {Key: key, HashKey: "b", Value: "2"}})
+	if err != nil {
+		t.Fatalf("transact got [%v]", err)
+	}
+	hash, err := QueryHash(database, key)
+	if err != nil || len(hash) != 1 || hash["b"] != "2" {
+		t.Errorf("query got %v [%v]", hash, err)
+	}
+	keys, err := database.Keys(key)
+	if err != nil || len(keys) != 1 || keys[0] != key {
+		t.Errorf("keys got %v [%v]", keys, err)
+	}
+}
+
+// The role of the server serving the database
+func serverRole(database *RedisDatabase) (string, error) {
+	reply, err := database.do(false, "ROLE")
+	if err != nil {
+		return "", err
+	}
+	role, _ := reply.([]interface{})
+	if len(role) == 0 {
+		return "", fmt.Errorf("Invalid role reply %#v", reply)
+	}
+	return string(toBytes(role[0])), nil
+}
+
+func TestIntegrationRedisAuth(t *testing.T) {
+	options := integrationOptions(t, requireEnv(t, "REDIS_TEST_ADDR"))
+	database, key := connectIntegration(t, options)
+	checkRoundTrip(t, database, key)
+
+	if options.Password == "" {
+		t.Skip("REDIS_TEST_PASSWORD is not set")
+	}
+	// The wrong password is replied by the server, not reported as connection failure
+	options.Password = "wrong-" + options.Password
+	if _, err := NewRedisDatabase(options); err == nil {
+		t.Errorf("connect with wrong password succeeded")
+	} else if _, ok := err.(*RespError); !ok {
+		t.Errorf("connect with wrong password got [%v]", err)
+	}
+	options.Password = ""
+	if _, err := NewRedisDatabase(options); err == nil {
+		t.Errorf("connect without password succeeded")
+	}
+}
+
+func TestIntegrationRedisTLS(t *testing.T) {
+	options := integrationOptions(t, requireEnv(t, "REDIS_TEST_TLS_ADDR"))
+	options.TLS = true
+	options.TLSCAFile = os.Getenv("REDIS_TEST_TLS_CA")
+	options.TLSServerName = os.Getenv("REDIS_TEST_TLS_SERVER_NAME")
+	if options.TLSServerName == "" {
+		options.TLSServerName = options.Host
+	}
+	database, key := connectIntegration(t, options)
+	checkRoundTrip(t, database, key)
+
+	// The server is not verified with other name
+	options.TLSServerName = "unknown.invalid"
+	if _, err := NewRedisDatabase(options); err == nil {
+		t.Errorf("connect to TLS server of other name succeeded")
+	}
+	// The plain connection is refused by TLS server
+	options.TLS = false
+	options.Timeout = time.Second
+	if _, err := NewRedisDatabase(options); err == nil {
+		t.Errorf("connect to TLS server without TLS succeeded")
+	}
+}
+
+func TestIntegrationSentinel(t *testing.T) {
+	options := sentinelOptions(t)
+	database, key := connectIntegration(t, options)
+	checkRoundTrip(t, database, key)
+
+	// The master reported by sentinels is connected
+	master, err := database.discoverMaster()
+	if err != nil {
+		t.Fatalf("discover master got [%v]", err)
+	}
+	if role, err := serverRole(database); err != nil || role != "master" {
+		t.Errorf("connected to [%s] of [%s] [%v]", role, master, err)
+	}
+
+	// The sentinels unreachable are skipped
+	options.SentinelAddrs = append([]string{"127.0.0.1:1"}, options.SentinelAddrs...)
+	if _, err = NewRedisDatabase(options); err != nil {
+		t.Errorf("connect with sentinel unreachable got [%v]", err)
+	}
+	options.SentinelMaster = "unknown-" + util.NewUUID()
+	if _, err = NewRedisDatabase(options); err == nil {
+		t.Errorf("connect to unknown master succeeded")
+	}
+}
+
+func TestIntegrationSentinelFailover(t *testing.T) {
+	options := sentinelOptions(t)
+	if os.Getenv("REDIS_TEST_FAILOVER") != "1" {
+		t.Skip("REDIS_TEST_FAILOVER is not set")
+	}
+	database, key := connectIntegration(t, options)
+	if err := database.Write("1", key, "a"); err != nil {
+		t.Fatal(err)
+	}
+	master, err := database.discoverMaster()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail over the master by sentinel, the pooled connections are kept to the old master
+	sentinel, err := dialResp(options.SentinelAddrs[0], nil, options.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sentinel.Close()
+	sentinel.SetDeadline(time.Now().Add(options.Timeout))
+	if options.SentinelPassword != "" {
+		if _, err = sentinel.Do("AUTH", options.SentinelPassword); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = sentinel.Do("SENTINEL", "failover", options.SentinelMaster); err != nil {
+		t.Fatalf("failover got [%v]", err)
+	}
+
+	deadline := time.Now().Add(time.Second * IntegrationFailoverTimeout)
+	promoted := master
+	for promoted == master {
+		if time.Now().After(deadline) {
+			t.Fatalf("master [%s] is not failed over", master)
+		}
+		time.Sleep(500 * time.Millisecond)
+		if promoted, err = database.discoverMaster(); err != nil {
+			promoted = master
+		}
+	}
+
+	// The pooled connections to the demoted master are dropped, until the write is performed by the promoted one
+	for {
+		err = database.Write("2", key, "a")
+		role := ""
+		if err == nil {
+			role, err = serverRole(database)
+		}
+		if err == nil && role == "master" && promotedValue(t, options, promoted, key) == "2" {
+			break
+		}
+		if _, ok := err.(*ConnectionError); err != nil && !ok {
+			t.Fatalf("write after failover got [%v]", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("write is not performed by promoted master [%s] [%v]", promoted, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Read the value of key from the promoted master directly
+func promotedValue(t *testing.T, options *RedisOptions, addr string, key string) string {
+	conn, err := dialResp(addr, nil, options.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(options.Timeout))
+	if options.Password != "" {
+		if _, err = conn.Do("AUTH", options.Password); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply, err := conn.Do("HGET", key, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(toBytes(reply))
+}
@@ -0,0 +1,436 @@
+package db
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The replies of fake server which close the connection, or hold it without reply
+const (
+	replyClose = "close"
+	replyHang  = "hang"
+)
+
+// The fake redis server replying the commands by handler
+type fakeServer struct {
+	listener net.Listener
+	handler  func(args []string) string
+	// Released when the test is finished
+	hang chan bool
+
+	lock     sync.Mutex
+	commands map[string]int
+	accepted int
+}
+
+// The constructor of fake server, PING is replied if the handler returns empty
+func newFakeServer(t *testing.T, handler func(args []string) string) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeServer{
+		listener: listener,
+		handler:  handler,
+		hang:     make(chan bool),
+		commands: make(map[string]int),
+	}
+	t.Cleanup(func() {
+		close(server.hang)
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.accepted++
+			server.lock.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// Serve the commands of one connection
+func (this *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRequest(reader)
+		if err != nil {
+			return
+		}
+		this.lock.Lock()
+		this.commands[args[0]]++
+		this.lock.Unlock()
+
+		reply := ""
+		if this.handler != nil {
+			reply = this.handler(args)
+		}
+		switch {
+		case reply == replyClose:
+			return
+		case reply == replyHang:
+			<-this.hang
+			return
+		case reply == "" && args[0] == "PING":
+			reply = "+PONG\r\n"
+		case reply == "":
+			reply = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// The count of command received
+func (this *fakeServer) count(command string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.commands[command]
+}
+
+// The count of connections accepted
+func (this *fakeServer) connections() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.accepted
+}
+
+// The options connecting to the fake server
+func (this *fakeServer) options(timeout time.Duration) *RedisOptions {
+	addr := this.listener.Addr().(*net.TCPAddr)
+	return &RedisOptions{Host: addr.IP.String(), Port: addr.Port, PoolSize: 2, Timeout: timeout}
+}
+
+// Read one command sent as array of bulk strings
+func readRequest(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for i := 0; i < count; i++ {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func TestReadReply(t *testing.T) {
+	cases := []struct {
+		raw      string
+		expected interface{}
+		err      string
+	}{
+		{raw: "+OK\r\n", expected: "OK"},
+		{raw: ":42\r\n", expected: int64(42)},
+		{raw: "$5\r\nhello\r\n", expected: []byte("hello")},
+		{raw: "$-1\r\n", expected: nil},
+		{raw: "-ERR wrong\r\n", err: "ERR wrong"},
+		{
+			raw:      "*4\r\n$1\r\na\r\n-ERR inside\r\n$-1\r\n*1\r\n:1\r\n",
+			expected: []interface{}{[]byte("a"), &RespError{Message: "ERR inside"}, nil, []interface{}{int64(1)}},
+		},
+		{raw: "?what\r\n", err: "Unknown reply: [?what]"},
+		{raw: "+OK\n", err: "Invalid reply line"},
+	}
+
+	for _, c := range cases {
+		conn := &respConn{reader: bufio.NewReader(strings.NewReader(c.raw))}
+		reply, err := conn.readReply()
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("reply %q got error [%v], want [%s]", c.raw, err, c.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(reply, c.expected) {
+			t.Errorf("reply %q got %#v [%v], want %#v", c.raw, reply, err, c.expected)
+		}
+	}
+}
+
+func TestRespPipelinedReplies(t *testing.T) {
+	server := newFakeServer(t, func(args []string) string {
+		if args[0] == "ECHO" {
+			return "$" + strconv.Itoa(len(args[1])) + "\r\n" + args[1] + "\r\n"
+		}
+		return ""
+	})
+	conn, err := dialResp(server.listener.Addr().String(), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Send the commands at once, the replies are read in order
+	request := "*1\r\n$4\r\nPING\r\n*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n*1\r\n$3\r\nBAD\r\n*1\r\n$4\r\nPING\r\n"
+	if _, err = io.WriteString(conn.conn, request); err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"PONG", []byte("hi"), nil, "PONG"}
+	for index, want := range expected {
+		reply, err := conn.readReply()
+		if index == 2 {
+			if _, ok := err.(*RespError); !ok {
+				t.Errorf("reply %d got error [%v]", index, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(reply, want) {
+			t.Errorf("reply %d got %#v [%v], want %#v", index, reply, err, want)
+		}
+	}
+}
+
+func TestRedisErrorReply(t *testing.T) {
+	server := newFakeServer(t, func(args []string) string {
+		switch {
+		case args[0] == "HSET" && args[1] == "readonly":
+			return "-READONLY You can't write against a read only replica.\r\n"
+		case args[0] == "HSET":
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		case args[0] == "HGETALL":
+			return "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n"
+		case args[0] == "EVAL":
+			return ":0\r\n"
+		}
+		return ""
+	})
+	database, err := NewRedisDatabase(server.options(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// The error reply is returned as is, and the connection is kept
+	err = database.Write("1", "hash", "a")
+	if respErr, ok := err.(*RespError); !ok || !strings.HasPrefix(respErr.Message, "WRONGTYPE") {
+		t.Errorf("write got [%v]", err)
+	}
+	hash, err := QueryHash(database, "hash")
+	if err != nil || !reflect.DeepEqual(hash, map[string]string{"a": "1", "b": "2"}) {
+		t.Errorf("query got %v [%v]", hash, err)
+	}
+	if err = database.Transact(nil, []Mutation{{Key: "hash", HashKey: "a", Value: "1"}}); err != ErrConditionFailed {
+		t.Errorf("transact got [%v]", err)
+	}
+	if server.connections() != 1 {
+		t.Errorf("%d connections opened", server.connections())
+	}
+
+	// The replica is dropped and retried once on a new connection
+	err = database.Write("1", "readonly", "a")
+	if _, ok := err.(*ConnectionError); !ok {
+		t.Errorf("write to replica got [%v]", err)
+	}
+	if server.count("HSET") != 3 || server.connections() != 2 {
+		t.Errorf("HSET sent %d times on %d connections", server.count("HSET"), server.connections())
+	}
+}
+
+func TestRedisPoolExhausted(t *testing.T) {
+	server := newFakeServer(t, func(args []string) string {
+		if args[0] == "HGET" {
+			time.Sleep(10 * time.Millisecond)
+			return "$1\r\n1\r\n"
+		}
+		return ""
+	})
+	database, err := NewRedisDatabase(server.options(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// All the slots are taken by others
+	for i := 0; i < database.options.PoolSize; i++ {
+		database.slots <- true
+	}
+	err = database.Read("", map[string]interface{}{}, "hash", "a")
+	if connErr, ok := err.(*ConnectionError); !ok || !strings.Contains(connErr.Err.Error(), "Wait for free connection timeout") {
+		t.Errorf("read with exhausted pool got [%v]", err)
+	}
+	for i := 0; i < database.options.PoolSize; i++ {
+		<-database.slots
+	}
+
+	// The concurrent calls share the connections of pool
+	var group sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			recordMap := make(map[string]interface{})
+			if err := database.Read("", recordMap, "hash", "a"); err != nil || string(recordMap["a"].([]byte)) != "1" {
+				t.Errorf("concurrent read got %v [%v]", recordMap, err)
+			}
+		}()
+	}
+	group.Wait()
+	if server.connections() > database.options.PoolSize {
+		t.Errorf("%d connections opened with pool size %d", server.connections(), database.options.PoolSize)
+	}
+}
+
+func TestRedisTimeout(t *testing.T) {
+	server := newFakeServer(t, func(args []string) string {
+		if args[0] == "HGET" || args[0] == "EVAL" {
+			return replyHang
+		}
+		return ""
+	})
+	database, err := NewRedisDatabase(server.options(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// The idempotent command is retried once
+	err = database.Read("", map[string]interface{}{}, "hash", "a")
+	if _, ok := err.(*ConnectionError); !ok {
+		t.Errorf("read got [%v]", err)
+	}
+	if server.count("HGET") != 2 {
+		t.Errorf("HGET sent %d times", server.count("HGET"))
+	}
+
+	// The script is never retried
+	err = database.Transact(nil, []Mutation{{Key: "hash", HashKey: "a", Value: "1"}})
+	if _, ok := err.(*ConnectionError); !ok {
+		t.Errorf("transact got [%v]", err)
+	}
+	if server.count("EVAL") != 1 {
+		t.Errorf("EVAL sent %d times", server.count("EVAL"))
+	}
+}
+
+func TestRedisRetryBrokenConnection(t *testing.T) {
+	var lock sync.Mutex
+	broken := map[string]bool{}
+	server := newFakeServer(t, func(args []string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		if args[0] == "HGET" || args[0] == "EVAL" {
+			// Break the connection at the first time
+			if !broken[args[0]] {
+				broken[args[0]] = true
+				return replyClose
+			}
+			if args[0] == "HGET" {
+				return "$1\r\n1\r\n"
+			}
+			return ":1\r\n"
+		}
+		return ""
+	})
+	database, err := NewRedisDatabase(server.options(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	recordMap := make(map[string]interface{})
+	if err = database.Read("", recordMap, "hash", "a"); err != nil || string(recordMap["a"].([]byte)) != "1" {
+		t.Errorf("read got %v [%v]", recordMap, err)
+	}
+	if server.count("HGET") != 2 {
+		t.Errorf("HGET sent %d times", server.count("HGET"))
+	}
+
+	// The script broken may have been applied, so it is failed without retry
+	if err = database.Transact(nil, []Mutation{{Key: "hash", HashKey: "a", Value: "1"}}); err == nil {
+		t.Errorf("broken transact succeeded")
+	}
+	if err = database.Transact(nil, []Mutation{{Key: "hash", HashKey: "a", Value: "1"}}); err != nil {
+		t.Errorf("transact got [%v]", err)
+	}
+	if server.count("EVAL") != 2 {
+		t.Errorf("EVAL sent %d times", server.count("EVAL"))
+	}
+}
+
+func TestSentinelDemotedMaster(t *testing.T) {
+	var lock sync.Mutex
+	role := "slave"
+	master := newFakeServer(t, func(args []string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		switch args[0] {
+		case "ROLE":
+			return "*1\r\n$" + strconv.Itoa(len(role)) + "\r\n" + role + "\r\n"
+		case "HSET":
+			return ":1\r\n"
+		}
+		return ""
+	})
+	addr := master.listener.Addr().(*net.TCPAddr)
+	host, port := addr.IP.String(), strconv.Itoa(addr.Port)
+	sentinel := newFakeServer(t, func(args []string) string {
+		if args[0] == "SENTINEL" && args[1] == "get-master-addr-by-name" && args[2] == "mymaster" {
+			return "*2\r\n$" + strconv.Itoa(len(host)) + "\r\n" + host + "\r\n$" + strconv.Itoa(len(port)) + "\r\n" + port + "\r\n"
+		}
+		if args[0] == "SENTINEL" {
+			return "*-1\r\n"
+		}
+		return ""
+	})
+	options := &RedisOptions{
+		PoolSize:       2,
+		Timeout:        time.Second,
+		SentinelAddrs:  []string{"127.0.0.1:1", sentinel.listener.Addr().String()},
+		SentinelMaster: "mymaster",
+	}
+
+	// The server reported by sentinel is not connected until it is promoted
+	_, err := NewRedisDatabase(options)
+	if connErr, ok := err.(*ConnectionError); !ok || !strings.Contains(connErr.Err.Error(), "is not master") {
+		t.Errorf("connect to replica got [%v]", err)
+	}
+	lock.Lock()
+	role = "master"
+	lock.Unlock()
+	database, err := NewRedisDatabase(options)
+	if err != nil {
+		t.Fatalf("connect to master got [%v]", err)
+	}
+	defer database.Close()
+	if err = database.Write("1", "hash", "a"); err != nil {
+		t.Errorf("write got [%v]", err)
+	}
+
+	// The unknown master is reported by sentinel
+	options.SentinelMaster = "unknown"
+	if _, err = NewRedisDatabase(options); err == nil || !strings.Contains(err.Error(), "does not know master") {
+		t.Errorf("connect to unknown master got [%v]", err)
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The definition of error replied by redis server
+type RespError struct {
+	Message string
+}
+
+func (this *RespError) Error() string {
+	return this.Message
+}
+
+// The connection speaking redis protocol
+type respConn struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connect to redis server, over TLS if tlsConfig is specified
+func dialResp(addr string, tlsConfig *tls.Config, timeout time.Duration) (*respConn, error) {
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{
+		addr:   addr,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+// Send the command and read its reply
+func (this *respConn) Do(args ...string) (interface{}, error) {
+	request := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		request += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(this.conn, request); err != nil {
+		return nil, err
+	}
+	return this.readReply()
+}
+
+// Set the deadline of following calls
+func (this *respConn) SetDeadline(deadline time.Time) error {
+	return this.conn.SetDeadline(deadline)
+}
+
+// Close the connection
+func (this *respConn) Close() error {
+	return this.conn.Close()
+}
+
+// Read one reply from server
+func (this *respConn) readReply() (interface{}, error) {
+	line, err := this.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("Empty reply line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, &RespError{Message: line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(this.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			// Error replies inside array are kept as values
+			replies[i], err = this.readReply()
+			if respErr, ok := err.(*RespError); ok {
+				replies[i] = respErr
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("Unknown reply: [%s]", line)
+}
+
+// Read one line without the trailing CRLF
+func (this *respConn) readLine() (string, error) {
+	line, err := this.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("Invalid reply line")
+	}
+	return line[:len(line)-2], nil
+}
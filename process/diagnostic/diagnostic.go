@@ -8,8 +8,11 @@ import (
 
 	"github.com/Sirupsen/logrus"
 
+	"order_process/process/db"
 	"order_process/process/env"
 	"order_process/process/model/cluster"
+	"order_process/process/model/order"
+	"order_process/process/model/pipeline"
 )
 
 const (
@@ -18,15 +21,20 @@ const (
 
 // The definition of heart beat check
 type Diagnostic struct {
-	serviceID string
-	cluster   cluster.ICluster
+	serviceID       string
+	cluster         cluster.ICluster
+	pipelineManager pipeline.IPipelineManager
+	database        db.IDatabase
 }
 
 // The constructor of heart beat check
-func New(serviceID string, cluster cluster.ICluster) *Diagnostic {
+func New(serviceID string, cluster cluster.ICluster, pipelineManager pipeline.IPipelineManager,
+	database db.IDatabase) *Diagnostic {
 	return &Diagnostic{
-		serviceID: serviceID,
-		cluster:   cluster,
+		serviceID:       serviceID,
+		cluster:         cluster,
+		pipelineManager: pipelineManager,
+		database:        database,
 	}
 }
 
@@ -49,6 +57,61 @@ func (this *Diagnostic) HeartBeatHandler(w http.ResponseWriter, r *http.Request)
 	fmt.Fprint(w, string(str))
 }
 
+// Queue Depth API handler, used for describe the pending tasks per step and priority of current service
+func (this *Diagnostic) QueueDepthHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("GET /diagnostic/queues")
+
+	// Generate response
+	response := map[string]interface{}{
+		"service_id":   this.serviceID,
+		"queues":       this.pipelineManager.QueueDepths(),
+		"generated_at": time.Now().String(),
+	}
+
+	str, _ := json.Marshal(response)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(str))
+}
+
+// Timeouts API handler, used for list the orders failed with timeout, which have not been archived
+func (this *Diagnostic) TimeoutsHandler(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("GET /diagnostic/timeouts")
+
+	records, err := order.Find(this.database, &order.OrderFilter{FailureReason: order.FR_Timeout.String()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	orders := []map[string]interface{}{}
+	for _, record := range records {
+		orderInfo := map[string]interface{}{
+			"order_id":        record.OrderID,
+			"service_id":      record.ServiceID,
+			"current_step":    record.CurrentStep,
+			"start_time":      order.FormatTime(record.StartTime),
+			"failure_message": record.FailureMessage,
+		}
+		if !record.Deadline.IsZero() {
+			orderInfo["deadline"] = order.FormatTime(record.Deadline)
+		}
+		orders = append(orders, orderInfo)
+	}
+
+	// Generate response
+	response := map[string]interface{}{
+		"orders":       orders,
+		"orders_count": len(orders),
+		"generated_at": time.Now().String(),
+	}
+
+	str, _ := json.Marshal(response)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(str))
+}
+
 // Cluster State API handler, used for describe the cluster state
 func (this *Diagnostic) ClusterStatusHandler(w http.ResponseWriter, req *http.Request) {
 	logrus.Debug("GET /diagnostic/cluster")
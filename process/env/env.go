@@ -1,6 +1,7 @@
 package env
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/Sirupsen/logrus"
@@ -18,10 +19,33 @@ const (
 	Version          = "0.1"
 )
 
-// The defination of redis configuration
+// The defination of database configuration
 type RedisCfg struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	Backend  string `json:"backend"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Password string `json:"-"`
+	DB       int    `json:"db"`
+	PoolSize int    `json:"pool_size" gcfg:"pool-size"`
+	// The deadline of every redis call, in seconds
+	Timeout int `json:"timeout"`
+
+	TLS           bool   `json:"tls"`
+	TLSCAFile     string `json:"tls_ca_file" gcfg:"tls-ca-file"`
+	TLSServerName string `json:"tls_server_name" gcfg:"tls-server-name"`
+
+	// The sentinels are used to discover master if specified
+	SentinelAddr     []string `json:"sentinel_addr" gcfg:"sentinel-addr"`
+	SentinelMaster   string   `json:"sentinel_master" gcfg:"sentinel-master"`
+	SentinelPassword string   `json:"-" gcfg:"sentinel-password"`
+}
+
+// Describe the redis configuration without passwords
+func (this RedisCfg) String() string {
+	this.Password = ""
+	this.SentinelPassword = ""
+	type redisCfg RedisCfg
+	return fmt.Sprintf("%v", redisCfg(this))
 }
 
 // The definition of log configuration
@@ -35,6 +59,20 @@ type ServiceCfg struct {
 	IP   string `json:"ip"`
 	Port int    `json:"port"`
 	Path string `json:"path"`
+	// The finished orders are archived after the days, 0 means never
+	ArchiveAfterDays int `json:"archive_after_days" gcfg:"archive-after-days"`
+	// The directory of archive files shared by the services of cluster, "archive" under path if empty
+	ArchivePath string `json:"archive_path" gcfg:"archive-path"`
+	// The JSON Schema file validating the submitted order payload
+	OrderSchema string `json:"order_schema" gcfg:"order-schema"`
+	// The responses of order submissions are kept for the idempotency keys the seconds, 0 means default
+	IdempotencyKeyTTL int `json:"idempotency_key_ttl" gcfg:"idempotency-key-ttl"`
+	// The time budgets of steps in "<step>=<seconds>", the step exceeding its budget fails with timeout
+	StepBudget []string `json:"step_budget" gcfg:"step-budget"`
+	// Whether the steps without registered executor are simulated for demos, taking 5 seconds and failing at random
+	SimulateSteps bool `json:"simulate_steps" gcfg:"simulate-steps"`
+	// The JSON file defining the workflows of orders, only the standard workflow is defined if empty
+	WorkflowFile string `json:"workflow_file" gcfg:"workflow-file"`
 }
 
 // The definition of service environment
@@ -0,0 +1,318 @@
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"order_process/process/db"
+)
+
+// The hashes of idempotency keys, one hash per user maps key to the stored request
+const (
+	IdempotencyKeyTable = "IdempotencyKeys"
+	MaxKeyLength        = 255
+	DefaultTTL          = 24 * 3600 // in seconds
+	// The key is reserved for the request in progress at most the seconds,
+	// so that the retry is not blocked by the request lost with crashed service.
+	PendingTimeout = 60   // in seconds
+	PurgeInterval  = 3600 // in seconds
+	MaxAttempts    = 10
+)
+
+var (
+	ErrKeyInProgress = errors.New("The request with the same idempotency key is in progress")
+	ErrKeyReused     = errors.New("The idempotency key has been used by a different request")
+	ErrKeyTakenOver  = errors.New("The idempotency key has been taken over by another request")
+)
+
+// The definition of KeyState
+type KeyState int
+
+const (
+	KS_Pending KeyState = iota
+	KS_Completed
+)
+
+var KeyStateNames = map[KeyState]string{
+	KS_Pending:   "pending",
+	KS_Completed: "completed",
+}
+
+func (s KeyState) String() string {
+	return KeyStateNames[s]
+}
+
+// The definition of the request stored with idempotency key
+type KeyRecord struct {
+	State       string    `json:"state"`
+	RequestHash string    `json:"request_hash"`
+	OrderID     string    `json:"order_id,omitempty"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Response    string    `json:"response,omitempty"`
+	ExpireTime  time.Time `json:"expire_time"`
+}
+
+// The definition of the key reserved for the request in progress,
+// which is completed or released only if it is not taken over by others
+type Reservation struct {
+	database db.IDatabase
+	userID   string
+	key      string
+	pending  KeyRecord
+	// The value stored when the key is reserved, and the one bound to the order
+	value string
+	bound string
+	ttl   time.Duration
+}
+
+// The condition and mutation binding the reserved key to the order, which should be applied in the
+// transaction creating the order, so that the retry gets the order even if the key is not completed.
+// The transaction fails if the key has been taken over by others.
+func (this *Reservation) Bind(orderID string) (db.Condition, db.Mutation, error) {
+	bound := this.pending
+	bound.OrderID = orderID
+	bound.ExpireTime = time.Now().UTC().Add(this.ttl)
+	value, err := json.Marshal(bound)
+	if err != nil {
+		return db.Condition{}, db.Mutation{}, err
+	}
+	this.bound = string(value)
+	condition := db.Condition{Key: hashName(this.userID), HashKey: this.key, Value: this.value}
+	mutation := db.Mutation{Key: hashName(this.userID), HashKey: this.key, Value: this.bound}
+	return condition, mutation, nil
+}
+
+// Complete the key bound to the order with the response, which is replayed for the same request until the key expires.
+// ErrKeyTakenOver is returned if the key is owned by another request.
+func (this *Reservation) Complete(orderID string, statusCode int, response string) error {
+	record := KeyRecord{
+		State:       KS_Completed.String(),
+		RequestHash: this.pending.RequestHash,
+		OrderID:     orderID,
+		StatusCode:  statusCode,
+		Response:    response,
+		ExpireTime:  time.Now().UTC().Add(this.ttl),
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	current := this.bound
+	if current == "" {
+		current = this.value
+	}
+	condition := db.Condition{Key: hashName(this.userID), HashKey: this.key, Value: current}
+	mutation := db.Mutation{Key: hashName(this.userID), HashKey: this.key, Value: string(value)}
+	err = this.database.Transact([]db.Condition{condition}, []db.Mutation{mutation})
+	if err != db.ErrConditionFailed {
+		return err
+	}
+
+	// The key may have been completed by the retry of the same request
+	store := Store{database: this.database}
+	completed, _, err := store.get(this.userID, this.key)
+	if err != nil {
+		return err
+	}
+	if completed != nil && completed.State == KS_Completed.String() && completed.OrderID == orderID {
+		return nil
+	}
+	return ErrKeyTakenOver
+}
+
+// Release the reserved key if the request failed, so that it can be retried.
+// ErrKeyTakenOver is returned if the key is owned by another request.
+func (this *Reservation) Release() error {
+	condition := db.Condition{Key: hashName(this.userID), HashKey: this.key, Value: this.value}
+	mutation := db.Mutation{Key: hashName(this.userID), HashKey: this.key, Delete: true}
+	err := this.database.Transact([]db.Condition{condition}, []db.Mutation{mutation})
+	if err == db.ErrConditionFailed {
+		return ErrKeyTakenOver
+	}
+	return err
+}
+
+// The definition of the store of idempotency keys, which purges the expired keys periodically
+type Store struct {
+	database db.IDatabase
+	ttl      time.Duration
+	stop     chan bool
+}
+
+// The constructor of the store of idempotency keys
+func New(database db.IDatabase, ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = time.Second * DefaultTTL
+	}
+	return &Store{
+		database: database,
+		ttl:      ttl,
+		stop:     make(chan bool),
+	}
+}
+
+// Start purging in background
+func (this *Store) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Second * PurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.Purge()
+			case <-this.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop purging
+func (this *Store) Stop() {
+	close(this.stop)
+}
+
+// Reserve the key of user for the request body.
+// The reservation is returned if the key is reserved for the request, which must be completed or released later,
+// otherwise the record of the same request is returned, which is either completed to be replayed,
+// or pending with the order bound whose response should be completed by the reservation returned with it.
+func (this *Store) Reserve(userID string, key string, body []byte) (*KeyRecord, *Reservation, error) {
+	pending := KeyRecord{
+		State:       KS_Pending.String(),
+		RequestHash: requestHash(body),
+		ExpireTime:  time.Now().UTC().Add(time.Second * PendingTimeout),
+	}
+	value, err := json.Marshal(pending)
+	if err != nil {
+		return nil, nil, err
+	}
+	reservation := &Reservation{
+		database: this.database,
+		userID:   userID,
+		key:      key,
+		pending:  pending,
+		value:    string(value),
+		ttl:      this.ttl,
+	}
+
+	for attempt := 0; attempt < MaxAttempts; attempt++ {
+		condition := db.Condition{Key: hashName(userID), HashKey: key, Absent: true}
+		mutation := db.Mutation{Key: hashName(userID), HashKey: key, Value: string(value)}
+		err = this.database.Transact([]db.Condition{condition}, []db.Mutation{mutation})
+		if err == nil {
+			return nil, reservation, nil
+		} else if err != db.ErrConditionFailed {
+			return nil, nil, err
+		}
+
+		// The key has been used
+		record, data, err := this.get(userID, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if record == nil {
+			// Released by others
+			continue
+		}
+		if !record.ExpireTime.After(time.Now()) {
+			// Take over the expired key
+			condition = db.Condition{Key: hashName(userID), HashKey: key, Value: data}
+			err = this.database.Transact([]db.Condition{condition}, []db.Mutation{mutation})
+			if err == nil {
+				return nil, reservation, nil
+			} else if err != db.ErrConditionFailed {
+				return nil, nil, err
+			}
+			continue
+		}
+		if record.RequestHash != pending.RequestHash {
+			return nil, nil, ErrKeyReused
+		}
+		if record.State == KS_Pending.String() {
+			if record.OrderID == "" {
+				return nil, nil, ErrKeyInProgress
+			}
+			// The order has been bound, the response is completed by the retry
+			reservation.pending = *record
+			reservation.value = data
+			reservation.bound = data
+			return record, reservation, nil
+		}
+		return record, nil, nil
+	}
+	return nil, nil, errors.New("The idempotency key is too busy to be reserved")
+}
+
+// Purge the expired keys of all users
+func (this *Store) Purge() {
+	names, err := this.database.Keys(IdempotencyKeyTable + ":")
+	if err != nil {
+		logrus.Errorf("Purge idempotency keys failed [%v]", err)
+		return
+	}
+
+	count := 0
+	now := time.Now()
+	for _, name := range names {
+		keys, err := db.QueryHash(this.database, name)
+		if err != nil {
+			logrus.Errorf("Purge idempotency keys of [%s] failed [%v]", name, err)
+			continue
+		}
+		for key, data := range keys {
+			record := KeyRecord{}
+			if err = json.Unmarshal([]byte(data), &record); err == nil && record.ExpireTime.After(now) {
+				continue
+			}
+
+			// Skip the key which is taken over meanwhile
+			condition := db.Condition{Key: name, HashKey: key, Value: data}
+			mutation := db.Mutation{Key: name, HashKey: key, Delete: true}
+			err = this.database.Transact([]db.Condition{condition}, []db.Mutation{mutation})
+			if err == nil {
+				count++
+			} else if err != db.ErrConditionFailed {
+				logrus.Errorf("Purge idempotency key [%s] of [%s] failed [%v]", key, name, err)
+			}
+		}
+	}
+	if count > 0 {
+		logrus.Printf("Purged [%d] expired idempotency keys", count)
+	}
+}
+
+// Get the stored record of key and its raw data, nil if absent
+func (this *Store) get(userID string, key string) (*KeyRecord, string, error) {
+	recordMap := make(map[string]interface{})
+	err := this.database.Read("", recordMap, hashName(userID), key)
+	if err != nil {
+		return nil, "", err
+	}
+	data, _ := recordMap[key].([]byte)
+	if len(data) == 0 {
+		return nil, "", nil
+	}
+
+	record := KeyRecord{}
+	if err = json.Unmarshal(data, &record); err != nil {
+		return nil, "", err
+	}
+	return &record, string(data), nil
+}
+
+// The name of the hash of user
+func hashName(userID string) string {
+	return IdempotencyKeyTable + ":" + userID
+}
+
+// The hash of request body
+func requestHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,141 @@
+package idempotency
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+)
+
+// Bind the reserved key to the order as the transaction creating it does
+func bind(t *testing.T, database db.IDatabase, reservation *Reservation, orderID string) error {
+	condition, mutation, err := reservation.Bind(orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database.Transact([]db.Condition{condition}, []db.Mutation{mutation})
+}
+
+func TestReserveComplete(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	store := New(database, time.Hour)
+	body := []byte(`{"payload":"1"}`)
+
+	record, reservation, err := store.Reserve("user", "key", body)
+	if err != nil || record != nil || reservation == nil {
+		t.Fatalf("reserve got %v %v [%v]", record, reservation, err)
+	}
+	if _, _, err = store.Reserve("user", "key", body); err != ErrKeyInProgress {
+		t.Errorf("reserve pending key got [%v]", err)
+	}
+	if _, _, err = store.Reserve("user", "key", []byte(`{"payload":"2"}`)); err != ErrKeyReused {
+		t.Errorf("reserve key of other request got [%v]", err)
+	}
+
+	if err = reservation.Complete("order", 200, `{"order_id":"order"}`); err != nil {
+		t.Fatal(err)
+	}
+	record, reservation, err = store.Reserve("user", "key", body)
+	if err != nil || reservation != nil || record.State != KS_Completed.String() || record.Response != `{"order_id":"order"}` {
+		t.Errorf("reserve completed key got %+v %v [%v]", record, reservation, err)
+	}
+}
+
+func TestReserveBound(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	store := New(database, time.Hour)
+	body := []byte(`{"payload":"1"}`)
+
+	_, reservation, err := store.Reserve("user", "key", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bind(t, database, reservation, "order"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry gets the order bound though the key is not completed
+	record, retry, err := store.Reserve("user", "key", body)
+	if err != nil || retry == nil || record.State != KS_Pending.String() || record.OrderID != "order" {
+		t.Fatalf("reserve bound key got %+v %v [%v]", record, retry, err)
+	}
+	// The bound key is kept as long as the completed one
+	if record.ExpireTime.Before(time.Now().Add(time.Hour - time.Minute)) {
+		t.Errorf("bound key expires at %v", record.ExpireTime)
+	}
+
+	// Both the request and its retry complete the key with the order
+	if err = retry.Complete("order", 200, `{"order_id":"order"}`); err != nil {
+		t.Errorf("complete by retry got [%v]", err)
+	}
+	if err = reservation.Complete("order", 200, `{"order_id":"order"}`); err != nil {
+		t.Errorf("complete by request got [%v]", err)
+	}
+	if record, _, _ = store.get("user", "key"); record.State != KS_Completed.String() {
+		t.Errorf("key is [%s]", record.State)
+	}
+}
+
+func TestBindTakenOver(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	store := New(database, time.Hour)
+	body := []byte(`{"payload":"1"}`)
+
+	_, reservation, err := store.Reserve("user", "key", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reservation expires and is taken over by the retry
+	record, _, err := store.get("user", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.ExpireTime = time.Now().Add(-time.Second)
+	value, _ := json.Marshal(record)
+	if err = database.Write(string(value), hashName("user"), "key"); err != nil {
+		t.Fatal(err)
+	}
+	_, retry, err := store.Reserve("user", "key", body)
+	if err != nil || retry == nil {
+		t.Fatalf("take over expired key got %v [%v]", retry, err)
+	}
+
+	if err = bind(t, database, reservation, "lost"); err != db.ErrConditionFailed {
+		t.Errorf("bind taken over key got [%v]", err)
+	}
+	if err = bind(t, database, retry, "order"); err != nil {
+		t.Errorf("bind got [%v]", err)
+	}
+
+	// The original request neither releases nor completes the key of the new owner
+	if err = reservation.Release(); err != ErrKeyTakenOver {
+		t.Errorf("release taken over key got [%v]", err)
+	}
+	if err = reservation.Complete("lost", 200, `{"order_id":"lost"}`); err != ErrKeyTakenOver {
+		t.Errorf("complete taken over key got [%v]", err)
+	}
+	if record, _, _ = store.get("user", "key"); record == nil || record.OrderID != "order" || record.State != KS_Pending.String() {
+		t.Errorf("key of new owner is %+v", record)
+	}
+	if err = retry.Complete("order", 200, `{"order_id":"order"}`); err != nil {
+		t.Errorf("complete got [%v]", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	store := New(db.NewMemoryDatabase(), time.Hour)
+	body := []byte(`{"payload":"1"}`)
+
+	_, reservation, err := store.Reserve("user", "key", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reservation.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, reservation, err = store.Reserve("user", "key", body); err != nil || reservation == nil {
+		t.Errorf("reserve released key got %v [%v]", reservation, err)
+	}
+}
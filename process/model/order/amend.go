@@ -0,0 +1,108 @@
+package order
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The errors when the order cannot be amended
+var (
+	ErrOrderUpdated  = errors.New("Order has been updated by others")
+	ErrEmptyPatch    = errors.New("Nothing to amend")
+	ErrOptionAmended = errors.New("Only the payload of order can be amended")
+)
+
+// The options of order submission, which cannot be amended
+var submissionOptions = []string{"priority", "not_before", "deadline", "workflow"}
+
+// Check whether the payload of order can be amended, which is allowed before its initial step is finished
+func (this *OrderRecord) Amendable() error {
+	if this.Cancelled {
+		return ErrOrderCancelled
+	}
+	if this.FailureOccured {
+		return ErrOrderFailed
+	}
+	if this.IsParent() {
+		// The payload has been split into the children
+		return ErrOrderInFamily
+	}
+	if !this.IsStarting() {
+		return ErrOrderStarted
+	}
+	return nil
+}
+
+// Apply the patch of top level fields to the payload, the field patched with null is removed.
+// The json of patched payload is returned with the sorted names of patched fields.
+func PatchPayload(payload *OrderPayload, patch map[string]json.RawMessage) ([]byte, []string, error) {
+	if len(patch) == 0 {
+		return nil, nil, ErrEmptyPatch
+	}
+
+	document := make(map[string]json.RawMessage)
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = json.Unmarshal(data, &document); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fields := []string{}
+	for field, value := range patch {
+		for _, option := range submissionOptions {
+			if field == option {
+				return nil, nil, ErrOptionAmended
+			}
+		}
+		if string(value) == "null" {
+			delete(document, field)
+		} else {
+			document[field] = value
+		}
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	data, err := json.Marshal(document)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid patch [%v]", err)
+	}
+	return data, fields, nil
+}
+
+// Amend the payload and totals of order by user, the amended fields and the previous payload are recorded.
+// The owner of order finds the amendment when finishing the initial step, then performs it again with the amended payload.
+func (this *OrderRecord) Amend(userID string, payload *OrderPayload, totals *OrderTotals, fields []string) error {
+	if err := this.Amendable(); err != nil {
+		return err
+	}
+
+	this.AddEvent(OrderEvent{
+		Type:            ET_Amended.String(),
+		Actor:           UserActor(userID),
+		Step:            this.CurrentStep,
+		Fields:          fields,
+		PreviousPayload: this.Payload,
+	})
+	this.Payload = payload
+	this.Totals = totals
+
+	// The owner may be switched by transfer, so only the version is conditioned
+	err := this.save(nil, nil)
+	if _, ok := err.(*VersionConflictError); ok {
+		// Report the progress of order if it cannot be amended any more
+		if latest, e := this.Reload(); e == nil {
+			if e = latest.Amendable(); e != nil {
+				return e
+			}
+		}
+		return ErrOrderUpdated
+	}
+	return err
+}
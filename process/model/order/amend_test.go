@@ -0,0 +1,177 @@
+package order
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"order_process/process/db"
+)
+
+// Create the order with the payload of one line item
+func newOrderWithPayload(t *testing.T, database db.IDatabase) *OrderRecord {
+	payload := &OrderPayload{
+		LineItems:       []LineItem{{SKU: "A-100", Quantity: 2, UnitPrice: "19.99"}},
+		ShippingAddress: &ShippingAddress{Name: "Ann", Line1: "1 Main St", City: "Springfield", PostalCode: "12345", Country: "US"},
+	}
+	totals, err := ComputeTotals(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := New(database, map[string]interface{}{"user_id": "user", "service_id": "service", "payload": payload, "totals": totals})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestPatchPayload(t *testing.T) {
+	payload := &OrderPayload{
+		LineItems:       []LineItem{{SKU: "A-100", Quantity: 2, UnitPrice: "19.99"}},
+		ShippingAddress: &ShippingAddress{Name: "Ann"},
+	}
+	cases := []struct {
+		name     string
+		payload  *OrderPayload
+		patch    string
+		expected string
+		fields   []string
+		err      error
+	}{
+		{
+			name:     "replace and remove fields",
+			payload:  payload,
+			patch:    `{"shipping_address": null, "line_items": [{"sku": "B-200", "quantity": 1, "unit_price": "5"}]}`,
+			expected: `{"line_items":[{"sku":"B-200","quantity":1,"unit_price":"5"}]}`,
+			fields:   []string{"line_items", "shipping_address"},
+		},
+		{
+			name:     "add field",
+			payload:  payload,
+			patch:    `{"currency": "EUR"}`,
+			expected: `{"currency":"EUR","line_items":[{"sku":"A-100","quantity":2,"unit_price":"19.99"}],"shipping_address":{"name":"Ann","line1":"","city":"","postal_code":"","country":""}}`,
+			fields:   []string{"currency"},
+		},
+		{
+			name:     "order without payload",
+			patch:    `{"line_items": []}`,
+			expected: `{"line_items":[]}`,
+			fields:   []string{"line_items"},
+		},
+		{name: "empty patch", payload: payload, patch: `{}`, err: ErrEmptyPatch},
+		{name: "priority", payload: payload, patch: `{"currency": "EUR", "priority": "urgent"}`, err: ErrOptionAmended},
+		{name: "deadline", payload: payload, patch: `{"deadline": null}`, err: ErrOptionAmended},
+		{name: "workflow", payload: payload, patch: `{"workflow": "express"}`, err: ErrOptionAmended},
+	}
+
+	for _, c := range cases {
+		patch := make(map[string]json.RawMessage)
+		if err := json.Unmarshal([]byte(c.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+		data, fields, err := PatchPayload(c.payload, patch)
+		if err != c.err {
+			t.Errorf("%s: got [%v], expected [%v]", c.name, err, c.err)
+			continue
+		}
+		if err == nil && (string(data) != c.expected || !reflect.DeepEqual(fields, c.fields)) {
+			t.Errorf("%s: patched %s of fields %v", c.name, data, fields)
+		}
+	}
+
+	// The patch which is not json is rejected
+	if _, _, err := PatchPayload(payload, map[string]json.RawMessage{"currency": json.RawMessage("EUR")}); err == nil {
+		t.Errorf("invalid patch is applied")
+	}
+}
+
+func TestAmend(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	record := newOrderWithPayload(t, database)
+	previous := record.Payload
+
+	payload := &OrderPayload{LineItems: []LineItem{{SKU: "B-200", Quantity: 1, UnitPrice: "5"}}}
+	totals, err := ComputeTotals(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = record.Amend("user", payload, totals, []string{"line_items", "shipping_address"}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := Get(database, record.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Payload, payload) || !reflect.DeepEqual(saved.Totals, totals) {
+		t.Errorf("amended order is %+v", saved)
+	}
+	events, _, err := GetEvents(database, record.OrderID, "", MaxEventsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := events[len(events)-1]
+	if last.Type != ET_Amended.String() || last.Actor != UserActor("user") || last.Step != record.CurrentStep ||
+		!reflect.DeepEqual(last.Fields, []string{"line_items", "shipping_address"}) ||
+		!reflect.DeepEqual(last.PreviousPayload, previous) {
+		t.Errorf("last event is %+v", last)
+	}
+}
+
+func TestAmendConflict(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	record := newOrderWithPayload(t, database)
+	previous := record.Payload
+	payload := &OrderPayload{LineItems: []LineItem{{SKU: "B-200", Quantity: 1, UnitPrice: "5"}}}
+
+	// The order saved by others after it is read
+	latest, err := Get(database, record.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest.Priority = OP_High.String()
+	if err = latest.SaveToDB(OSS_Active.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err = record.Amend("user", payload, nil, []string{"line_items"}); err != ErrOrderUpdated {
+		t.Errorf("amend stale order got [%v]", err)
+	}
+
+	// The progress of order is reported if it cannot be amended any more
+	if _, err = Cancel(database, record.OrderID, "user", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = latest.Amend("user", payload, nil, []string{"line_items"}); err != ErrOrderCancelled {
+		t.Errorf("amend cancelled order got [%v]", err)
+	}
+
+	// Nothing is recorded for the rejected amendments
+	saved, err := Get(database, record.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Payload, previous) {
+		t.Errorf("payload is amended to %+v", saved.Payload)
+	}
+	events, _, err := GetEvents(database, record.OrderID, "", MaxEventsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if event.Type == ET_Amended.String() {
+			t.Errorf("rejected amendment is recorded %+v", event)
+		}
+	}
+}
+
+func TestAmendStartedOrder(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	record := newOrderWithPayload(t, database)
+	record.Steps[len(record.Steps)-1].StepCompleted = true
+	if err := record.SaveToDB(OSS_Active.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := record.Amend("user", &OrderPayload{}, nil, []string{"line_items"}); err != ErrOrderStarted {
+		t.Errorf("amend started order got [%v]", err)
+	}
+}
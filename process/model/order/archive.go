@@ -0,0 +1,230 @@
+package order
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"order_process/process/db"
+	"order_process/process/util"
+)
+
+// The archive files of orders, one gzip compressed json file for each order
+const (
+	ArchiveSuffix = ".json.gz"
+)
+
+var (
+	ErrArchivePathNotSet = errors.New("Archive path is not configured")
+
+	// The directory of archive files, which should be shared by the services of cluster,
+	// so the archived orders can be read from any of them
+	ArchivePath = ""
+)
+
+// Archive the finished orders of service completed or failed before specified time, each order is compressed
+// with its events into the archive file under ArchivePath, and removed from the hot hashes and indexes.
+// The transferred entries of service are pruned as well. The entries which cannot be read are logged and skipped.
+// Returns the count of archived orders.
+func Archive(database db.IDatabase, serviceID string, before time.Time) (int, error) {
+	if ArchivePath == "" {
+		return 0, ErrArchivePathNotSet
+	}
+	hash, err := db.QueryHash(database, OrderStateInServiceTable+":"+serviceID)
+	if err != nil {
+		return 0, err
+	}
+
+	var records []*OrderRecord
+	for orderId, info := range hash {
+		t := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(info), &t); err != nil {
+			logrus.Warnf("Archive: invalid state of order [%s] in service [%s] [%v]", orderId, serviceID, err)
+			continue
+		}
+
+		switch t["order_state_in_service"] {
+		case OSS_Transferred.String():
+			// The order is owned by other service
+			err = database.Transact(
+				[]db.Condition{{Key: OrderStateInServiceTable + ":" + serviceID, HashKey: orderId, Value: info}},
+				[]db.Mutation{{Key: OrderStateInServiceTable + ":" + serviceID, HashKey: orderId, Delete: true}})
+			if err != nil && err != db.ErrConditionFailed {
+				return 0, err
+			}
+		default:
+			// Both the completed and the failed orders are finished
+			record, err := Get(database, orderId)
+			if _, ok := err.(*NotFoundError); ok {
+				// The entry left by the order failed to be created
+				logrus.Warnf("Archive: order [%s] of service [%s] not found", orderId, serviceID)
+				continue
+			}
+			if err != nil {
+				logrus.Warnf("Archive: read order [%s] of service [%s] failed [%v]", orderId, serviceID, err)
+				continue
+			}
+			if record.Finished && record.CompleteTime.Before(before) {
+				records = append(records, record)
+			}
+		}
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	archived := 0
+	for _, record := range records {
+		// The events are archived with the order
+		events, err := getEvents(database, record.OrderID)
+		if err != nil {
+			logrus.Warnf("Archive: read events of order [%s] failed [%v]", record.OrderID, err)
+			continue
+		}
+		if err = writeArchived(record, events); err != nil {
+			return archived, err
+		}
+
+		err = database.Transact(
+			[]db.Condition{{
+				Key:     OrderVersionTable,
+				HashKey: record.OrderID,
+				Value:   strconv.FormatInt(record.Version, 10),
+				Absent:  record.Version == 0,
+			}},
+			record.archiveMutations(serviceID, events))
+		if err == db.ErrConditionFailed {
+			// Updated during archiving, leave it for next round
+			os.Remove(archivedPath(record.OrderID))
+			continue
+		}
+		if err != nil {
+			// The file left is overwritten by next round, the order is read from the hot hashes meanwhile
+			return archived, err
+		}
+		archived++
+	}
+	return archived, nil
+}
+
+// Generate the mutations removing order from hot hashes
+func (this *OrderRecord) archiveMutations(serviceID string, events []OrderEvent) []db.Mutation {
+	mutations := []db.Mutation{
+		{Key: OrderTableName, HashKey: this.OrderID, Delete: true},
+		{Key: OrderVersionTable, HashKey: this.OrderID, Delete: true},
+		{Key: OrderStateInServiceTable + ":" + serviceID, HashKey: this.OrderID, Delete: true},
+	}
+	for _, key := range this.indexedKeys {
+		mutations = append(mutations, db.Mutation{Key: key, HashKey: this.OrderID, Delete: true})
+	}
+	for _, event := range events {
+		mutations = append(mutations, db.Mutation{Key: OrderEventTable + ":" + this.OrderID, HashKey: event.EventID, Delete: true})
+	}
+	return mutations
+}
+
+// The path of archive file of order, the files are spread into the directories named by the first 2 characters of ids
+func archivedPath(orderId string) string {
+	if len(orderId) < 2 {
+		return filepath.Join(ArchivePath, orderId+ArchiveSuffix)
+	}
+	return filepath.Join(ArchivePath, orderId[:2], orderId+ArchiveSuffix)
+}
+
+// Write the compressed json record of order with its events into archive file.
+// The file is written aside and renamed, so a partial file is never read.
+func writeArchived(record *OrderRecord, events []OrderEvent) error {
+	recordMap := record.ToMap()
+	(*recordMap)["events"] = events
+	data, err := json.Marshal(recordMap)
+	if err != nil {
+		return err
+	}
+
+	path := archivedPath(record.OrderID)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), record.OrderID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	writer := gzip.NewWriter(file)
+	if _, err = writer.Write(data); err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Retrieve order record from archive
+func getArchived(database db.IDatabase, orderId string) (*OrderRecord, error) {
+	data, err := readArchived(orderId)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, &NotFoundError{OrderID: orderId}
+	}
+	record, err := parseOrderRecord(database, data)
+	if err != nil {
+		return nil, err
+	}
+	record.archived = true
+	return record, nil
+}
+
+// Retrieve the events of order from archive, empty if the order is not archived
+func getArchivedEvents(orderId string) ([]OrderEvent, error) {
+	data, err := readArchived(orderId)
+	if err != nil || data == nil {
+		return []OrderEvent{}, err
+	}
+
+	archived := struct {
+		Events []OrderEvent `json:"events"`
+	}{}
+	if err = json.Unmarshal(data, &archived); err != nil {
+		return nil, err
+	}
+	return append([]OrderEvent{}, archived.Events...), nil
+}
+
+// Read the archived json record of order, nil if the order is not archived
+func readArchived(orderId string) ([]byte, error) {
+	if ArchivePath == "" || util.ValidateUUID(orderId) != nil {
+		return nil, nil
+	}
+	file, err := os.Open(archivedPath(orderId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
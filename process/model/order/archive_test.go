@@ -0,0 +1,163 @@
+package order
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/util"
+)
+
+// Create the order completed at specified time
+func newCompletedOrder(t *testing.T, database db.IDatabase, completeTime time.Time) *OrderRecord {
+	record, err := New(database, map[string]interface{}{"user_id": "user", "service_id": "service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Steps = append(record.Steps, OrderStep{StepName: "Completed", StartTime: completeTime, CompleteTime: completeTime, StepCompleted: true})
+	record.CurrentStep = "Completed"
+	record.Finished = true
+	record.CompleteTime = completeTime
+	if err = record.SaveToDB(OSS_Completed.String()); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// Archive the orders into the temporary directory during the test
+func useArchivePath(t *testing.T) {
+	path := ArchivePath
+	ArchivePath = t.TempDir()
+	t.Cleanup(func() {
+		ArchivePath = path
+	})
+}
+
+func TestArchive(t *testing.T) {
+	useArchivePath(t)
+	database := db.NewMemoryDatabase()
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	completed := newCompletedOrder(t, database, old)
+	failed := newFailedOrder(t, database, []OrderStep{{StepName: "Scheduling"}})
+	recent := newCompletedOrder(t, database, time.Now().UTC())
+	active, err := New(database, map[string]interface{}{"user_id": "user", "service_id": "service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := Archive(database, "service", time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The failed and the recent orders completed just now
+	if count != 1 {
+		t.Fatalf("%d orders archived", count)
+	}
+
+	count, err = Archive(database, "service", time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("%d orders archived", count)
+	}
+
+	// Only the active order is left in the hot hashes
+	orders, err := db.QueryHash(database, OrderTableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := orders[active.OrderID]; len(orders) != 1 || !found {
+		t.Errorf("hot orders %v", orders)
+	}
+	keys, err := database.Keys(OrderEventTable + ":")
+	if err != nil || len(keys) != 1 {
+		t.Errorf("hot events %v [%v]", keys, err)
+	}
+
+	for _, record := range []*OrderRecord{completed, failed, recent} {
+		archived, err := Get(database, record.OrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !archived.archived || archived.FailureOccured != record.FailureOccured || archived.CurrentStep != record.CurrentStep {
+			t.Errorf("archived order is %+v", archived)
+		}
+		if _, err = os.Stat(filepath.Join(ArchivePath, record.OrderID[:2], record.OrderID+ArchiveSuffix)); err != nil {
+			t.Errorf("archive file got [%v]", err)
+		}
+		events, _, err := GetEvents(database, record.OrderID, "", MaxEventsPerPage)
+		if err != nil || len(events) == 0 || events[0].Type != ET_Created.String() {
+			t.Errorf("archived events are %v [%v]", events, err)
+		}
+	}
+
+	archived, _ := Get(database, failed.OrderID)
+	if err = archived.Retryable(); err != ErrOrderArchived {
+		t.Errorf("retry archived order got [%v]", err)
+	}
+}
+
+func TestArchiveSkipsMissingOrder(t *testing.T) {
+	useArchivePath(t)
+	database := db.NewMemoryDatabase()
+	completed := newCompletedOrder(t, database, time.Now().UTC().Add(-48*time.Hour))
+
+	// The entry left in service without order
+	missing := util.NewUUID()
+	if err := UpdateOrderStateInService(database, "service", missing, OSS_Active.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := Archive(database, "service", time.Now().UTC())
+	if err != nil || count != 1 {
+		t.Fatalf("archived %d orders [%v]", count, err)
+	}
+	if archived, err := Get(database, completed.OrderID); err != nil || !archived.archived {
+		t.Errorf("order is not archived [%v]", err)
+	}
+	if _, err = Get(database, missing); err == nil {
+		t.Errorf("missing order is found")
+	} else if _, ok := err.(*NotFoundError); !ok {
+		t.Errorf("get missing order got [%v]", err)
+	}
+}
+
+func TestArchiveSkipsUnreadableOrder(t *testing.T) {
+	useArchivePath(t)
+	database := db.NewMemoryDatabase()
+	completed := newCompletedOrder(t, database, time.Now().UTC().Add(-48*time.Hour))
+
+	// The order which cannot be parsed
+	broken := util.NewUUID()
+	if err := database.Write("{", OrderTableName, broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateOrderStateInService(database, "service", broken, OSS_Completed.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := Archive(database, "service", time.Now().UTC())
+	if err != nil || count != 1 {
+		t.Fatalf("archived %d orders [%v]", count, err)
+	}
+	if archived, err := Get(database, completed.OrderID); err != nil || !archived.archived {
+		t.Errorf("order is not archived [%v]", err)
+	}
+}
+
+func TestArchivePathNotSet(t *testing.T) {
+	useArchivePath(t)
+	ArchivePath = ""
+	database := db.NewMemoryDatabase()
+	record := newCompletedOrder(t, database, time.Now().UTC().Add(-48*time.Hour))
+
+	if _, err := Archive(database, "service", time.Now().UTC()); err != ErrArchivePathNotSet {
+		t.Errorf("archive got [%v]", err)
+	}
+	if _, err := Get(database, record.OrderID); err != nil {
+		t.Errorf("get order got [%v]", err)
+	}
+}
@@ -0,0 +1,76 @@
+package order
+
+import (
+	"errors"
+	"time"
+
+	"order_process/process/db"
+)
+
+// The errors when the order cannot be cancelled
+var (
+	ErrOrderCompleted = errors.New("Order has been completed")
+	ErrOrderCancelled = errors.New("Order has been cancelled")
+	ErrOrderFailed    = errors.New("Order has failed")
+)
+
+// The max attempts to cancel the order which is being updated by its owner
+const MaxCancelAttempts = 10
+
+// Check whether the order can be cancelled
+func (this *OrderRecord) Cancellable() error {
+	if this.Cancelled {
+		return ErrOrderCancelled
+	}
+	if this.FailureOccured {
+		return ErrOrderFailed
+	}
+	orderWorkflow := this.GetWorkflow()
+	if orderWorkflow == nil {
+		return ErrWorkflowUndefined
+	}
+	if this.Finished || this.CurrentStep == orderWorkflow.SuccessStep {
+		return ErrOrderCompleted
+	}
+	if this.ParentID != "" {
+		// The family is cancelled by its parent
+		return ErrOrderInFamily
+	}
+	return nil
+}
+
+// Request the cancellation of order by user with reason.
+// Only the cancellation is recorded here, whichever service owning the order
+// finds it when saving the order, then fails the order and rolls back the steps.
+func Cancel(database db.IDatabase, orderId string, userID string, reason string) (*OrderRecord, error) {
+	for attempt := 0; attempt < MaxCancelAttempts; attempt++ {
+		record, err := Get(database, orderId)
+		if err != nil {
+			return nil, err
+		}
+		if err = record.Cancellable(); err != nil {
+			return nil, err
+		}
+
+		record.Cancelled = true
+		record.CancelReason = reason
+		record.CancelTime = time.Now().UTC()
+		record.AddEvent(OrderEvent{
+			Type:   ET_Cancelled.String(),
+			Actor:  UserActor(userID),
+			Step:   record.CurrentStep,
+			Reason: reason,
+		})
+
+		// The owner may be switched by transfer, so only the version is conditioned
+		err = record.save(nil, nil)
+		if _, ok := err.(*VersionConflictError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+	return nil, errors.New("Order is too busy to be cancelled")
+}
@@ -0,0 +1,84 @@
+package order
+
+import (
+	"testing"
+	"time"
+
+	"order_process/process/db"
+)
+
+func TestCancel(t *testing.T) {
+	database := &faultyDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+	record := newOrder(t, database.MemoryDatabase)
+
+	// The order saved by its owner meanwhile is cancelled in the next attempt
+	database.interleave = func() {
+		latest, err := Get(database.MemoryDatabase, record.OrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest.Priority = OP_High.String()
+		if err = latest.SaveToDB(OSS_Active.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancelled, err := Cancel(database, record.OrderID, "user", "Changed my mind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if database.interleave != nil {
+		t.Fatalf("order is not saved meanwhile")
+	}
+
+	saved, err := Get(database, record.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Cancelled || saved.CancelReason != "Changed my mind" || saved.CancelTime.IsZero() ||
+		saved.Priority != OP_High.String() || saved.Version != cancelled.Version {
+		t.Errorf("cancelled order is %+v", saved)
+	}
+
+	events, _, err := GetEvents(database, record.OrderID, "", MaxEventsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := events[len(events)-1]
+	if last.Type != ET_Cancelled.String() || last.Actor != UserActor("user") || last.Reason != "Changed my mind" ||
+		last.Step != record.CurrentStep {
+		t.Errorf("last event is %+v", last)
+	}
+
+	if _, err = Cancel(database, record.OrderID, "user", "Again"); err != ErrOrderCancelled {
+		t.Errorf("cancel again got [%v]", err)
+	}
+}
+
+func TestCancelFinishedOrder(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	completed := newCompletedOrder(t, database, time.Now().UTC())
+	failed := newFailedOrder(t, database, []OrderStep{{StepName: "Scheduling"}})
+
+	for record, expected := range map[*OrderRecord]error{completed: ErrOrderCompleted, failed: ErrOrderFailed} {
+		events, _, err := GetEvents(database, record.OrderID, "", MaxEventsPerPage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Cancel(database, record.OrderID, "user", "Too late"); err != expected {
+			t.Errorf("cancel order at [%s] got [%v]", record.CurrentStep, err)
+		}
+
+		// Nothing is recorded for the refused cancellation
+		saved, err := Get(database, record.OrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, _, err := GetEvents(database, record.OrderID, "", MaxEventsPerPage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Cancelled || saved.Version != record.Version || len(after) != len(events) {
+			t.Errorf("refused cancellation is saved %+v", saved)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package order
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/util"
+)
+
+// The hashes of order events, one hash per order maps event_id to event.
+// The event ids are ordered by the time of events.
+const (
+	OrderEventTable      = "OrderEvents"
+	DefaultEventsPerPage = 50
+	MaxEventsPerPage     = 500
+)
+
+// The definition of EventType
+type EventType int
+
+const (
+	ET_Created EventType = iota
+	ET_StepStarted
+	ET_StepFinished
+	ET_StepFailed
+	ET_StepRolledBack
+	ET_Transferred
+	ET_Cancelled
+	ET_Retried
+	ET_Split
+	ET_Merged
+	ET_Amended
+	ET_CompensateFailed
+)
+
+var EventTypeNames = map[EventType]string{
+	ET_Created:          "created",
+	ET_StepStarted:      "step_started",
+	ET_StepFinished:     "step_finished",
+	ET_StepFailed:       "step_failed",
+	ET_StepRolledBack:   "step_rolled_back",
+	ET_Transferred:      "transferred",
+	ET_Cancelled:        "cancelled",
+	ET_Retried:          "retried",
+	ET_Split:            "split",
+	ET_Merged:           "merged",
+	ET_Amended:          "amended",
+	ET_CompensateFailed: "compensate_failed",
+}
+
+func (t EventType) String() string {
+	return EventTypeNames[t]
+}
+
+// The definition of order event
+type OrderEvent struct {
+	EventID string    `json:"event_id"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	// Who triggered the event, "user:<user_id>" or "service:<service_id>"
+	Actor   string `json:"actor"`
+	Step    string `json:"step,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// The services of ownership transfer
+	FromServiceID string `json:"from_service_id,omitempty"`
+	ToServiceID   string `json:"to_service_id,omitempty"`
+	// The new attempt of failed order
+	AttemptID string `json:"attempt_id,omitempty"`
+	// The children of split order, or the parent of merged order
+	OrderIDs []string `json:"order_ids,omitempty"`
+	// The amended fields of payload and the payload before amendment
+	Fields          []string      `json:"fields,omitempty"`
+	PreviousPayload *OrderPayload `json:"previous_payload,omitempty"`
+}
+
+// The actor of user
+func UserActor(userID string) string {
+	return "user:" + userID
+}
+
+// The actor of service
+func ServiceActor(serviceID string) string {
+	return "service:" + serviceID
+}
+
+// Fill the id and time of new event
+func newEvent(event OrderEvent) OrderEvent {
+	event.Time = time.Now().UTC()
+	event.EventID = fmt.Sprintf("%019d-%s", event.Time.UnixNano(), util.NewUUID()[:8])
+	return event
+}
+
+// Append the event, which is saved together with the order.
+// The event is triggered by current service if the actor is not specified.
+func (this *OrderRecord) AddEvent(event OrderEvent) {
+	if event.Actor == "" {
+		event.Actor = ServiceActor(this.ServiceID)
+	}
+	this.pendingEvents = append(this.pendingEvents, newEvent(event))
+}
+
+// Generate the condition and mutation appending the event, the existing event is never overwritten
+func eventMutation(orderId string, event OrderEvent) (db.Condition, db.Mutation, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return db.Condition{}, db.Mutation{}, err
+	}
+	key := OrderEventTable + ":" + orderId
+	return db.Condition{Key: key, HashKey: event.EventID, Absent: true},
+		db.Mutation{Key: key, HashKey: event.EventID, Value: string(data)}, nil
+}
+
+// Get all the events of order in order of time
+func getEvents(database db.IDatabase, orderId string) ([]OrderEvent, error) {
+	hash, err := db.QueryHash(database, OrderEventTable+":"+orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []OrderEvent{}
+	for _, data := range hash {
+		event := OrderEvent{}
+		if err = json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].EventID < events[j].EventID
+	})
+	return events, nil
+}
+
+// Get at most limit events of order after the event id, the events of archived order are read from archive.
+// The id of last returned event is returned as cursor of next page, empty if no more events.
+// DefaultEventsPerPage events are returned if limit is not positive, and at most MaxEventsPerPage.
+func GetEvents(database db.IDatabase, orderId string, after string, limit int) ([]OrderEvent, string, error) {
+	if limit <= 0 {
+		limit = DefaultEventsPerPage
+	}
+	if limit > MaxEventsPerPage {
+		limit = MaxEventsPerPage
+	}
+
+	events, err := getEvents(database, orderId)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(events) == 0 {
+		if events, err = getArchivedEvents(orderId); err != nil {
+			return nil, "", err
+		}
+	}
+
+	start := sort.Search(len(events), func(i int) bool {
+		return events[i].EventID > after
+	})
+	events = events[start:]
+
+	next := ""
+	if len(events) > limit {
+		events = events[:limit]
+		next = events[limit-1].EventID
+	}
+	return events, next, nil
+}
@@ -0,0 +1,119 @@
+package order
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/util"
+)
+
+// Write the events of order directly, whose ids are in order of index
+func writeEvents(t *testing.T, database db.IDatabase, orderId string, count int) []string {
+	var mutations []db.Mutation
+	var eventIds []string
+	for index := 0; index < count; index++ {
+		event := OrderEvent{EventID: fmt.Sprintf("%020d-%08x", index, index), Type: ET_StepStarted.String()}
+		data, _ := json.Marshal(event)
+		mutations = append(mutations, db.Mutation{Key: OrderEventTable + ":" + orderId, HashKey: event.EventID, Value: string(data)})
+		eventIds = append(eventIds, event.EventID)
+	}
+	if err := database.Transact(nil, mutations); err != nil {
+		t.Fatal(err)
+	}
+	return eventIds
+}
+
+// Get the ids of events
+func eventIds(events []OrderEvent) []string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.EventID)
+	}
+	return ids
+}
+
+func TestGetEventsPages(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	orderId := util.NewUUID()
+	ids := writeEvents(t, database, orderId, 5)
+
+	cases := []struct {
+		name     string
+		after    string
+		limit    int
+		expected []string
+		next     string
+	}{
+		{name: "first page", limit: 2, expected: ids[:2], next: ids[1]},
+		{name: "page after cursor", after: ids[1], limit: 2, expected: ids[2:4], next: ids[3]},
+		{name: "last page of exactly limit events", after: ids[2], limit: 2, expected: ids[3:]},
+		{name: "last page of less than limit events", after: ids[3], limit: 2, expected: ids[4:]},
+		{name: "page after last event", after: ids[4], limit: 2, expected: []string{}},
+		{name: "all events in exactly one page", limit: 5, expected: ids},
+		{name: "default limit", expected: ids},
+		{name: "cursor between events", after: ids[1] + "-", limit: 1, expected: ids[2:3], next: ids[2]},
+	}
+	for _, c := range cases {
+		events, next, err := GetEvents(database, orderId, c.after, c.limit)
+		if err != nil {
+			t.Fatalf("%s: got [%v]", c.name, err)
+		}
+		if got := eventIds(events); fmt.Sprint(got) != fmt.Sprint(c.expected) || next != c.next {
+			t.Errorf("%s: got %v next [%s], expected %v next [%s]", c.name, got, next, c.expected, c.next)
+		}
+	}
+}
+
+func TestGetEventsLimit(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	orderId := util.NewUUID()
+	ids := writeEvents(t, database, orderId, MaxEventsPerPage+1)
+
+	for _, limit := range []int{0, -1} {
+		events, next, err := GetEvents(database, orderId, "", limit)
+		if err != nil || len(events) != DefaultEventsPerPage || next != ids[DefaultEventsPerPage-1] {
+			t.Errorf("limit %d got %d events next [%s] [%v]", limit, len(events), next, err)
+		}
+	}
+	// The limit beyond the max is clamped
+	events, next, err := GetEvents(database, orderId, "", MaxEventsPerPage*2)
+	if err != nil || len(events) != MaxEventsPerPage || next != ids[MaxEventsPerPage-1] {
+		t.Errorf("limit beyond max got %d events next [%s] [%v]", len(events), next, err)
+	}
+	events, next, err = GetEvents(database, orderId, next, MaxEventsPerPage*2)
+	if err != nil || len(events) != 1 || events[0].EventID != ids[MaxEventsPerPage] || next != "" {
+		t.Errorf("last page got %v next [%s] [%v]", eventIds(events), next, err)
+	}
+}
+
+func TestGetArchivedEvents(t *testing.T) {
+	useArchivePath(t)
+	database := db.NewMemoryDatabase()
+	record := newCompletedOrder(t, database, time.Now().UTC().Add(-time.Hour))
+	writeEvents(t, database, record.OrderID, 2)
+	expected, _, err := GetEvents(database, record.OrderID, "", MaxEventsPerPage)
+	if err != nil || len(expected) < 2 {
+		t.Fatalf("events before archiving are %v [%v]", expected, err)
+	}
+	if count, err := Archive(database, "service", time.Now().UTC()); err != nil || count != 1 {
+		t.Fatalf("archived %d orders [%v]", count, err)
+	}
+
+	// The archived events are paged as well
+	events, next, err := GetEvents(database, record.OrderID, "", 1)
+	if err != nil || len(events) != 1 || events[0].EventID != expected[0].EventID || next != expected[0].EventID {
+		t.Fatalf("first page of archived events is %v next [%s] [%v]", eventIds(events), next, err)
+	}
+	events, _, err = GetEvents(database, record.OrderID, next, MaxEventsPerPage)
+	if err != nil || fmt.Sprint(eventIds(events)) != fmt.Sprint(eventIds(expected[1:])) {
+		t.Errorf("next page of archived events is %v [%v]", eventIds(events), err)
+	}
+
+	// Nothing for the order neither saved nor archived
+	if events, next, err = GetEvents(database, util.NewUUID(), "", 1); err != nil || len(events) != 0 || next != "" {
+		t.Errorf("events of unknown order are %v next [%s] [%v]", events, next, err)
+	}
+}
@@ -0,0 +1,85 @@
+package order
+
+import (
+	"fmt"
+	"time"
+)
+
+// The definition of FailureReason
+type FailureReason int
+
+const (
+	FR_Error FailureReason = iota
+	FR_Cancelled
+	FR_Timeout
+	FR_Family
+)
+
+var FailureReasonNames = map[FailureReason]string{
+	FR_Error:     "error",
+	FR_Cancelled: "cancelled",
+	FR_Timeout:   "timeout",
+	FR_Family:    "family",
+}
+
+func (r FailureReason) String() string {
+	return FailureReasonNames[r]
+}
+
+// The error returned when the order exceeded its deadline or the step exceeded its budget
+type TimeoutError struct {
+	OrderID  string
+	Step     string
+	Deadline time.Time
+	// Whether the budget of step is exceeded rather than the deadline of order
+	StepBudget time.Duration
+}
+
+func (this *TimeoutError) Error() string {
+	if this.StepBudget > 0 {
+		return fmt.Sprintf("Step [%s] of order [%s] exceeded its budget [%v]", this.Step, this.OrderID, this.StepBudget)
+	}
+	return fmt.Sprintf("Order [%s] exceeded its deadline [%s] at step [%s]", this.OrderID, FormatTime(this.Deadline), this.Step)
+}
+
+// Get the reason of failure caused by error
+func FailureReasonOf(err error) FailureReason {
+	if _, ok := err.(*TimeoutError); ok {
+		return FR_Timeout
+	}
+	if err == ErrOrderCancelled {
+		return FR_Cancelled
+	}
+	if _, ok := err.(*FamilyError); ok {
+		return FR_Family
+	}
+	return FR_Error
+}
+
+// Get the time by which current step must be finished with its budget,
+// which is the earlier one of the deadline of order and the budget of step, zero time if unbounded.
+func (this *OrderRecord) StepDeadline(budget time.Duration) time.Time {
+	deadline := this.Deadline
+	if budget > 0 && len(this.Steps) > 0 {
+		stepDeadline := this.Steps[len(this.Steps)-1].StartTime.Add(budget)
+		if deadline.IsZero() || stepDeadline.Before(deadline) {
+			deadline = stepDeadline
+		}
+	}
+	return deadline
+}
+
+// Check whether current step is finished in time with its budget, *TimeoutError is returned if not
+func (this *OrderRecord) CheckDeadline(budget time.Duration) error {
+	now := time.Now()
+	if !this.Deadline.IsZero() && !now.Before(this.Deadline) {
+		return &TimeoutError{OrderID: this.OrderID, Step: this.CurrentStep, Deadline: this.Deadline}
+	}
+	if budget > 0 && len(this.Steps) > 0 {
+		stepDeadline := this.Steps[len(this.Steps)-1].StartTime.Add(budget)
+		if !now.Before(stepDeadline) {
+			return &TimeoutError{OrderID: this.OrderID, Step: this.CurrentStep, Deadline: stepDeadline, StepBudget: budget}
+		}
+	}
+	return nil
+}
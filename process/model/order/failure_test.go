@@ -0,0 +1,71 @@
+package order
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckDeadline(t *testing.T) {
+	now := time.Now().UTC()
+	cases := []struct {
+		name      string
+		deadline  time.Time
+		stepStart time.Time
+		budget    time.Duration
+		// The step deadline expected, and the deadline and budget of TimeoutError expected if exceeded
+		expected time.Time
+		exceeded bool
+	}{
+		{name: "unbounded", stepStart: now},
+		{name: "step without budget", deadline: now.Add(time.Hour), stepStart: now, expected: now.Add(time.Hour)},
+		{name: "unexpired budget", stepStart: now.Add(-time.Minute), budget: time.Hour, expected: now.Add(59 * time.Minute)},
+		{name: "expired budget", stepStart: now.Add(-2 * time.Hour), budget: time.Hour, expected: now.Add(-time.Hour), exceeded: true},
+		{name: "expired deadline", deadline: now.Add(-time.Second), stepStart: now, expected: now.Add(-time.Second), exceeded: true},
+		{
+			name: "deadline before budget", deadline: now.Add(10 * time.Minute), stepStart: now, budget: time.Hour,
+			expected: now.Add(10 * time.Minute),
+		},
+		{
+			name: "budget before deadline", deadline: now.Add(time.Hour), stepStart: now, budget: 10 * time.Minute,
+			expected: now.Add(10 * time.Minute),
+		},
+		{
+			name: "expired budget before deadline", deadline: now.Add(time.Hour), stepStart: now.Add(-time.Hour),
+			budget: 10 * time.Minute, expected: now.Add(-50 * time.Minute), exceeded: true,
+		},
+	}
+
+	for _, c := range cases {
+		record := &OrderRecord{
+			OrderID:     "order",
+			CurrentStep: "Processing",
+			Deadline:    c.deadline,
+			Steps:       []OrderStep{{StepName: "Scheduling"}, {StepName: "Processing", StartTime: c.stepStart}},
+		}
+		if deadline := record.StepDeadline(c.budget); !deadline.Equal(c.expected) {
+			t.Errorf("%s: step deadline is [%v], expected [%v]", c.name, deadline, c.expected)
+		}
+
+		err := record.CheckDeadline(c.budget)
+		if !c.exceeded {
+			if err != nil {
+				t.Errorf("%s: check got [%v]", c.name, err)
+			}
+			continue
+		}
+		timeoutErr, ok := err.(*TimeoutError)
+		if !ok {
+			t.Errorf("%s: check got [%v]", c.name, err)
+			continue
+		}
+		// The budget is reported only if the step exceeded its budget before the deadline of order
+		budget := c.budget
+		if !c.deadline.IsZero() && !c.deadline.After(now) {
+			budget = 0
+		}
+		if !timeoutErr.Deadline.Equal(c.expected) || timeoutErr.StepBudget != budget || timeoutErr.Step != "Processing" ||
+			FailureReasonOf(err) != FR_Timeout {
+			t.Errorf("%s: timeout is %+v", c.name, timeoutErr)
+		}
+	}
+}
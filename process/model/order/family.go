@@ -0,0 +1,267 @@
+package order
+
+import (
+	"errors"
+	"fmt"
+
+	"order_process/process/db"
+)
+
+// The errors when the family of orders cannot be formed
+var (
+	ErrOrderInFamily = errors.New("Order is in a family of orders")
+	ErrOrderStarted  = errors.New("Order has started processing")
+	ErrInvalidSplit  = errors.New("Each line item should be in exactly one of at least two children")
+	ErrInvalidMerge  = errors.New("At least two distinct orders are required")
+	ErrMixedWorkflow = errors.New("Orders under different workflows cannot be merged")
+)
+
+// The max attempts to form the family of orders which are being updated by their owners
+const MaxFamilyAttempts = 10
+
+// The error returned when the order fails with other order in its family
+type FamilyError struct {
+	OrderID  string
+	MemberID string
+}
+
+func (this *FamilyError) Error() string {
+	return fmt.Sprintf("Order [%s] failed with order [%s] in its family", this.OrderID, this.MemberID)
+}
+
+// Check whether the order is the parent of other orders
+func (this *OrderRecord) IsParent() bool {
+	return len(this.ChildIDs) > 0
+}
+
+// Check whether the order can be split by the line items of groups
+func (this *OrderRecord) Splittable(groups [][]int) error {
+	if this.Cancelled {
+		return ErrOrderCancelled
+	}
+	if this.FailureOccured {
+		return ErrOrderFailed
+	}
+	if this.ParentID != "" || this.IsParent() {
+		return ErrOrderInFamily
+	}
+	if !this.IsStarting() {
+		return ErrOrderStarted
+	}
+
+	if this.Payload == nil || len(groups) < 2 {
+		return ErrInvalidSplit
+	}
+	used := make(map[int]bool)
+	for _, group := range groups {
+		if len(group) == 0 {
+			return ErrInvalidSplit
+		}
+		for _, index := range group {
+			if index < 0 || index >= len(this.Payload.LineItems) || used[index] {
+				return ErrInvalidSplit
+			}
+			used[index] = true
+		}
+	}
+	if len(used) != len(this.Payload.LineItems) {
+		return ErrInvalidSplit
+	}
+	return nil
+}
+
+// Check whether the order can be merged into new parent
+func (this *OrderRecord) Mergeable() error {
+	if this.Cancelled {
+		return ErrOrderCancelled
+	}
+	if this.FailureOccured {
+		return ErrOrderFailed
+	}
+	orderWorkflow := this.GetWorkflow()
+	if orderWorkflow == nil {
+		return ErrWorkflowUndefined
+	}
+	if this.Finished || this.CurrentStep == orderWorkflow.SuccessStep {
+		return ErrOrderCompleted
+	}
+	if this.ParentID != "" || this.IsParent() {
+		return ErrOrderInFamily
+	}
+	return nil
+}
+
+// Check whether the order is still in its initial step or waiting to be started,
+// which is not finished yet
+func (this *OrderRecord) IsStarting() bool {
+	orderWorkflow := this.GetWorkflow()
+	if orderWorkflow == nil || this.Steps[len(this.Steps)-1].StepCompleted {
+		return false
+	}
+	return this.CurrentStep == orderWorkflow.InitialStep ||
+		orderWorkflow.DelayedStep != "" && this.CurrentStep == orderWorkflow.DelayedStep
+}
+
+// Split the order into children by user, each group holds the indexes of line items of one child.
+// The children owned by service share the options of order, and the pricing stays with the order.
+// The order becomes the parent following its children instead of processing the steps.
+func Split(database db.IDatabase, orderId string, serviceID string, userID string, groups [][]int) (*OrderRecord, []*OrderRecord, error) {
+	for attempt := 0; attempt < MaxFamilyAttempts; attempt++ {
+		record, err := Get(database, orderId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = record.Splittable(groups); err != nil {
+			return nil, nil, err
+		}
+
+		children := []*OrderRecord{}
+		mutations := []db.Mutation{}
+		for _, group := range groups {
+			payload := &OrderPayload{
+				Currency:        record.Payload.Currency,
+				ShippingAddress: record.Payload.ShippingAddress,
+				Attributes:      record.Payload.Attributes,
+			}
+			for _, index := range group {
+				payload.LineItems = append(payload.LineItems, record.Payload.LineItems[index])
+			}
+
+			childMap := map[string]interface{}{
+				"service_id": serviceID,
+				"user_id":    record.UserID,
+				"workflow":   record.Workflow,
+				"priority":   record.Priority,
+				"payload":    payload,
+				"parent_id":  record.OrderID,
+			}
+			if !record.NotBefore.IsZero() {
+				childMap["not_before"] = record.NotBefore
+			}
+			if !record.Deadline.IsZero() {
+				childMap["deadline"] = record.Deadline
+			}
+			if err = initRecord(childMap); err != nil {
+				return nil, nil, err
+			}
+			child, err := build(database, childMap, OrderEvent{Type: ET_Created.String(), Actor: UserActor(userID)})
+			if err != nil {
+				return nil, nil, err
+			}
+			children = append(children, child)
+			mutations = append(mutations, db.Mutation{
+				Key:     OrderStateInServiceTable + ":" + serviceID,
+				HashKey: child.OrderID,
+				Value:   orderStateInServiceInfo(child.OrderID, OSS_Active.String()),
+			})
+			record.ChildIDs = append(record.ChildIDs, child.OrderID)
+		}
+		record.AddEvent(OrderEvent{
+			Type:     ET_Split.String(),
+			Actor:    UserActor(userID),
+			Step:     record.CurrentStep,
+			OrderIDs: record.ChildIDs,
+		})
+
+		// The owner of order finds the split when saving the order, and aborts current step
+		err = saveRecords(append([]*OrderRecord{record}, children...), nil, mutations)
+		if _, ok := err.(*VersionConflictError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return record, children, nil
+	}
+	return nil, nil, errors.New("Order is too busy to be split")
+}
+
+// Merge the orders of user under the same workflow into new parent owned by service, which has the highest priority of them.
+// The orders keep processing their steps, and are completed together with the parent.
+func Merge(database db.IDatabase, serviceID string, userID string, orderIds []string) (*OrderRecord, error) {
+	distinct := make(map[string]bool)
+	for _, orderId := range orderIds {
+		distinct[orderId] = true
+	}
+	if len(orderIds) < 2 || len(distinct) != len(orderIds) {
+		return nil, ErrInvalidMerge
+	}
+
+	for attempt := 0; attempt < MaxFamilyAttempts; attempt++ {
+		children := []*OrderRecord{}
+		priority := OP_Low
+		for _, orderId := range orderIds {
+			child, err := Get(database, orderId)
+			if err != nil {
+				return nil, err
+			}
+			if err = child.Mergeable(); err != nil {
+				return nil, err
+			}
+			if len(children) > 0 && child.Workflow != children[0].Workflow {
+				return nil, ErrMixedWorkflow
+			}
+			if child.GetPriority() > priority {
+				priority = child.GetPriority()
+			}
+			children = append(children, child)
+		}
+
+		parentMap := map[string]interface{}{
+			"service_id": serviceID,
+			"user_id":    userID,
+			"workflow":   children[0].Workflow,
+			"priority":   priority.String(),
+			"child_ids":  orderIds,
+		}
+		if err := initRecord(parentMap); err != nil {
+			return nil, err
+		}
+		parent, err := build(database, parentMap, OrderEvent{Type: ET_Created.String(), Actor: UserActor(userID)})
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			child.ParentID = parent.OrderID
+			child.AddEvent(OrderEvent{
+				Type:     ET_Merged.String(),
+				Actor:    UserActor(userID),
+				Step:     child.CurrentStep,
+				OrderIDs: []string{parent.OrderID},
+			})
+		}
+
+		// The owners of orders find the merge when saving the orders
+		err = saveRecords(append(children, parent), nil, []db.Mutation{{
+			Key:     OrderStateInServiceTable + ":" + serviceID,
+			HashKey: parent.OrderID,
+			Value:   orderStateInServiceInfo(parent.OrderID, OSS_Active.String()),
+		}})
+		if _, ok := err.(*VersionConflictError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parent, nil
+	}
+	return nil, errors.New("Orders are too busy to be merged")
+}
+
+// Get the parent of order
+func (this *OrderRecord) GetParent() (*OrderRecord, error) {
+	return Get(this.database, this.ParentID)
+}
+
+// Get the children of order
+func (this *OrderRecord) GetChildren() ([]*OrderRecord, error) {
+	children := []*OrderRecord{}
+	for _, childId := range this.ChildIDs {
+		child, err := Get(this.database, childId)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
@@ -0,0 +1,224 @@
+package order
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"order_process/process/db"
+)
+
+// The definition of OrderStatus, which is maintained in the status index
+type OrderStatus int
+
+const (
+	OS_Processing OrderStatus = iota
+	OS_Completed
+	OS_Failed
+)
+
+var OrderStatusNames = map[OrderStatus]string{
+	OS_Processing: "processing",
+	OS_Completed:  "completed",
+	OS_Failed:     "failed",
+}
+
+func (s OrderStatus) String() string {
+	return OrderStatusNames[s]
+}
+
+// The hashes of indexes, each index hash maps order_id to start_time
+const (
+	OrderIndexTable = "OrderIndex"
+	UserIndexName   = "user"
+	StepIndexName   = "step"
+	StatusIndexName = "status"
+	DayIndexName    = "day"
+	// The failed orders are indexed by failure reason
+	FailureIndexName = "failure"
+	DayIndexLayout   = "2006-01-02"
+	MaxDaysPerFind   = 366
+)
+
+// The definition of order query filter, the empty criteria are ignored
+type OrderFilter struct {
+	UserID      string
+	CurrentStep string
+	Status      string
+	// The reason of failure, e.g. "timeout"
+	FailureReason string
+	// The range of start time, StartFrom is inclusive and StartTo is exclusive
+	StartFrom time.Time
+	StartTo   time.Time
+}
+
+// Get the status of order
+func (this *OrderRecord) Status() string {
+	if this.FailureOccured {
+		return OS_Failed.String()
+	}
+	if this.Finished {
+		return OS_Completed.String()
+	}
+	return OS_Processing.String()
+}
+
+// The name of index hash
+func indexKey(indexName string, value string) string {
+	return OrderIndexTable + ":" + indexName + ":" + value
+}
+
+// The index hashes which current order belongs to
+func (this *OrderRecord) indexKeys() []string {
+	keys := []string{
+		indexKey(UserIndexName, this.UserID),
+		indexKey(StepIndexName, this.CurrentStep),
+		indexKey(StatusIndexName, this.Status()),
+		indexKey(DayIndexName, this.StartTime.UTC().Format(DayIndexLayout)),
+	}
+	if this.FailureOccured && this.FailureReason != "" {
+		keys = append(keys, indexKey(FailureIndexName, this.FailureReason))
+	}
+	return keys
+}
+
+// Generate the mutations moving order from the indexes it was saved in to current indexes
+func (this *OrderRecord) indexMutations() []db.Mutation {
+	keys := this.indexKeys()
+
+	var mutations []db.Mutation
+	for _, indexedKey := range this.indexedKeys {
+		stale := true
+		for _, key := range keys {
+			if key == indexedKey {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			mutations = append(mutations, db.Mutation{Key: indexedKey, HashKey: this.OrderID, Delete: true})
+		}
+	}
+	for _, key := range keys {
+		mutations = append(mutations, db.Mutation{Key: key, HashKey: this.OrderID, Value: FormatTime(this.StartTime)})
+	}
+	return mutations
+}
+
+// Generate the mutations adding order to the current indexes it is missing from,
+// e.g. the order saved before the indexes were introduced
+func (this *OrderRecord) missingIndexMutations() ([]db.Mutation, error) {
+	var mutations []db.Mutation
+	for _, key := range this.indexKeys() {
+		recordMap := make(map[string]interface{})
+		if err := this.database.Read("", recordMap, key, this.OrderID); err != nil {
+			return nil, err
+		}
+		if value, _ := recordMap[this.OrderID].([]byte); string(value) != FormatTime(this.StartTime) {
+			mutations = append(mutations, db.Mutation{Key: key, HashKey: this.OrderID, Value: FormatTime(this.StartTime)})
+		}
+	}
+	return mutations, nil
+}
+
+// Find the orders matching all the criteria of filter, sorted by start time
+func Find(database db.IDatabase, filter *OrderFilter) ([]*OrderRecord, error) {
+	var candidates map[string]bool
+
+	// Keep the orders found in every index
+	intersect := func(key string) error {
+		hash, err := db.QueryHash(database, key)
+		if err != nil {
+			return err
+		}
+		matched := make(map[string]bool)
+		for orderId := range hash {
+			if candidates == nil || candidates[orderId] {
+				matched[orderId] = true
+			}
+		}
+		candidates = matched
+		return nil
+	}
+
+	if filter.UserID != "" {
+		if err := intersect(indexKey(UserIndexName, filter.UserID)); err != nil {
+			return nil, err
+		}
+	}
+	if filter.CurrentStep != "" {
+		if err := intersect(indexKey(StepIndexName, filter.CurrentStep)); err != nil {
+			return nil, err
+		}
+	}
+	if filter.Status != "" {
+		if err := intersect(indexKey(StatusIndexName, filter.Status)); err != nil {
+			return nil, err
+		}
+	}
+	if filter.FailureReason != "" {
+		if err := intersect(indexKey(FailureIndexName, filter.FailureReason)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Narrow down by the day indexes if the time range is bounded
+	if !filter.StartFrom.IsZero() && !filter.StartTo.IsZero() &&
+		filter.StartTo.Sub(filter.StartFrom) <= MaxDaysPerFind*24*time.Hour {
+		days := make(map[string]bool)
+		for day := filter.StartFrom.UTC().Truncate(24 * time.Hour); day.Before(filter.StartTo); day = day.Add(24 * time.Hour) {
+			hash, err := db.QueryHash(database, indexKey(DayIndexName, day.Format(DayIndexLayout)))
+			if err != nil {
+				return nil, err
+			}
+			for orderId := range hash {
+				if candidates == nil || candidates[orderId] {
+					days[orderId] = true
+				}
+			}
+		}
+		candidates = days
+	}
+
+	if candidates == nil {
+		return nil, errors.New("At least one of user, step, status, failure reason or bounded time range is required")
+	}
+
+	records := []*OrderRecord{}
+	for orderId := range candidates {
+		record, err := Get(database, orderId)
+		if err != nil {
+			return nil, err
+		}
+		if record.matchFilter(filter) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartTime.Before(records[j].StartTime)
+	})
+	return records, nil
+}
+
+// Check whether order matches the filter, since the index may be updated after it is queried
+func (this *OrderRecord) matchFilter(filter *OrderFilter) bool {
+	if filter.UserID != "" && this.UserID != filter.UserID {
+		return false
+	}
+	if filter.CurrentStep != "" && this.CurrentStep != filter.CurrentStep {
+		return false
+	}
+	if filter.Status != "" && this.Status() != filter.Status {
+		return false
+	}
+	if filter.FailureReason != "" && (!this.FailureOccured || this.FailureReason != filter.FailureReason) {
+		return false
+	}
+	if !filter.StartFrom.IsZero() && this.StartTime.Before(filter.StartFrom) {
+		return false
+	}
+	if !filter.StartTo.IsZero() && !this.StartTime.Before(filter.StartTo) {
+		return false
+	}
+	return true
+}
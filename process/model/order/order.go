@@ -5,31 +5,71 @@ import (
 	"errors"
 	"fmt"
 	"order_process/process/db"
+	"order_process/process/model/workflow"
 	"order_process/process/util"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // The definition of Order
 type OrderRecord struct {
-	OrderID        string      `json:"order_id"`
-	CurrentStep    string      `json:"current_step"`
-	StartTime      string      `json:"start_time"`
-	CompleteTime   string      `json:"complete_time"`
-	Steps          []OrderStep `json:"steps"`
-	UserID         string      `json:"user_id"`
-	Finished       bool        `json:"finished"`
-	FailureOccured bool        `json:"failure_occured"`
-	ServiceID      string      `json:"service_id"`
-	RollbackState  string      `json:"rollback_state"`
+	OrderID        string        `json:"order_id"`
+	CurrentStep    string        `json:"current_step"`
+	StartTime      time.Time     `json:"start_time"`
+	NotBefore      time.Time     `json:"not_before"`
+	Deadline       time.Time     `json:"deadline"`
+	CompleteTime   time.Time     `json:"complete_time"`
+	Steps          []OrderStep   `json:"steps"`
+	UserID         string        `json:"user_id"`
+	Workflow       string        `json:"workflow"`
+	Priority       string        `json:"priority"`
+	Payload        *OrderPayload `json:"payload"`
+	Totals         *OrderTotals  `json:"totals"`
+	Cancelled      bool          `json:"cancelled"`
+	CancelReason   string        `json:"cancel_reason"`
+	CancelTime     time.Time     `json:"cancel_time"`
+	Finished       bool          `json:"finished"`
+	FailureOccured bool          `json:"failure_occured"`
+	FailureReason  string        `json:"failure_reason"`
+	FailureMessage string        `json:"failure_message"`
+	FailureStep    string        `json:"failure_step"`
+	ServiceID      string        `json:"service_id"`
+	RollbackState  string        `json:"rollback_state"`
+	Version        int64         `json:"version"`
+
+	// The attempts of the failed order are linked to the original order
+	OriginalOrderID string `json:"original_order_id"`
+	Attempt         int    `json:"attempt"`
+	RetryOf         string `json:"retry_of"`
+	RetriedBy       string `json:"retried_by"`
+
+	// The family of orders by split or merge, the parent follows its children
+	ParentID string   `json:"parent_id"`
+	ChildIDs []string `json:"child_ids"`
+
+	database db.IDatabase
+	// The index hashes which the order was saved in
+	indexedKeys []string
+	// The events to be saved with the order
+	pendingEvents []OrderEvent
+	// The order is read from archive
+	archived bool
 }
 
 // The definition of Order Step
 type OrderStep struct {
-	StepName       string `json:"step_name"`
-	StartTime      string `json:"step_start_time"`
-	CompleteTime   string `json:"step_complete_time"`
-	StepCompleted  bool   `json:"step_completed"`
-	StepRollbacked bool   `json:"step_rollbacked"`
+	StepName       string    `json:"step_name"`
+	StartTime      time.Time `json:"step_start_time"`
+	CompleteTime   time.Time `json:"step_complete_time"`
+	StepCompleted  bool      `json:"step_completed"`
+	StepRollbacked bool      `json:"step_rollbacked"`
+	// The result reported by the executor of step, empty if nothing is reported
+	StepResult string `json:"step_result"`
+	// The failed attempts of compensation during rollback
+	CompensateAttempts int `json:"compensate_attempts"`
+	// Whether the compensation is given up after the attempts, the step should be revoked manually
+	CompensateFailed bool `json:"compensate_failed"`
 }
 
 // The definition of RollbackState
@@ -67,116 +107,385 @@ var OrderStateInServiceNames = map[OrderStateInService]string{
 const (
 	OrderTableName           = "Orders"
 	OrderStateInServiceTable = "OrderStateInService"
+	OrderVersionTable        = "OrderVersions"
+	// The max delay of order
+	MaxOrderDelay = 366 * 24 * time.Hour
 )
 
+// The error returned when the order has been saved by others since it was loaded
+type VersionConflictError struct {
+	OrderID string
+	Version int64
+}
+
+func (this *VersionConflictError) Error() string {
+	return fmt.Sprintf("Order [%s] has been updated since version [%d]", this.OrderID, this.Version)
+}
+
+// The error returned when the order is neither saved nor archived
+type NotFoundError struct {
+	OrderID string
+}
+
+func (this *NotFoundError) Error() string {
+	return fmt.Sprintf("Order [%s] not found", this.OrderID)
+}
+
 func (s OrderStateInService) String() string {
 	return OrderStateInServiceNames[s]
 }
 
+// The layouts of timestamps, the legacy one is produced by time.Time.String()
+const (
+	TimeLayout       = time.RFC3339Nano
+	LegacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+)
+
+// Format the timestamp in RFC 3339 with nanoseconds
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeLayout)
+}
+
+// Parse the timestamp in RFC 3339 or legacy layout
+func ParseTime(str string) (time.Time, error) {
+	if t, err := time.Parse(TimeLayout, str); err == nil {
+		return t.UTC(), nil
+	}
+
+	// Drop the monotonic clock reading
+	if index := strings.Index(str, " m="); index >= 0 {
+		str = str[:index]
+	}
+	t, err := time.Parse(LegacyTimeLayout, str)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// Get the timestamp of field in record map, the absent or empty field is zero time
+func timeField(value interface{}) (time.Time, error) {
+	switch t := value.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		if t == "" {
+			return time.Time{}, nil
+		}
+		return ParseTime(t)
+	case nil:
+		return time.Time{}, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid timestamp [%v]", value)
+}
+
+// Get the string of required field in record map
+func stringField(fields map[string]interface{}, key string) (string, error) {
+	str, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("Invalid %s [%v]", key, fields[key])
+	}
+	return str, nil
+}
+
+// Get the bool of required field in record map
+func boolField(fields map[string]interface{}, key string) (bool, error) {
+	value, ok := fields[key].(bool)
+	if !ok {
+		return false, fmt.Errorf("Invalid %s [%v]", key, fields[key])
+	}
+	return value, nil
+}
+
+// Get the list of strings of field in record map, nil if absent
+func stringsField(value interface{}) ([]string, error) {
+	switch list := value.(type) {
+	case []string:
+		return list, nil
+	case nil:
+		return nil, nil
+	case []interface{}:
+		strs := make([]string, 0, len(list))
+		for _, item := range list {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid string [%v]", item)
+			}
+			strs = append(strs, str)
+		}
+		return strs, nil
+	}
+	return nil, fmt.Errorf("Invalid list of strings [%v]", value)
+}
+
 // New order record
-func New(record map[string]interface{}) (*OrderRecord, error) {
-	id := util.NewUUID()
-	record["order_id"] = id
-	record["current_step"] = "Scheduling"
-	record["start_time"] = time.Now().UTC().String()
+func New(database db.IDatabase, record map[string]interface{}) (*OrderRecord, error) {
+	return NewWith(database, record, nil, nil)
+}
+
+// Create the new order along with the additional conditions and mutations in one transaction,
+// the order id can be specified by record to generate them before the order is created
+func NewWith(database db.IDatabase, record map[string]interface{}, conditions []db.Condition, mutations []db.Mutation) (*OrderRecord, error) {
+	if err := initRecord(record); err != nil {
+		return nil, err
+	}
+	return create(database, record, OrderEvent{Type: ET_Created.String(), Actor: UserActor(record["user_id"].(string))},
+		conditions, mutations)
+}
+
+// Initialize the id, workflow, first step and start time of new order,
+// the order runs under the default workflow if not specified
+func initRecord(record map[string]interface{}) error {
+	workflowName, _ := record["workflow"].(string)
+	orderWorkflow := workflow.Default()
+	if workflowName != "" {
+		orderWorkflow = workflow.Get(workflowName)
+	}
+	if orderWorkflow == nil {
+		return fmt.Errorf("Workflow [%s] is not defined", workflowName)
+	}
+
+	if orderId, _ := record["order_id"].(string); orderId == "" {
+		record["order_id"] = util.NewUUID()
+	}
+	record["workflow"] = orderWorkflow.Name
+	record["current_step"] = orderWorkflow.InitialStep
+	record["start_time"] = time.Now().UTC()
+	if notBefore, ok := record["not_before"].(time.Time); ok && notBefore.After(record["start_time"].(time.Time)) {
+		if orderWorkflow.DelayedStep == "" {
+			return fmt.Errorf("Workflow [%s] cannot start orders later", orderWorkflow.Name)
+		}
+		// The delayed order enters the initial step when due
+		record["current_step"] = orderWorkflow.DelayedStep
+	}
 
 	steps := []OrderStep{}
 	orderStep := OrderStep{
 		StepName:       record["current_step"].(string),
-		StartTime:      time.Now().UTC().String(),
+		StartTime:      record["start_time"].(time.Time),
 		StepCompleted:  false,
 		StepRollbacked: false,
 	}
 	steps = append(steps, orderStep)
 	record["steps"] = steps
-	record["finished"] = false
-	record["failure_occured"] = false
-	record["rollback_state"] = UnTriggerred.String()
+	return nil
+}
 
-	orderRecord, err := generateOrderRecord(record)
+// Create the order record with its id, steps and start time along with the additional conditions and mutations,
+// the creation is recorded by event
+func create(database db.IDatabase, record map[string]interface{}, event OrderEvent,
+	conditions []db.Condition, mutations []db.Mutation) (*OrderRecord, error) {
+	orderRecord, err := build(database, record, event)
 	if err != nil {
 		return nil, err
 	}
 
-	UpdateOrderStateInService(record["service_id"].(string), id, OSS_Active.String())
-	err = orderRecord.SaveToDB(OSS_Active.String())
+	// The order becomes active in its service in the transaction creating it
+	condition, mutation := orderRecord.activation()
+	err = orderRecord.save(append(conditions, condition), append(mutations, mutation))
 	if err != nil {
 		return nil, err
 	}
 	return orderRecord, nil
 }
 
-// Generate Order Record according information stored in record map
-func generateOrderRecord(record map[string]interface{}) (*OrderRecord, error) {
-	if record["order_id"] == nil {
-		return nil, errors.New("order_id is required")
+// The condition and mutation making the new order active in its service
+func (this *OrderRecord) activation() (db.Condition, db.Mutation) {
+	condition := db.Condition{
+		Key:     OrderStateInServiceTable + ":" + this.ServiceID,
+		HashKey: this.OrderID,
+		Absent:  true,
 	}
-	if record["service_id"] == nil {
-		return nil, errors.New("service_id is required")
+	mutation := db.Mutation{
+		Key:     OrderStateInServiceTable + ":" + this.ServiceID,
+		HashKey: this.OrderID,
+		Value:   orderStateInServiceInfo(this.OrderID, OSS_Active.String()),
 	}
-	if record["current_step"] == nil {
-		return nil, errors.New("current_step is required")
-	}
-	if record["start_time"] == nil {
-		return nil, errors.New("start_time is required")
-	}
-	if record["steps"] == nil {
-		return nil, errors.New("steps is required")
+	return condition, mutation
+}
+
+// Build the new order record which is not saved yet, the creation is recorded by event
+func build(database db.IDatabase, record map[string]interface{}, event OrderEvent) (*OrderRecord, error) {
+	record["finished"] = false
+	record["failure_occured"] = false
+	record["rollback_state"] = UnTriggerred.String()
+	record["schema_version"] = CurrentSchemaVersion
+
+	orderRecord, err := generateOrderRecord(database, record)
+	if err != nil {
+		return nil, err
 	}
-	if record["user_id"] == nil {
-		return nil, errors.New("user_id is required")
+
+	event.Step = orderRecord.CurrentStep
+	orderRecord.AddEvent(event)
+	return orderRecord, nil
+}
+
+// Generate Order Record according information stored in record map
+func generateOrderRecord(database db.IDatabase, record map[string]interface{}) (*OrderRecord, error) {
+	for _, key := range []string{"order_id", "service_id", "current_step", "start_time", "steps", "user_id"} {
+		if record[key] == nil {
+			return nil, fmt.Errorf("%s is required", key)
+		}
 	}
 
-	parseStep := func(stepMap map[string]interface{}) OrderStep {
-		step := OrderStep{
-			StepName:       stepMap["step_name"].(string),
-			StartTime:      stepMap["step_start_time"].(string),
-			StepCompleted:  stepMap["step_completed"].(bool),
-			StepRollbacked: stepMap["step_rollbacked"].(bool),
+	parseStep := func(stepMap map[string]interface{}) (OrderStep, error) {
+		var step OrderStep
+		var err error
+		if step.StepName, err = stringField(stepMap, "step_name"); err != nil {
+			return step, err
 		}
-		if v, ok := stepMap["step_complete_time"].(string); ok {
-			step.CompleteTime = v
+		if step.StepCompleted, err = boolField(stepMap, "step_completed"); err != nil {
+			return step, err
 		}
-		return step
+		if step.StepRollbacked, err = boolField(stepMap, "step_rollbacked"); err != nil {
+			return step, err
+		}
+		step.StepResult, _ = stepMap["step_result"].(string)
+		switch attempts := stepMap["compensate_attempts"].(type) {
+		case float64:
+			step.CompensateAttempts = int(attempts)
+		case int:
+			step.CompensateAttempts = attempts
+		}
+		step.CompensateFailed, _ = stepMap["compensate_failed"].(bool)
+		step.StartTime, err = timeField(stepMap["step_start_time"])
+		if err != nil {
+			return step, err
+		}
+		step.CompleteTime, err = timeField(stepMap["step_complete_time"])
+		return step, err
 	}
 
 	var steps []OrderStep
-	if stepsMaps, ok := record["steps"].([]string); ok {
+	switch stepsMaps := record["steps"].(type) {
+	case []string:
 		for _, jsonStep := range stepsMaps {
 			stepMap := map[string]interface{}{}
 			err := json.Unmarshal([]byte(jsonStep), &stepMap)
 			if err != nil {
 				return nil, err
 			}
-			steps = append(steps, parseStep(stepMap))
+			step, err := parseStep(stepMap)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
 		}
-	} else if stepsMaps, ok := record["steps"].([]map[string]interface{}); ok {
+	case []map[string]interface{}:
 		for _, stepMap := range stepsMaps {
-			steps = append(steps, parseStep(stepMap))
+			step, err := parseStep(stepMap)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
 		}
-	} else if _, ok := record["steps"].([]OrderStep); ok {
-		steps, _ = record["steps"].([]OrderStep)
-	} else {
-		for _, stepMapInterface := range record["steps"].([]interface{}) {
-			stepMap := stepMapInterface.(map[string]interface{})
-			steps = append(steps, parseStep(stepMap))
+	case []OrderStep:
+		steps = stepsMaps
+	case []interface{}:
+		for _, stepMapInterface := range stepsMaps {
+			stepMap, ok := stepMapInterface.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Invalid step [%v]", stepMapInterface)
+			}
+			step, err := parseStep(stepMap)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
 		}
+	default:
+		return nil, fmt.Errorf("Invalid steps [%v]", record["steps"])
+	}
+
+	startTime, err := timeField(record["start_time"])
+	if err != nil {
+		return nil, err
 	}
 
 	orderRecord := OrderRecord{
-		OrderID:        record["order_id"].(string),
-		CurrentStep:    record["current_step"].(string),
-		StartTime:      record["start_time"].(string),
-		Steps:          steps,
-		UserID:         record["user_id"].(string),
-		Finished:       record["finished"].(bool),
-		FailureOccured: record["failure_occured"].(bool),
-		ServiceID:      record["service_id"].(string),
-		RollbackState:  record["rollback_state"].(string),
+		StartTime: startTime,
+		Steps:     steps,
+		database:  database,
+	}
+	for key, field := range map[string]*string{
+		"order_id":       &orderRecord.OrderID,
+		"current_step":   &orderRecord.CurrentStep,
+		"user_id":        &orderRecord.UserID,
+		"service_id":     &orderRecord.ServiceID,
+		"rollback_state": &orderRecord.RollbackState,
+	} {
+		if *field, err = stringField(record, key); err != nil {
+			return nil, err
+		}
+	}
+	if orderRecord.Finished, err = boolField(record, "finished"); err != nil {
+		return nil, err
+	}
+	if orderRecord.FailureOccured, err = boolField(record, "failure_occured"); err != nil {
+		return nil, err
 	}
 	if orderRecord.Finished {
-		orderRecord.CompleteTime = record["complete_time"].(string)
+		orderRecord.CompleteTime, err = timeField(record["complete_time"])
+		if err != nil {
+			return nil, err
+		}
 	}
+	orderRecord.NotBefore, err = timeField(record["not_before"])
+	if err != nil {
+		return nil, err
+	}
+	orderRecord.Deadline, err = timeField(record["deadline"])
+	if err != nil {
+		return nil, err
+	}
+	orderRecord.FailureReason, _ = record["failure_reason"].(string)
+	orderRecord.Workflow, _ = record["workflow"].(string)
+	orderRecord.FailureMessage, _ = record["failure_message"].(string)
+	orderRecord.FailureStep, _ = record["failure_step"].(string)
+	orderRecord.OriginalOrderID, _ = record["original_order_id"].(string)
+	orderRecord.RetryOf, _ = record["retry_of"].(string)
+	orderRecord.RetriedBy, _ = record["retried_by"].(string)
+	switch attempt := record["attempt"].(type) {
+	case float64:
+		orderRecord.Attempt = int(attempt)
+	case int:
+		orderRecord.Attempt = attempt
+	}
+	orderRecord.ParentID, _ = record["parent_id"].(string)
+	orderRecord.ChildIDs, err = stringsField(record["child_ids"])
+	if err != nil {
+		return nil, err
+	}
+	if orderRecord.Attempt == 0 {
+		// The order submitted before retry is supported
+		orderRecord.Attempt = 1
+	}
+	orderRecord.Priority, _ = record["priority"].(string)
+	if orderRecord.Priority == "" {
+		// The order submitted before priority is supported
+		orderRecord.Priority = OP_Normal.String()
+	}
+	orderRecord.Payload, err = payloadField(record["payload"])
+	if err != nil {
+		return nil, err
+	}
+	orderRecord.Totals, err = totalsField(record["totals"])
+	if err != nil {
+		return nil, err
+	}
+	if cancelled, ok := record["cancelled"].(bool); ok && cancelled {
+		orderRecord.Cancelled = true
+		orderRecord.CancelReason, _ = record["cancel_reason"].(string)
+		orderRecord.CancelTime, err = timeField(record["cancel_time"])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if version, ok := record["version"].(float64); ok {
+		orderRecord.Version = int64(version)
+	}
+	orderRecord.indexedKeys = orderRecord.indexKeys()
 	return &orderRecord, nil
 }
 
@@ -195,12 +504,21 @@ func (this *OrderRecord) ToMap() *map[string]interface{} {
 	for _, step := range this.Steps {
 		stepMap := map[string]interface{}{
 			"step_name":       step.StepName,
-			"step_start_time": step.StartTime,
+			"step_start_time": FormatTime(step.StartTime),
 			"step_completed":  step.StepCompleted,
 			"step_rollbacked": step.StepRollbacked,
 		}
 		if step.StepCompleted {
-			stepMap["step_complete_time"] = step.CompleteTime
+			stepMap["step_complete_time"] = FormatTime(step.CompleteTime)
+		}
+		if step.StepResult != "" {
+			stepMap["step_result"] = step.StepResult
+		}
+		if step.CompensateAttempts > 0 {
+			stepMap["compensate_attempts"] = step.CompensateAttempts
+		}
+		if step.CompensateFailed {
+			stepMap["compensate_failed"] = true
 		}
 		stepsMap = append(stepsMap, stepMap)
 	}
@@ -208,17 +526,51 @@ func (this *OrderRecord) ToMap() *map[string]interface{} {
 	recordMap := map[string]interface{}{
 		"order_id":        this.OrderID,
 		"current_step":    this.CurrentStep,
-		"start_time":      this.StartTime,
+		"start_time":      FormatTime(this.StartTime),
 		"steps":           stepsMap,
 		"user_id":         this.UserID,
+		"priority":        this.Priority,
+		"payload":         this.Payload,
+		"totals":          this.Totals,
 		"finished":        this.Finished,
 		"failure_occured": this.FailureOccured,
+		"failure_reason":  this.FailureReason,
+		"failure_message": this.FailureMessage,
+		"failure_step":    this.FailureStep,
+		"workflow":        this.Workflow,
+		"attempt":         this.Attempt,
 		"service_id":      this.ServiceID,
 		"rollback_state":  this.RollbackState,
+		"version":         this.Version,
+		"schema_version":  CurrentSchemaVersion,
 	}
 
+	if !this.NotBefore.IsZero() {
+		recordMap["not_before"] = FormatTime(this.NotBefore)
+	}
+	if !this.Deadline.IsZero() {
+		recordMap["deadline"] = FormatTime(this.Deadline)
+	}
+	if this.OriginalOrderID != "" {
+		recordMap["original_order_id"] = this.OriginalOrderID
+		recordMap["retry_of"] = this.RetryOf
+	}
+	if this.RetriedBy != "" {
+		recordMap["retried_by"] = this.RetriedBy
+	}
+	if this.ParentID != "" {
+		recordMap["parent_id"] = this.ParentID
+	}
+	if len(this.ChildIDs) > 0 {
+		recordMap["child_ids"] = this.ChildIDs
+	}
 	if this.Finished {
-		recordMap["complete_time"] = this.CompleteTime
+		recordMap["complete_time"] = FormatTime(this.CompleteTime)
+	}
+	if this.Cancelled {
+		recordMap["cancelled"] = true
+		recordMap["cancel_reason"] = this.CancelReason
+		recordMap["cancel_time"] = FormatTime(this.CancelTime)
 	}
 	return &recordMap
 }
@@ -234,34 +586,93 @@ func (this *OrderRecord) ToJsonForUser() (string, error) {
 
 // Just used for query
 func (this *OrderRecord) toMapForUser() *map[string]interface{} {
+	displayName := func(step string) string {
+		if orderWorkflow := this.GetWorkflow(); orderWorkflow != nil {
+			return orderWorkflow.DisplayName(step)
+		}
+		return step
+	}
+
 	stepsMap := []map[string]interface{}{}
 	for _, step := range this.Steps {
 		stepMap := map[string]interface{}{
 			"step_name":       step.StepName,
-			"step_start_time": step.StartTime,
+			"display_name":    displayName(step.StepName),
+			"step_start_time": FormatTime(step.StartTime),
 		}
 		if step.StepCompleted {
-			stepMap["step_complete_time"] = step.CompleteTime
+			stepMap["step_complete_time"] = FormatTime(step.CompleteTime)
 		}
 		stepsMap = append(stepsMap, stepMap)
 	}
 
 	recordMap := map[string]interface{}{
-		"order_id":     this.OrderID,
-		"current_step": this.CurrentStep,
-		"start_time":   this.StartTime,
-		"steps":        stepsMap,
+		"order_id":                  this.OrderID,
+		"current_step":              this.CurrentStep,
+		"current_step_display_name": displayName(this.CurrentStep),
+		"workflow":                  this.Workflow,
+		"start_time":                FormatTime(this.StartTime),
+		"steps":                     stepsMap,
+		"priority":                  this.Priority,
+		"payload":                   this.Payload,
+		"totals":                    this.Totals,
+	}
+
+	// Estimate the progress by the step durations of the cluster
+	if durations, err := GetStepDurations(this.database); err == nil {
+		now := time.Now().UTC()
+		if percent, completeTime, ok := this.EstimateProgress(durations, now); ok {
+			recordMap["progress"] = percent
+			recordMap["estimated_complete_time"] = FormatTime(completeTime)
+			remaining := completeTime.Sub(now)
+			if remaining < 0 {
+				remaining = 0
+			}
+			recordMap["estimated_remaining_seconds"] = int64(remaining.Seconds())
+		}
 	}
 
+	if !this.NotBefore.IsZero() {
+		recordMap["not_before"] = FormatTime(this.NotBefore)
+	}
+	if !this.Deadline.IsZero() {
+		recordMap["deadline"] = FormatTime(this.Deadline)
+	}
 	if this.Finished {
-		recordMap["complete_time"] = this.CompleteTime
+		recordMap["complete_time"] = FormatTime(this.CompleteTime)
+	}
+	if this.Cancelled {
+		recordMap["cancelled"] = true
+		recordMap["cancel_reason"] = this.CancelReason
+		recordMap["cancel_time"] = FormatTime(this.CancelTime)
+	}
+	if this.FailureOccured {
+		recordMap["failure_reason"] = this.FailureReason
+		recordMap["failure_message"] = this.FailureMessage
+		recordMap["failure_step"] = this.FailureStep
+	}
+	recordMap["attempt"] = this.Attempt
+	if this.OriginalOrderID != "" {
+		recordMap["original_order_id"] = this.OriginalOrderID
+		recordMap["retry_of"] = this.RetryOf
+	}
+	if this.RetriedBy != "" {
+		recordMap["retried_by"] = this.RetriedBy
+	}
+	if this.ParentID != "" {
+		recordMap["parent_id"] = this.ParentID
+	}
+	if len(this.ChildIDs) > 0 {
+		recordMap["child_ids"] = this.ChildIDs
 	}
 	return &recordMap
 }
 
-// Save current order data to database
+// Save current order data and its indexes to database.
+// The save succeeds only if nobody else saved the order since it was loaded,
+// otherwise *VersionConflictError is returned.
 func (this *OrderRecord) SaveToDB(orderStateInService string) error {
-	state, err := GetOrderStateInService(this.ServiceID, this.OrderID)
+	state, err := GetOrderStateInService(this.database, this.ServiceID, this.OrderID)
 	if err != nil {
 		return err
 	}
@@ -270,25 +681,112 @@ func (this *OrderRecord) SaveToDB(orderStateInService string) error {
 		return errors.New("Cannot update order, because order is not active in current service")
 	}
 
-	str, err := this.ToJson()
-	err = db.Write(str, OrderTableName, this.OrderID)
+	// The order must be still active
+	conditions := []db.Condition{
+		{
+			Key:     OrderStateInServiceTable + ":" + this.ServiceID,
+			HashKey: this.OrderID,
+			Value:   orderStateInServiceInfo(this.OrderID, OSS_Active.String()),
+		},
+	}
+	mutations := []db.Mutation{}
+	if orderStateInService != OSS_Active.String() {
+		mutations = append(mutations, db.Mutation{
+			Key:     OrderStateInServiceTable + ":" + this.ServiceID,
+			HashKey: this.OrderID,
+			Value:   orderStateInServiceInfo(this.OrderID, orderStateInService),
+		})
+	}
+	return this.save(conditions, mutations)
+}
+
+// Save current order data and its indexes with additional conditions and mutations,
+// the order must not be saved by others since it was loaded.
+func (this *OrderRecord) save(conditions []db.Condition, mutations []db.Mutation) error {
+	return saveRecords([]*OrderRecord{this}, conditions, mutations)
+}
+
+// Save the orders in one transaction with additional conditions and mutations,
+// none of the orders must be saved by others since it was loaded.
+// The conflict is reported with the first order.
+func saveRecords(records []*OrderRecord, conditions []db.Condition, mutations []db.Mutation) error {
+	recordMutations := []db.Mutation{}
+	for index, record := range records {
+		conditions = append(conditions, db.Condition{
+			Key:     OrderVersionTable,
+			HashKey: record.OrderID,
+			Value:   strconv.FormatInt(record.Version, 10),
+			Absent:  record.Version == 0,
+		})
+
+		record.Version++
+		str, err := record.ToJson()
+		if err != nil {
+			restoreVersions(records[:index+1])
+			return err
+		}
+
+		recordMutations = append(recordMutations,
+			db.Mutation{Key: OrderTableName, HashKey: record.OrderID, Value: str},
+			db.Mutation{Key: OrderVersionTable, HashKey: record.OrderID, Value: strconv.FormatInt(record.Version, 10)})
+	}
+	mutations = append(recordMutations, mutations...)
+
+	for _, record := range records {
+		mutations = append(mutations, record.indexMutations()...)
+		for _, event := range record.pendingEvents {
+			condition, mutation, err := eventMutation(record.OrderID, event)
+			if err != nil {
+				restoreVersions(records)
+				return err
+			}
+			conditions = append(conditions, condition)
+			mutations = append(mutations, mutation)
+		}
+	}
+
+	err := records[0].database.Transact(conditions, mutations)
 	if err != nil {
+		restoreVersions(records)
+		if err == db.ErrConditionFailed {
+			return &VersionConflictError{OrderID: records[0].OrderID, Version: records[0].Version}
+		}
 		return err
 	}
-
-	if orderStateInService != OSS_Active.String() {
-		return UpdateOrderStateInService(this.ServiceID, this.OrderID, orderStateInService)
+	for _, record := range records {
+		record.indexedKeys = record.indexKeys()
+		record.pendingEvents = nil
 	}
 	return nil
 }
 
+// Restore the versions of orders which failed to be saved
+func restoreVersions(records []*OrderRecord) {
+	for _, record := range records {
+		record.Version--
+	}
+}
+
+// The error when the workflow of order is not defined any more
+var ErrWorkflowUndefined = errors.New("Workflow of order is not defined")
+
+// Get the workflow which the order runs under, nil if it is not defined any more
+func (this *OrderRecord) GetWorkflow() *workflow.Workflow {
+	return workflow.Get(this.Workflow)
+}
+
+// Reload the latest saved order data from database
+func (this *OrderRecord) Reload() (*OrderRecord, error) {
+	return Get(this.database, this.OrderID)
+}
+
 func (this *OrderRecord) GetOrderStateInService(serviceID string) (string, error) {
-	return GetOrderStateInService(serviceID, this.OrderID)
+	return GetOrderStateInService(this.database, serviceID, this.OrderID)
 }
 
-func GetOrderStateInService(serviceID string, orderID string) (string, error) {
+func GetOrderStateInService(database db.IDatabase, serviceID string, orderID string) (string, error) {
 	recordMap := make(map[string]interface{})
-	err := db.Read("", recordMap, OrderStateInServiceTable+":"+serviceID, orderID)
+	err := database.Read("", recordMap, OrderStateInServiceTable+":"+serviceID, orderID)
 	if err != nil {
 		return "", err
 	}
@@ -305,25 +803,67 @@ func GetOrderStateInService(serviceID string, orderID string) (string, error) {
 	return "", errors.New(fmt.Sprintf("IsOrderActiveInService: error state: [%v]", t))
 }
 
-func UpdateOrderStateInService(serviceID string, orderId string, orderStateInService string) error {
+func UpdateOrderStateInService(database db.IDatabase, serviceID string, orderId string, orderStateInService string) error {
 	// Update order state in service order list.
-	// Generate service information
+	err := database.Write(orderStateInServiceInfo(orderId, orderStateInService),
+		OrderStateInServiceTable+":"+serviceID, orderId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Move the active order from one service to another in one transaction, and record the transfer.
+// db.ErrConditionFailed is returned if the order is no longer active in the source service.
+func TransferOrderStateInService(database db.IDatabase, fromServiceID string, toServiceID string, orderId string) error {
+	transferCondition, transferMutation, err := eventMutation(orderId, newEvent(OrderEvent{
+		Type:          ET_Transferred.String(),
+		Actor:         ServiceActor(toServiceID),
+		FromServiceID: fromServiceID,
+		ToServiceID:   toServiceID,
+	}))
+	if err != nil {
+		return err
+	}
+
+	conditions := []db.Condition{
+		{
+			Key:     OrderStateInServiceTable + ":" + fromServiceID,
+			HashKey: orderId,
+			Value:   orderStateInServiceInfo(orderId, OSS_Active.String()),
+		},
+		transferCondition,
+	}
+	mutations := []db.Mutation{
+		{
+			Key:     OrderStateInServiceTable + ":" + fromServiceID,
+			HashKey: orderId,
+			Value:   orderStateInServiceInfo(orderId, OSS_Transferred.String()),
+		},
+		{
+			Key:     OrderStateInServiceTable + ":" + toServiceID,
+			HashKey: orderId,
+			Value:   orderStateInServiceInfo(orderId, OSS_Active.String()),
+		},
+		transferMutation,
+	}
+	return database.Transact(conditions, mutations)
+}
+
+// Generate the information of order state in service
+func orderStateInServiceInfo(orderId string, orderStateInService string) string {
 	regInfo := map[string]string{
 		"order_id":               orderId,
 		"order_state_in_service": orderStateInService,
 	}
 	regInfoJson, _ := json.Marshal(regInfo)
-	err := db.Write(string(regInfoJson), OrderStateInServiceTable+":"+serviceID, orderId)
-	if err != nil {
-		return err
-	}
-	return nil
+	return string(regInfoJson)
 }
 
 // Read from Database
-func ReadFromDB(orderID string) (map[string]interface{}, error) {
+func ReadFromDB(database db.IDatabase, orderID string) (map[string]interface{}, error) {
 	recordMap := make(map[string]interface{})
-	err := db.Read("", recordMap, OrderTableName, orderID)
+	err := database.Read("", recordMap, OrderTableName, orderID)
 	if err != nil {
 		return nil, err
 	}
@@ -331,22 +871,22 @@ func ReadFromDB(orderID string) (map[string]interface{}, error) {
 }
 
 // Retrieve order record from database
-func Get(orderId string) (*OrderRecord, error) {
+func Get(database db.IDatabase, orderId string) (*OrderRecord, error) {
 	err := util.ValidateUUID(orderId)
 	if err != nil {
 		return nil, err
 	}
 
-	recordMap, err := ReadFromDB(orderId)
-
-	t := make(map[string]interface{})
-	err = json.Unmarshal(recordMap[orderId].([]byte), &t)
+	recordMap, err := ReadFromDB(database, orderId)
 	if err != nil {
 		return nil, err
 	}
-	orderRecord, err := generateOrderRecord(t)
-	if err != nil {
-		return nil, err
+
+	// The finished order may have been archived
+	data, _ := recordMap[orderId].([]byte)
+	if len(data) == 0 {
+		return getArchived(database, orderId)
 	}
-	return orderRecord, nil
+
+	return parseOrderRecord(database, data)
 }
@@ -0,0 +1,197 @@
+package order
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/util"
+)
+
+// Create the order of user in service
+func newOrder(t *testing.T, database db.IDatabase) *OrderRecord {
+	record, err := New(database, map[string]interface{}{"user_id": "user", "service_id": "service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestNewGetSave(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	record := newOrder(t, database)
+	if record.Version != 1 || record.CurrentStep == "" || len(record.Steps) != 1 || record.StartTime.IsZero() {
+		t.Fatalf("new order is %+v", record)
+	}
+	if state, err := record.GetOrderStateInService("service"); err != nil || state != OSS_Active.String() {
+		t.Errorf("order is [%s] in service [%v]", state, err)
+	}
+	events, _, err := GetEvents(database, record.OrderID, "", 0)
+	if err != nil || len(events) != 1 || events[0].Type != ET_Created.String() {
+		t.Errorf("events of new order are %v [%v]", events, err)
+	}
+
+	loaded, err := Get(database, record.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.ToMap(), record.ToMap()) {
+		t.Errorf("loaded order differs\nsaved  %v\nloaded %v", record.ToMap(), loaded.ToMap())
+	}
+
+	// The indexes are moved with the order saved
+	loaded.CurrentStep = "Processing"
+	if err = loaded.SaveToDB(OSS_Active.String()); err != nil {
+		t.Fatal(err)
+	}
+	found, err := Find(database, &OrderFilter{UserID: "user", CurrentStep: "Processing"})
+	if err != nil || len(found) != 1 || found[0].Version != 2 {
+		t.Errorf("find got %v [%v]", found, err)
+	}
+	if hash, _ := db.QueryHash(database, indexKey(StepIndexName, record.CurrentStep)); len(hash) != 0 {
+		t.Errorf("order is kept in stale index %v", hash)
+	}
+
+	if _, err = Get(database, util.NewUUID()); err == nil {
+		t.Errorf("get missing order succeeded")
+	}
+	if _, err = Get(database, "invalid"); err == nil {
+		t.Errorf("get invalid order id succeeded")
+	}
+}
+
+func TestSaveStaleOrder(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	record := newOrder(t, database)
+	stale, err := Get(database, record.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record.Priority = OP_High.String()
+	if err = record.SaveToDB(OSS_Active.String()); err != nil {
+		t.Fatal(err)
+	}
+	stale.Priority = OP_Low.String()
+	err = stale.SaveToDB(OSS_Active.String())
+	if conflict, ok := err.(*VersionConflictError); !ok || conflict.OrderID != record.OrderID {
+		t.Fatalf("save stale order got [%v]", err)
+	}
+	if stale.Version != 1 {
+		t.Errorf("version of stale order is [%d]", stale.Version)
+	}
+
+	// The reloaded order can be saved again
+	reloaded, err := stale.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Priority != OP_High.String() {
+		t.Errorf("priority is [%s]", reloaded.Priority)
+	}
+	if err = reloaded.SaveToDB(OSS_Active.String()); err != nil {
+		t.Errorf("save reloaded order got [%v]", err)
+	}
+}
+
+func TestSaveInactiveOrder(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	record := newOrder(t, database)
+	if err := TransferOrderStateInService(database, "service", "other", record.OrderID); err != nil {
+		t.Fatal(err)
+	}
+	before := dump(t, database)
+
+	// The order transferred is saved by the service taking it over only
+	record.Priority = OP_High.String()
+	if err := record.SaveToDB(OSS_Active.String()); err == nil {
+		t.Errorf("save order transferred succeeded")
+	}
+	if after := dump(t, database); !reflect.DeepEqual(before, after) {
+		t.Errorf("order transferred is changed\nbefore %v\nafter  %v", before, after)
+	}
+	if err := TransferOrderStateInService(database, "service", "other", record.OrderID); err != db.ErrConditionFailed {
+		t.Errorf("transfer again got [%v]", err)
+	}
+
+	record.ServiceID = "other"
+	if err := record.SaveToDB(OSS_Completed.String()); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := record.GetOrderStateInService("other"); state != OSS_Completed.String() {
+		t.Errorf("order is [%s] in service", state)
+	}
+}
+
+func TestNewWith(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	orderId := util.NewUUID()
+
+	// The order is not created if the additional condition fails
+	_, err := NewWith(database, map[string]interface{}{"user_id": "user", "service_id": "service", "order_id": orderId},
+		[]db.Condition{{Key: "Extra", HashKey: "field", Value: "value"}},
+		[]db.Mutation{{Key: "Extra", HashKey: "field", Value: "bound"}})
+	if _, ok := err.(*VersionConflictError); !ok {
+		t.Fatalf("create with failed condition got [%v]", err)
+	}
+	if _, err = Get(database, orderId); err == nil {
+		t.Errorf("order is created with failed condition")
+	}
+	if keys, _ := database.Keys(""); len(keys) != 0 {
+		t.Errorf("failed creation left %v", dump(t, database))
+	}
+
+	database.Write("value", "Extra", "field")
+	record, err := NewWith(database, map[string]interface{}{"user_id": "user", "service_id": "service", "order_id": orderId},
+		[]db.Condition{{Key: "Extra", HashKey: "field", Value: "value"}},
+		[]db.Mutation{{Key: "Extra", HashKey: "field", Value: "bound"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.OrderID != orderId {
+		t.Errorf("order id is [%s]", record.OrderID)
+	}
+	if hash, _ := db.QueryHash(database, "Extra"); hash["field"] != "bound" {
+		t.Errorf("additional mutation is not applied %v", hash)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	expected := time.Date(2016, 3, 27, 10, 22, 31, 449261800, time.UTC)
+	cases := []struct {
+		str   string
+		valid bool
+	}{
+		// RFC 3339
+		{"2016-03-27T10:22:31.4492618Z", true},
+		{"2016-03-27T18:22:31.4492618+08:00", true},
+		{"2016-03-27T10:22:31.449261800Z", true},
+		// The legacy layout of time.Time.String()
+		{"2016-03-27 10:22:31.4492618 +0000 UTC", true},
+		{"2016-03-27 18:22:31.4492618 +0800 CST", true},
+		{"2016-03-27 10:22:31.4492618 +0000 UTC m=+3.000000001", true},
+		// Invalid
+		{"", false},
+		{"2016-03-27", false},
+		{"2016-03-27T10:22:31", false},
+		{"27 Mar 16 10:22 UTC", false},
+		{"2016-03-27 10:22:31.4492618 +0000 UTC m", false},
+	}
+
+	for _, c := range cases {
+		parsed, err := ParseTime(c.str)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("invalid [%s] is parsed as [%v]", c.str, parsed)
+			}
+			continue
+		}
+		if err != nil || !parsed.Equal(expected) || parsed.Location() != time.UTC {
+			t.Errorf("[%s] is parsed as [%v] [%v]", c.str, parsed, err)
+		}
+		if formatted := FormatTime(parsed); formatted != "2016-03-27T10:22:31.4492618Z" {
+			t.Errorf("[%s] is formatted as [%s]", c.str, formatted)
+		}
+	}
+}
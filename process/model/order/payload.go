@@ -0,0 +1,144 @@
+package order
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"order_process/process/model/workflow"
+)
+
+// The definition of the order payload submitted by customer
+type OrderPayload struct {
+	Currency        string                 `json:"currency,omitempty"`
+	LineItems       []LineItem             `json:"line_items"`
+	Discounts       []Discount             `json:"discounts,omitempty"`
+	TaxLines        []TaxLine              `json:"tax_lines,omitempty"`
+	ExpectedTotal   string                 `json:"expected_total,omitempty"`
+	ShippingAddress *ShippingAddress       `json:"shipping_address,omitempty"`
+	Attributes      map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// The definition of line item, the unit price is decimal string in currency of order
+type LineItem struct {
+	SKU       string `json:"sku"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice string `json:"unit_price"`
+}
+
+// The definition of shipping address
+type ShippingAddress struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	State      string `json:"state,omitempty"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+	Phone      string `json:"phone,omitempty"`
+}
+
+// The definition of the options of order submission, which are kept in order record besides payload
+type OrderOptions struct {
+	Priority string `json:"priority,omitempty"`
+	// The order is started at the time if specified
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	// The order fails with timeout if it is not completed by the time
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// The workflow which the order runs under, the default one if not specified
+	Workflow string `json:"workflow,omitempty"`
+}
+
+// Parse the payload and options from json of order submission, the unknown fields are rejected
+func ParseSubmission(data []byte) (*OrderPayload, *OrderOptions, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	submission := struct {
+		OrderPayload
+		OrderOptions
+	}{}
+	if err := decoder.Decode(&submission); err != nil {
+		return nil, nil, err
+	}
+	if _, err := ParseOrderPriority(submission.Priority); err != nil {
+		return nil, nil, err
+	}
+	orderWorkflow := workflow.Default()
+	if submission.Workflow != "" {
+		orderWorkflow = workflow.Get(submission.Workflow)
+	}
+	if orderWorkflow == nil {
+		return nil, nil, fmt.Errorf("Invalid workflow [%s]", submission.Workflow)
+	}
+	if submission.NotBefore != nil && orderWorkflow.DelayedStep == "" {
+		return nil, nil, fmt.Errorf("Workflow [%s] cannot start orders later", orderWorkflow.Name)
+	}
+	if submission.NotBefore != nil && submission.NotBefore.After(time.Now().Add(MaxOrderDelay)) {
+		return nil, nil, errors.New("not_before is too far in the future")
+	}
+	if submission.Deadline != nil {
+		if !submission.Deadline.After(time.Now()) {
+			return nil, nil, errors.New("deadline should be in the future")
+		}
+		if submission.NotBefore != nil && !submission.Deadline.After(*submission.NotBefore) {
+			return nil, nil, errors.New("deadline should be after not_before")
+		}
+	}
+	return &submission.OrderPayload, &submission.OrderOptions, nil
+}
+
+// Parse the payload from json, the unknown fields are rejected
+func ParsePayload(data []byte) (*OrderPayload, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	payload := OrderPayload{}
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// Get the payload of field in record map, nil if absent
+func payloadField(value interface{}) (*OrderPayload, error) {
+	switch payload := value.(type) {
+	case *OrderPayload:
+		return payload, nil
+	case nil:
+		return nil, nil
+	}
+
+	payload := OrderPayload{}
+	if err := decodeField(value, &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// Get the totals of field in record map, nil if absent
+func totalsField(value interface{}) (*OrderTotals, error) {
+	switch totals := value.(type) {
+	case *OrderTotals:
+		return totals, nil
+	case nil:
+		return nil, nil
+	}
+
+	totals := OrderTotals{}
+	if err := decodeField(value, &totals); err != nil {
+		return nil, err
+	}
+	return &totals, nil
+}
+
+// Decode the field of record map decoded from stored json into structure
+func decodeField(value interface{}, structure interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, structure)
+}
@@ -0,0 +1,287 @@
+package order
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The amount of money in minor units of currency (e.g. cents),
+// all the calculations are performed on integers to avoid rounding errors.
+type Money int64
+
+// The default currency and its digits of minor unit
+const (
+	DefaultCurrency       = "USD"
+	DefaultCurrencyDigits = 2
+	// The digits of percent in rates, e.g. "8.25" is 82500 in 1/10000 percent
+	PercentDigits = 4
+)
+
+// The currencies whose digits of minor unit is not default
+var CurrencyDigits = map[string]int{
+	"BIF": 0, "CLP": 0, "JPY": 0, "KRW": 0, "VND": 0,
+	"BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+// The definition of discount, either a fixed amount or a percent of subtotal
+type Discount struct {
+	Code    string `json:"code,omitempty"`
+	Amount  string `json:"amount,omitempty"`
+	Percent string `json:"percent,omitempty"`
+}
+
+// The definition of tax line, the rate is percent of discounted subtotal
+type TaxLine struct {
+	Name string `json:"name"`
+	Rate string `json:"rate"`
+}
+
+// The definition of computed order totals, all the amounts are decimal strings
+type OrderTotals struct {
+	Currency string         `json:"currency"`
+	Lines    []LineTotal    `json:"lines"`
+	Subtotal string         `json:"subtotal"`
+	Discount string         `json:"discount"`
+	Taxes    []TaxLineTotal `json:"taxes"`
+	Tax      string         `json:"tax"`
+	Total    string         `json:"total"`
+}
+
+// The definition of the total of line item
+type LineTotal struct {
+	SKU       string `json:"sku"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice string `json:"unit_price"`
+	Amount    string `json:"amount"`
+}
+
+// The definition of the total of tax line
+type TaxLineTotal struct {
+	Name   string `json:"name"`
+	Rate   string `json:"rate"`
+	Amount string `json:"amount"`
+}
+
+// The error of payload field which cannot be priced
+type PricingError struct {
+	// The JSON pointer of field, e.g. "/line_items/0/unit_price"
+	Field   string
+	Message string
+}
+
+func (this *PricingError) Error() string {
+	return fmt.Sprintf("Field [%s] %s", this.Field, this.Message)
+}
+
+// Get the digits of minor unit of currency
+func currencyDigits(currency string) int {
+	if digits, found := CurrencyDigits[currency]; found {
+		return digits
+	}
+	return DefaultCurrencyDigits
+}
+
+// Parse the non-negative decimal string into integer with specified fractional digits
+func parseDecimal(str string, digits int) (int64, error) {
+	parts := strings.SplitN(str, ".", 2)
+	fraction := ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if parts[0] == "" || len(fraction) > digits || (len(parts) == 2 && fraction == "") {
+		return 0, fmt.Errorf("Invalid decimal [%s] with at most %d fractional digits", str, digits)
+	}
+	for _, c := range parts[0] + fraction {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("Invalid decimal [%s]", str)
+		}
+	}
+	return strconv.ParseInt(parts[0]+fraction+strings.Repeat("0", digits-len(fraction)), 10, 64)
+}
+
+// Format the integer with specified fractional digits as decimal string
+func formatDecimal(value int64, digits int) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	str := fmt.Sprintf("%0*d", digits+1, value)
+	if digits == 0 {
+		return sign + str
+	}
+	return sign + str[:len(str)-digits] + "." + str[len(str)-digits:]
+}
+
+// Parse the amount of money in currency
+func ParseMoney(str string, currency string) (Money, error) {
+	value, err := parseDecimal(str, currencyDigits(currency))
+	return Money(value), err
+}
+
+// Format the amount of money in currency
+func (m Money) Format(currency string) string {
+	return formatDecimal(int64(m), currencyDigits(currency))
+}
+
+// Get the percent of money, rounded half up.
+// The rate is in 1/10000 percent.
+func (m Money) percent(rate int64) (Money, error) {
+	product := new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(rate))
+	divisor := big.NewInt(100)
+	divisor.Mul(divisor, new(big.Int).Exp(big.NewInt(10), big.NewInt(PercentDigits), nil))
+
+	// Round half up
+	product.Add(product, new(big.Int).Div(divisor, big.NewInt(2)))
+	product.Div(product, divisor)
+	if !product.IsInt64() {
+		return 0, errors.New("Amount overflow")
+	}
+	return Money(product.Int64()), nil
+}
+
+// Add amounts with overflow check
+func addMoney(a Money, b Money) (Money, error) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, errors.New("Amount overflow")
+	}
+	return sum, nil
+}
+
+// Compute the totals of payload: the subtotal of line items, minus discounts, plus taxes.
+// The invalid amounts of payload are reported as PricingError.
+func ComputeTotals(payload *OrderPayload) (*OrderTotals, error) {
+	currency := payload.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	totals := OrderTotals{
+		Currency: currency,
+		Lines:    []LineTotal{},
+		Taxes:    []TaxLineTotal{},
+	}
+
+	var subtotal Money
+	for index, item := range payload.LineItems {
+		if item.Quantity <= 0 {
+			return nil, &PricingError{
+				Field:   fmt.Sprintf("/line_items/%d/quantity", index),
+				Message: fmt.Sprintf("Invalid quantity [%d]", item.Quantity),
+			}
+		}
+		unitPrice, err := ParseMoney(item.UnitPrice, currency)
+		if err != nil {
+			return nil, &PricingError{Field: fmt.Sprintf("/line_items/%d/unit_price", index), Message: err.Error()}
+		}
+		amount := unitPrice * Money(item.Quantity)
+		if amount/Money(item.Quantity) != unitPrice {
+			return nil, errors.New("Amount overflow")
+		}
+		if subtotal, err = addMoney(subtotal, amount); err != nil {
+			return nil, err
+		}
+		totals.Lines = append(totals.Lines, LineTotal{
+			SKU:       item.SKU,
+			Quantity:  item.Quantity,
+			UnitPrice: unitPrice.Format(currency),
+			Amount:    amount.Format(currency),
+		})
+	}
+
+	var discount Money
+	for index, d := range payload.Discounts {
+		var amount Money
+		var err error
+		switch {
+		case d.Amount != "" && d.Percent == "":
+			if amount, err = ParseMoney(d.Amount, currency); err != nil {
+				return nil, &PricingError{Field: fmt.Sprintf("/discounts/%d/amount", index), Message: err.Error()}
+			}
+		case d.Percent != "" && d.Amount == "":
+			var rate int64
+			if rate, err = parseDecimal(d.Percent, PercentDigits); err != nil {
+				return nil, &PricingError{Field: fmt.Sprintf("/discounts/%d/percent", index), Message: err.Error()}
+			}
+			if amount, err = subtotal.percent(rate); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, &PricingError{
+				Field:   fmt.Sprintf("/discounts/%d", index),
+				Message: "should have either amount or percent",
+			}
+		}
+		if discount, err = addMoney(discount, amount); err != nil {
+			return nil, err
+		}
+	}
+	if discount > subtotal {
+		return nil, errors.New("Discount exceeds subtotal")
+	}
+
+	base := subtotal - discount
+	var tax Money
+	for index, line := range payload.TaxLines {
+		rate, err := parseDecimal(line.Rate, PercentDigits)
+		if err != nil {
+			return nil, &PricingError{Field: fmt.Sprintf("/tax_lines/%d/rate", index), Message: err.Error()}
+		}
+		amount, err := base.percent(rate)
+		if err != nil {
+			return nil, err
+		}
+		if tax, err = addMoney(tax, amount); err != nil {
+			return nil, err
+		}
+		totals.Taxes = append(totals.Taxes, TaxLineTotal{
+			Name:   line.Name,
+			Rate:   line.Rate,
+			Amount: amount.Format(currency),
+		})
+	}
+
+	total, err := addMoney(base, tax)
+	if err != nil {
+		return nil, err
+	}
+	totals.Subtotal = subtotal.Format(currency)
+	totals.Discount = discount.Format(currency)
+	totals.Tax = tax.Format(currency)
+	totals.Total = total.Format(currency)
+
+	// The total expected by customer must be exactly the same
+	if payload.ExpectedTotal != "" {
+		expected, err := ParseMoney(payload.ExpectedTotal, currency)
+		if err != nil {
+			return nil, &PricingError{Field: "/expected_total", Message: err.Error()}
+		}
+		if expected != total {
+			return nil, &PricingError{
+				Field:   "/expected_total",
+				Message: fmt.Sprintf("Expected total [%s] does not match total [%s]", payload.ExpectedTotal, totals.Total),
+			}
+		}
+	}
+	return &totals, nil
+}
+
+// Recompute the totals from payload and check them against the stored totals
+func (this *OrderRecord) VerifyTotals() error {
+	if this.Payload == nil || this.Totals == nil {
+		// The order submitted before pricing is supported
+		return nil
+	}
+	totals, err := ComputeTotals(this.Payload)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(totals, this.Totals) {
+		return errors.New("Order totals mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package order
+
+import (
+	"testing"
+)
+
+func TestComputeTotals(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload OrderPayload
+		// The subtotal, discount, tax and total expected
+		expected [4]string
+		// The field of PricingError or the message of other error expected
+		field string
+		err   string
+	}{
+		{
+			name:     "line items",
+			payload:  OrderPayload{LineItems: []LineItem{{SKU: "A", Quantity: 2, UnitPrice: "19.99"}, {SKU: "B", Quantity: 1, UnitPrice: "5"}}},
+			expected: [4]string{"44.98", "0.00", "0.00", "44.98"},
+		},
+		{
+			name: "discount and tax rounded half up",
+			payload: OrderPayload{
+				Currency:      "EUR",
+				LineItems:     []LineItem{{SKU: "A", Quantity: 2, UnitPrice: "19.99"}},
+				Discounts:     []Discount{{Code: "SPRING", Percent: "10"}},
+				TaxLines:      []TaxLine{{Name: "VAT", Rate: "20"}},
+				ExpectedTotal: "43.18",
+			},
+			expected: [4]string{"39.98", "4.00", "7.20", "43.18"},
+		},
+		{
+			name:     "half cent rounded up",
+			payload:  OrderPayload{LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "0.05"}}, TaxLines: []TaxLine{{Name: "T", Rate: "10"}}},
+			expected: [4]string{"0.05", "0.00", "0.01", "0.06"},
+		},
+		{
+			name:     "less than half cent rounded down",
+			payload:  OrderPayload{LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "0.04"}}, TaxLines: []TaxLine{{Name: "T", Rate: "10"}}},
+			expected: [4]string{"0.04", "0.00", "0.00", "0.04"},
+		},
+		{
+			name: "fractional percent discount",
+			payload: OrderPayload{
+				LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "100"}},
+				Discounts: []Discount{{Percent: "33.3333"}, {Amount: "0.01"}},
+			},
+			expected: [4]string{"100.00", "33.34", "0.00", "66.66"},
+		},
+		{
+			name: "percent of amount beyond int64 product",
+			payload: OrderPayload{
+				LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "90000000000000000"}},
+				Discounts: []Discount{{Percent: "100"}},
+			},
+			expected: [4]string{"90000000000000000.00", "90000000000000000.00", "0.00", "0.00"},
+		},
+		{
+			name: "tax lines",
+			payload: OrderPayload{
+				LineItems:     []LineItem{{SKU: "A", Quantity: 4, UnitPrice: "25"}},
+				TaxLines:      []TaxLine{{Name: "State", Rate: "5"}, {Name: "City", Rate: "2.5"}},
+				ExpectedTotal: "107.5",
+			},
+			expected: [4]string{"100.00", "0.00", "7.50", "107.50"},
+		},
+		{
+			name: "currency without minor unit",
+			payload: OrderPayload{
+				Currency:  "JPY",
+				LineItems: []LineItem{{SKU: "A", Quantity: 3, UnitPrice: "100"}},
+				TaxLines:  []TaxLine{{Name: "T", Rate: "8.25"}},
+			},
+			expected: [4]string{"300", "0", "25", "325"},
+		},
+		{
+			name:     "currency of 3 digits",
+			payload:  OrderPayload{Currency: "KWD", LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "1.234"}}},
+			expected: [4]string{"1.234", "0.000", "0.000", "1.234"},
+		},
+		{
+			name:    "line amount overflow",
+			payload: OrderPayload{LineItems: []LineItem{{SKU: "A", Quantity: 2, UnitPrice: "90000000000000000"}}},
+			err:     "Amount overflow",
+		},
+		{
+			name: "subtotal overflow",
+			payload: OrderPayload{LineItems: []LineItem{
+				{SKU: "A", Quantity: 1, UnitPrice: "50000000000000000"},
+				{SKU: "B", Quantity: 1, UnitPrice: "50000000000000000"},
+			}},
+			err: "Amount overflow",
+		},
+		{
+			name: "discount exceeds subtotal",
+			payload: OrderPayload{
+				LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "10"}},
+				Discounts: []Discount{{Amount: "10.01"}},
+			},
+			err: "Discount exceeds subtotal",
+		},
+		{
+			name:    "unit price of more digits than currency",
+			payload: OrderPayload{LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "1"}, {SKU: "B", Quantity: 1, UnitPrice: "19.999"}}},
+			field:   "/line_items/1/unit_price",
+		},
+		{
+			name:    "fractional unit price of currency without minor unit",
+			payload: OrderPayload{Currency: "JPY", LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "100.5"}}},
+			field:   "/line_items/0/unit_price",
+		},
+		{
+			name:    "invalid quantity",
+			payload: OrderPayload{LineItems: []LineItem{{SKU: "A", Quantity: 0, UnitPrice: "1"}}},
+			field:   "/line_items/0/quantity",
+		},
+		{
+			name: "discount of both amount and percent",
+			payload: OrderPayload{
+				LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "10"}},
+				Discounts: []Discount{{Amount: "1", Percent: "10"}},
+			},
+			field: "/discounts/0",
+		},
+		{
+			name: "invalid tax rate",
+			payload: OrderPayload{
+				LineItems: []LineItem{{SKU: "A", Quantity: 1, UnitPrice: "10"}},
+				TaxLines:  []TaxLine{{Name: "T", Rate: "8.25001"}},
+			},
+			field: "/tax_lines/0/rate",
+		},
+		{
+			name: "expected total mismatch",
+			payload: OrderPayload{
+				LineItems:     []LineItem{{SKU: "A", Quantity: 4, UnitPrice: "25"}},
+				TaxLines:      []TaxLine{{Name: "State", Rate: "5"}, {Name: "City", Rate: "2.5"}},
+				ExpectedTotal: "107.49",
+			},
+			field: "/expected_total",
+		},
+	}
+
+	for _, c := range cases {
+		totals, err := ComputeTotals(&c.payload)
+		switch {
+		case c.field != "":
+			if pricingErr, ok := err.(*PricingError); !ok || pricingErr.Field != c.field {
+				t.Errorf("%s: got [%v], expected error of field [%s]", c.name, err, c.field)
+			}
+		case c.err != "":
+			if _, ok := err.(*PricingError); err == nil || ok || err.Error() != c.err {
+				t.Errorf("%s: got [%v], expected [%s]", c.name, err, c.err)
+			}
+		case err != nil:
+			t.Errorf("%s: got [%v]", c.name, err)
+		default:
+			computed := [4]string{totals.Subtotal, totals.Discount, totals.Tax, totals.Total}
+			if computed != c.expected {
+				t.Errorf("%s: computed %v, expected %v", c.name, computed, c.expected)
+			}
+		}
+	}
+}
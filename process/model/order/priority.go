@@ -0,0 +1,52 @@
+package order
+
+import (
+	"fmt"
+)
+
+// The definition of OrderPriority, the greater one is processed first
+type OrderPriority int
+
+const (
+	OP_Low OrderPriority = iota
+	OP_Normal
+	OP_High
+	OP_Urgent
+)
+
+var OrderPriorities = []OrderPriority{
+	OP_Low,
+	OP_Normal,
+	OP_High,
+	OP_Urgent,
+}
+
+var OrderPriorityNames = map[OrderPriority]string{
+	OP_Low:    "low",
+	OP_Normal: "normal",
+	OP_High:   "high",
+	OP_Urgent: "urgent",
+}
+
+func (p OrderPriority) String() string {
+	return OrderPriorityNames[p]
+}
+
+// Parse the priority by name, the empty name is normal priority
+func ParseOrderPriority(name string) (OrderPriority, error) {
+	if name == "" {
+		return OP_Normal, nil
+	}
+	for _, priority := range OrderPriorities {
+		if priority.String() == name {
+			return priority, nil
+		}
+	}
+	return OP_Normal, fmt.Errorf("Invalid priority [%s]", name)
+}
+
+// Get the priority of order
+func (this *OrderRecord) GetPriority() OrderPriority {
+	priority, _ := ParseOrderPriority(this.Priority)
+	return priority
+}
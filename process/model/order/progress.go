@@ -0,0 +1,157 @@
+package order
+
+import (
+	"encoding/json"
+	"time"
+
+	"order_process/process/db"
+)
+
+// The hash mapping step name to the rolling statistics of its duration
+const (
+	StepDurationTable = "StepDurations"
+	// The max attempts to record the duration of step which is being recorded by others
+	MaxStepDurationAttempts = 5
+)
+
+var (
+	// The weight of the latest duration in the rolling average
+	StepDurationWeight = 0.1
+	// The estimated duration of step before any duration is recorded
+	DefaultStepDuration = 5 * time.Second
+)
+
+// The definition of the rolling statistics of step duration
+type StepDuration struct {
+	Average time.Duration `json:"average"`
+	Count   int64         `json:"count"`
+}
+
+// Add the duration to the rolling statistics. The first durations are averaged evenly
+// until the weight of each falls to StepDurationWeight.
+func (this StepDuration) add(duration time.Duration) StepDuration {
+	this.Count++
+	weight := 1 / float64(this.Count)
+	if weight < StepDurationWeight {
+		weight = StepDurationWeight
+	}
+	this.Average += time.Duration(weight * float64(duration-this.Average))
+	return this
+}
+
+// Record the duration of the completed step into the rolling statistics shared by the cluster
+func (this *OrderRecord) RecordStepDuration(step OrderStep) error {
+	duration := step.CompleteTime.Sub(step.StartTime)
+	if !step.StepCompleted || duration < 0 {
+		return nil
+	}
+
+	for attempt := 0; attempt < MaxStepDurationAttempts; attempt++ {
+		recordMap := make(map[string]interface{})
+		if err := this.database.Read("", recordMap, StepDurationTable, step.StepName); err != nil {
+			return err
+		}
+		data, _ := recordMap[step.StepName].([]byte)
+
+		stats := StepDuration{}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &stats); err != nil {
+				return err
+			}
+		}
+		latest, err := json.Marshal(stats.add(duration))
+		if err != nil {
+			return err
+		}
+
+		err = this.database.Transact(
+			[]db.Condition{{Key: StepDurationTable, HashKey: step.StepName, Value: string(data), Absent: len(data) == 0}},
+			[]db.Mutation{{Key: StepDurationTable, HashKey: step.StepName, Value: string(latest)}})
+		if err != db.ErrConditionFailed {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the rolling statistics of step durations
+func GetStepDurations(database db.IDatabase) (map[string]StepDuration, error) {
+	hash, err := db.QueryHash(database, StepDurationTable)
+	if err != nil {
+		return nil, err
+	}
+
+	durations := make(map[string]StepDuration)
+	for step, data := range hash {
+		stats := StepDuration{}
+		if err = json.Unmarshal([]byte(data), &stats); err != nil {
+			return nil, err
+		}
+		durations[step] = stats
+	}
+	return durations, nil
+}
+
+// Estimate the progress of order in percent and the time when it is completed by the durations
+// of the processing steps of its workflow, the failed order has no estimation.
+func (this *OrderRecord) EstimateProgress(durations map[string]StepDuration, now time.Time) (int, time.Time, bool) {
+	orderWorkflow := this.GetWorkflow()
+	if this.FailureOccured || this.Cancelled || orderWorkflow == nil {
+		return 0, time.Time{}, false
+	}
+	if this.Finished {
+		return 100, this.CompleteTime, true
+	}
+
+	expected := func(step string) time.Duration {
+		if stats, found := durations[step]; found && stats.Count > 0 {
+			return stats.Average
+		}
+		return DefaultStepDuration
+	}
+
+	steps := orderWorkflow.ProcessingSteps()
+	current := len(steps)
+	if this.CurrentStep == orderWorkflow.DelayedStep {
+		current = -1
+	}
+	for index, step := range steps {
+		if step == this.CurrentStep {
+			current = index
+		}
+	}
+
+	var done, remaining time.Duration
+	for index, step := range steps {
+		switch {
+		case index < current:
+			done += expected(step)
+		case index > current:
+			remaining += expected(step)
+		default:
+			// The current step is expected to take at least the time it has taken
+			last := this.Steps[len(this.Steps)-1]
+			elapsed := now.Sub(last.StartTime)
+			if last.StepCompleted || elapsed > expected(step) {
+				elapsed = expected(step)
+			}
+			done += elapsed
+			remaining += expected(step) - elapsed
+		}
+	}
+
+	start := now
+	if current < 0 && this.NotBefore.After(now) {
+		start = this.NotBefore
+	}
+
+	percent := 0
+	if done+remaining > 0 {
+		percent = int(done * 100 / (done + remaining))
+	}
+	if percent > 99 {
+		// Only the finished order is done
+		percent = 99
+	}
+	return percent, start.Add(remaining), true
+}
@@ -0,0 +1,107 @@
+package order
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateProgress(t *testing.T) {
+	now := time.Now().UTC()
+	durations := map[string]StepDuration{
+		"Scheduling":      {Average: 10 * time.Second, Count: 3},
+		"Pre-Processing":  {Average: 10 * time.Second, Count: 3},
+		"Processing":      {Average: 10 * time.Second, Count: 3},
+		"Post-Processing": {Average: 10 * time.Second, Count: 3},
+	}
+	cases := []struct {
+		name       string
+		record     OrderRecord
+		durations  map[string]StepDuration
+		percent    int
+		completion time.Time
+		estimated  bool
+	}{
+		{
+			name:       "delayed step",
+			record:     OrderRecord{CurrentStep: "Delayed", NotBefore: now.Add(time.Hour), Steps: []OrderStep{{StepName: "Delayed", StartTime: now}}},
+			durations:  durations,
+			completion: now.Add(time.Hour + 40*time.Second),
+			estimated:  true,
+		},
+		{
+			name:       "partial step",
+			record:     OrderRecord{CurrentStep: "Processing", Steps: []OrderStep{{StepName: "Processing", StartTime: now.Add(-4 * time.Second)}}},
+			durations:  durations,
+			percent:    60,
+			completion: now.Add(16 * time.Second),
+			estimated:  true,
+		},
+		{
+			name:       "step taking longer than expected",
+			record:     OrderRecord{CurrentStep: "Processing", Steps: []OrderStep{{StepName: "Processing", StartTime: now.Add(-30 * time.Second)}}},
+			durations:  durations,
+			percent:    75,
+			completion: now.Add(10 * time.Second),
+			estimated:  true,
+		},
+		{
+			name:       "default durations",
+			record:     OrderRecord{CurrentStep: "Pre-Processing", Steps: []OrderStep{{StepName: "Pre-Processing", StartTime: now}}},
+			percent:    25,
+			completion: now.Add(3 * DefaultStepDuration),
+			estimated:  true,
+		},
+		{
+			name: "last step completed",
+			record: OrderRecord{CurrentStep: "Post-Processing", Steps: []OrderStep{
+				{StepName: "Post-Processing", StartTime: now.Add(-time.Second), CompleteTime: now, StepCompleted: true},
+			}},
+			durations:  durations,
+			percent:    99,
+			completion: now,
+			estimated:  true,
+		},
+		{
+			name:       "finished order",
+			record:     OrderRecord{CurrentStep: "Completed", Finished: true, CompleteTime: now.Add(-time.Minute)},
+			durations:  durations,
+			percent:    100,
+			completion: now.Add(-time.Minute),
+			estimated:  true,
+		},
+		{
+			name: "rolling back order",
+			record: OrderRecord{CurrentStep: "Pre-Processing", FailureOccured: true, Steps: []OrderStep{
+				{StepName: "Scheduling", StepCompleted: true},
+				{StepName: "Pre-Processing", StepRollbacked: true},
+			}},
+			durations: durations,
+		},
+		{
+			name: "rolled back order",
+			record: OrderRecord{CurrentStep: "Failed", Finished: true, FailureOccured: true, Steps: []OrderStep{
+				{StepName: "Scheduling", StepCompleted: true, StepRollbacked: true},
+				{StepName: "Failed", StepCompleted: true},
+			}},
+			durations: durations,
+		},
+		{
+			name:      "cancelled order",
+			record:    OrderRecord{CurrentStep: "Scheduling", Cancelled: true, Steps: []OrderStep{{StepName: "Scheduling", StartTime: now}}},
+			durations: durations,
+		},
+		{
+			name:      "unknown workflow",
+			record:    OrderRecord{CurrentStep: "Scheduling", Workflow: "unknown", Steps: []OrderStep{{StepName: "Scheduling", StartTime: now}}},
+			durations: durations,
+		},
+	}
+
+	for _, c := range cases {
+		percent, completion, estimated := c.record.EstimateProgress(c.durations, now)
+		if percent != c.percent || !completion.Equal(c.completion) || estimated != c.estimated {
+			t.Errorf("%s: estimated [%v] %d%% completed at %v, expected [%v] %d%% at %v",
+				c.name, estimated, percent, completion, c.estimated, c.percent, c.completion)
+		}
+	}
+}
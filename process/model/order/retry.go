@@ -0,0 +1,130 @@
+package order
+
+import (
+	"errors"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/util"
+)
+
+// The errors when the order cannot be retried
+var (
+	ErrOrderNotFailed = errors.New("Order has not failed")
+	ErrOrderRetried   = errors.New("Order has been retried")
+	ErrOrderArchived  = errors.New("Order has been archived")
+)
+
+// Check whether the order can be retried
+func (this *OrderRecord) Retryable() error {
+	if this.Cancelled {
+		return ErrOrderCancelled
+	}
+	if !this.FailureOccured || !this.Finished {
+		return ErrOrderNotFailed
+	}
+	if this.RetriedBy != "" {
+		return ErrOrderRetried
+	}
+	if this.ParentID != "" || len(this.ChildIDs) > 0 {
+		return ErrOrderInFamily
+	}
+	if this.archived {
+		return ErrOrderArchived
+	}
+	if this.GetWorkflow() == nil {
+		return ErrWorkflowUndefined
+	}
+	return nil
+}
+
+// Create a new attempt of the failed order owned by service.
+// The attempt resumes from the step that failed with the earlier steps kept as recorded if resume is set,
+// otherwise it starts from the initial step of its workflow again.
+// The deadline of attempt is unbounded if zero.
+// The failed order is linked to the attempt in the transaction creating it, so it is retried only once.
+func Retry(database db.IDatabase, orderId string, serviceID string, actor string, resume bool, deadline time.Time) (*OrderRecord, error) {
+	record, err := Get(database, orderId)
+	if err != nil {
+		return nil, err
+	}
+	if err = record.Retryable(); err != nil {
+		return nil, err
+	}
+
+	attemptId := util.NewUUID()
+	record.RetriedBy = attemptId
+	record.AddEvent(OrderEvent{
+		Type:      ET_Retried.String(),
+		Actor:     actor,
+		Step:      record.CurrentStep,
+		AttemptID: attemptId,
+	})
+
+	attempt, err := build(database, record.attemptRecord(attemptId, serviceID, resume, deadline),
+		OrderEvent{Type: ET_Created.String(), Actor: actor})
+	if err != nil {
+		return nil, err
+	}
+
+	// The failed order is not updated by its owner any more, so only its version is conditioned
+	condition, mutation := attempt.activation()
+	err = saveRecords([]*OrderRecord{record, attempt}, []db.Condition{condition}, []db.Mutation{mutation})
+	if _, ok := err.(*VersionConflictError); ok {
+		return nil, ErrOrderRetried
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// Generate the record map of the new attempt of failed order
+func (this *OrderRecord) attemptRecord(attemptId string, serviceID string, resume bool, deadline time.Time) map[string]interface{} {
+	now := time.Now().UTC()
+
+	originalId := this.OriginalOrderID
+	if originalId == "" {
+		originalId = this.OrderID
+	}
+
+	orderWorkflow := this.GetWorkflow()
+	steps := []OrderStep{}
+	currentStep := orderWorkflow.InitialStep
+	if resume && this.FailureStep != "" && this.FailureStep != orderWorkflow.DelayedStep {
+		// Keep the steps before the failed one without performing them again,
+		// the steps compensated by the failed order are not compensated again by the attempt
+		kept := []OrderStep{}
+		for _, step := range this.Steps {
+			if step.StepName == this.FailureStep {
+				currentStep = step.StepName
+				steps = kept
+				break
+			}
+			if step.StepName != orderWorkflow.DelayedStep {
+				kept = append(kept, step)
+			}
+		}
+	}
+	steps = append(steps, OrderStep{StepName: currentStep, StartTime: now})
+
+	record := map[string]interface{}{
+		"order_id":          attemptId,
+		"service_id":        serviceID,
+		"user_id":           this.UserID,
+		"workflow":          this.Workflow,
+		"current_step":      currentStep,
+		"start_time":        now,
+		"steps":             steps,
+		"priority":          this.Priority,
+		"payload":           this.Payload,
+		"totals":            this.Totals,
+		"original_order_id": originalId,
+		"retry_of":          this.OrderID,
+		"attempt":           this.Attempt + 1,
+	}
+	if !deadline.IsZero() {
+		record["deadline"] = deadline.UTC()
+	}
+	return record
+}
@@ -0,0 +1,166 @@
+package order
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+)
+
+// Create the order failed at the last of steps, which are completed except the failed one
+func newFailedOrder(t *testing.T, database db.IDatabase, steps []OrderStep) *OrderRecord {
+	record, err := New(database, map[string]interface{}{"user_id": "user", "service_id": "service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failureStep := steps[len(steps)-1].StepName
+	now := time.Now().UTC()
+	for index := range steps {
+		steps[index].StartTime = now
+		if index < len(steps)-1 {
+			steps[index].StepCompleted = true
+			steps[index].CompleteTime = now
+		}
+	}
+	record.Steps = append(steps, OrderStep{StepName: "Failed", StartTime: now, CompleteTime: now, StepCompleted: true})
+	record.CurrentStep = "Failed"
+	record.FailureOccured = true
+	record.FailureStep = failureStep
+	record.FailureReason = FR_Error.String()
+	record.RollbackState = Triggerred.String()
+	record.Finished = true
+	record.CompleteTime = now
+	if err = record.SaveToDB(OSS_Completed.String()); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func stepNames(steps []OrderStep) []string {
+	names := []string{}
+	for _, step := range steps {
+		names = append(names, step.StepName)
+	}
+	return names
+}
+
+func TestRetryResume(t *testing.T) {
+	cases := []struct {
+		name  string
+		steps []OrderStep
+		kept  []string
+	}{
+		{
+			name: "compensated steps are kept without being performed again",
+			steps: []OrderStep{
+				{StepName: "Scheduling", StepRollbacked: true},
+				{StepName: "Pre-Processing", StepRollbacked: true},
+				{StepName: "Processing", StepRollbacked: true},
+			},
+			kept: []string{"Scheduling", "Pre-Processing"},
+		},
+		{
+			name: "steps not rolled back are kept",
+			steps: []OrderStep{
+				{StepName: "Scheduling"},
+				{StepName: "Pre-Processing"},
+				{StepName: "Processing", StepRollbacked: true},
+			},
+			kept: []string{"Scheduling", "Pre-Processing"},
+		},
+		{
+			name:  "failed at the initial step",
+			steps: []OrderStep{{StepName: "Scheduling", StepRollbacked: true}},
+		},
+	}
+
+	for _, c := range cases {
+		database := db.NewMemoryDatabase()
+		failed := newFailedOrder(t, database, c.steps)
+
+		attempt, err := Retry(database, failed.OrderID, "service", UserActor("user"), true, time.Time{})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if attempt.CurrentStep != failed.FailureStep {
+			t.Errorf("%s: current step [%s], want [%s]", c.name, attempt.CurrentStep, failed.FailureStep)
+		}
+		names := stepNames(attempt.Steps)
+		if len(names) != len(c.kept)+1 {
+			t.Fatalf("%s: steps %v, want %v", c.name, names, c.kept)
+		}
+		for index, step := range attempt.Steps[:len(c.kept)] {
+			original := failed.Steps[index]
+			if step.StepName != c.kept[index] || step.StepCompleted != original.StepCompleted || step.StepRollbacked != original.StepRollbacked {
+				t.Errorf("%s: step %d is %+v, want %+v", c.name, index, step, failed.Steps[index])
+			}
+		}
+		if last := attempt.Steps[len(c.kept)]; last.StepCompleted || last.StepRollbacked {
+			t.Errorf("%s: resumed step is %+v", c.name, last)
+		}
+	}
+}
+
+func TestRetryRestart(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	failed := newFailedOrder(t, database, []OrderStep{{StepName: "Scheduling"}, {StepName: "Pre-Processing"}})
+
+	attempt, err := Retry(database, failed.OrderID, "service", UserActor("user"), false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.CurrentStep != "Scheduling" || len(attempt.Steps) != 1 {
+		t.Errorf("attempt starts at %v", stepNames(attempt.Steps))
+	}
+	if attempt.OriginalOrderID != failed.OrderID || attempt.RetryOf != failed.OrderID || attempt.Attempt != 2 {
+		t.Errorf("attempt is not linked %+v", attempt)
+	}
+
+	failed, err = Get(database, failed.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.RetriedBy != attempt.OrderID {
+		t.Errorf("failed order is retried by [%s], want [%s]", failed.RetriedBy, attempt.OrderID)
+	}
+	if _, err = Retry(database, failed.OrderID, "service", UserActor("user"), false, time.Time{}); err != ErrOrderRetried {
+		t.Errorf("retry again got [%v]", err)
+	}
+}
+
+func TestRetryCrash(t *testing.T) {
+	database := &faultyDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+	failed := newFailedOrder(t, database.MemoryDatabase, []OrderStep{{StepName: "Scheduling"}, {StepName: "Pre-Processing"}})
+	before := dump(t, database)
+
+	// The failed order is linked only along with the attempt created
+	database.failAt = 1
+	if _, err := Retry(database, failed.OrderID, "service", UserActor("user"), true, time.Time{}); err != errCrash {
+		t.Fatalf("retry got [%v]", err)
+	}
+	if after := dump(t, database); !reflect.DeepEqual(before, after) {
+		t.Errorf("crashed retry left\nbefore %v\nafter  %v", before, after)
+	}
+
+	database.failAt = 0
+	attempt, err := Retry(database, failed.OrderID, "service", UserActor("user"), true, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := attempt.GetOrderStateInService("service"); state != OSS_Active.String() {
+		t.Errorf("attempt is [%s] in service", state)
+	}
+}
+
+func TestRetryNotFailed(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	record, err := New(database, map[string]interface{}{"user_id": "user", "service_id": "service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Retry(database, record.OrderID, "service", UserActor("user"), false, time.Time{}); err != ErrOrderNotFailed {
+		t.Errorf("retry got [%v]", err)
+	}
+}
@@ -0,0 +1,201 @@
+package order
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"order_process/process/db"
+	"order_process/process/model/workflow"
+)
+
+// The schema version of the order records written by current service
+const (
+	CurrentSchemaVersion = 3
+)
+
+// The migration which upgrades the stored record map by one schema version
+type Migration func(record map[string]interface{}) error
+
+// The migrations keyed by the schema version they upgrade from
+var migrations = map[int]Migration{
+	0: migrateToVersion1,
+	1: migrateToVersion2,
+	2: migrateToVersion3,
+}
+
+// Register the migration upgrading records from specified schema version
+func RegisterMigration(fromVersion int, migration Migration) {
+	migrations[fromVersion] = migration
+}
+
+// Get the schema version of stored record map, 0 if not versioned
+func schemaVersion(record map[string]interface{}) int {
+	switch version := record["schema_version"].(type) {
+	case float64:
+		return int(version)
+	case int:
+		return version
+	}
+	return 0
+}
+
+// Upgrade the stored record map to current schema version
+func migrate(record map[string]interface{}) error {
+	version := schemaVersion(record)
+	if version > CurrentSchemaVersion {
+		return fmt.Errorf("Unsupported schema version [%d] of order [%v]", version, record["order_id"])
+	}
+
+	for ; version < CurrentSchemaVersion; version++ {
+		migration, found := migrations[version]
+		if !found {
+			return fmt.Errorf("No migration from schema version [%d]", version)
+		}
+		if err := migration(record); err != nil {
+			return err
+		}
+		record["schema_version"] = version + 1
+	}
+	return nil
+}
+
+// Parse the stored json of order record, upgrading it to current schema version
+func parseOrderRecord(database db.IDatabase, data []byte) (*OrderRecord, error) {
+	t := make(map[string]interface{})
+	err := json.Unmarshal(data, &t)
+	if err != nil {
+		return nil, err
+	}
+	if err = migrate(t); err != nil {
+		return nil, err
+	}
+	return generateOrderRecord(database, t)
+}
+
+// Rewrite all the stored orders in the current schema version, and add them to the indexes they are missing from.
+// Returns the count of rewritten or indexed orders.
+func MigrateAll(database db.IDatabase) (int, error) {
+	hash, err := db.QueryHash(database, OrderTableName)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for orderId, data := range hash {
+		t := make(map[string]interface{})
+		if err = json.Unmarshal([]byte(data), &t); err != nil {
+			return migrated, err
+		}
+		record, err := parseOrderRecord(database, []byte(data))
+		if err != nil {
+			return migrated, err
+		}
+		mutations, err := record.missingIndexMutations()
+		if err != nil {
+			return migrated, err
+		}
+		if schemaVersion(t) != CurrentSchemaVersion {
+			str, err := record.ToJson()
+			if err != nil {
+				return migrated, err
+			}
+			mutations = append(mutations, db.Mutation{Key: OrderTableName, HashKey: orderId, Value: str})
+		}
+		if len(mutations) == 0 {
+			continue
+		}
+
+		// Skip the order updated during migration, which is saved in current schema version with its indexes
+		err = database.Transact(
+			[]db.Condition{
+				{Key: OrderTableName, HashKey: orderId, Value: data},
+				{
+					Key:     OrderVersionTable,
+					HashKey: orderId,
+					Value:   strconv.FormatInt(record.Version, 10),
+					Absent:  record.Version == 0,
+				},
+			},
+			mutations)
+		if err == db.ErrConditionFailed {
+			continue
+		}
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// Upgrade the records written before schema version was introduced,
+// the optional fields may be absent in them.
+func migrateToVersion1(record map[string]interface{}) error {
+	setDefault := func(fields map[string]interface{}, key string, value interface{}) {
+		if _, found := fields[key]; !found {
+			fields[key] = value
+		}
+	}
+
+	setDefault(record, "finished", false)
+	setDefault(record, "failure_occured", false)
+	setDefault(record, "rollback_state", UnTriggerred.String())
+	if record["finished"] == true {
+		setDefault(record, "complete_time", "")
+	}
+
+	if steps, ok := record["steps"].([]interface{}); ok {
+		for _, step := range steps {
+			if stepMap, ok := step.(map[string]interface{}); ok {
+				setDefault(stepMap, "step_completed", false)
+				setDefault(stepMap, "step_rollbacked", false)
+			}
+		}
+	}
+	return nil
+}
+
+// Upgrade the timestamps written by time.Time.String() to RFC 3339
+func migrateToVersion2(record map[string]interface{}) error {
+	convert := func(fields map[string]interface{}, key string) error {
+		str, ok := fields[key].(string)
+		if !ok || str == "" {
+			return nil
+		}
+		t, err := ParseTime(str)
+		if err != nil {
+			return err
+		}
+		fields[key] = FormatTime(t)
+		return nil
+	}
+
+	if err := convert(record, "start_time"); err != nil {
+		return err
+	}
+	if err := convert(record, "complete_time"); err != nil {
+		return err
+	}
+	if steps, ok := record["steps"].([]interface{}); ok {
+		for _, step := range steps {
+			if stepMap, ok := step.(map[string]interface{}); ok {
+				if err := convert(stepMap, "step_start_time"); err != nil {
+					return err
+				}
+				if err := convert(stepMap, "step_complete_time"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Record the workflow of the records written before workflows were introduced
+func migrateToVersion3(record map[string]interface{}) error {
+	if workflowName, _ := record["workflow"].(string); workflowName == "" {
+		record["workflow"] = workflow.StandardWorkflow
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package order
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/model/workflow"
+	"order_process/process/util"
+)
+
+func TestMigrateAllBackfillsIndexes(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	legacy := newOrder(t, database)
+	indexed := newOrder(t, database)
+
+	// The order saved before the indexes and schema versions were introduced
+	keys, err := database.Keys(OrderIndexTable + ":")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutations := []db.Mutation{{Key: OrderVersionTable, HashKey: legacy.OrderID, Delete: true}}
+	for _, key := range keys {
+		mutations = append(mutations, db.Mutation{Key: key, HashKey: legacy.OrderID, Delete: true})
+	}
+	recordMap := *legacy.ToMap()
+	delete(recordMap, "schema_version")
+	delete(recordMap, "version")
+	data, _ := json.Marshal(recordMap)
+	mutations = append(mutations, db.Mutation{Key: OrderTableName, HashKey: legacy.OrderID, Value: string(data)})
+	if err = database.Transact(nil, mutations); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := Find(database, &OrderFilter{UserID: "user"}); len(found) != 1 {
+		t.Fatalf("%d orders found before migration", len(found))
+	}
+
+	count, err := MigrateAll(database)
+	if err != nil || count != 1 {
+		t.Fatalf("migrated %d orders [%v]", count, err)
+	}
+	filter := &OrderFilter{UserID: "user", CurrentStep: legacy.CurrentStep, Status: OS_Processing.String(),
+		StartFrom: legacy.StartTime, StartTo: indexed.StartTime.Add(1)}
+	found, err := Find(database, filter)
+	if err != nil || len(found) != 2 {
+		t.Fatalf("find after migration got %v [%v]", found, err)
+	}
+	for _, record := range found {
+		if record.OrderID == legacy.OrderID && record.Version != 0 {
+			t.Errorf("version of migrated order is [%d]", record.Version)
+		}
+	}
+
+	// The migrated order is upgraded and indexed once
+	hash, err := db.QueryHash(database, OrderTableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated := make(map[string]interface{})
+	json.Unmarshal([]byte(hash[legacy.OrderID]), &migrated)
+	if schemaVersion(migrated) != CurrentSchemaVersion {
+		t.Errorf("schema version of migrated order is [%v]", migrated["schema_version"])
+	}
+	if count, err = MigrateAll(database); err != nil || count != 0 {
+		t.Errorf("migrated %d orders again [%v]", count, err)
+	}
+}
+
+func TestMigrateVersion0Record(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	orderId := util.NewUUID()
+
+	// The finished order written before schema versions were introduced, with the timestamps written by
+	// time.Time.String(), neither the rollback flags of steps nor the workflow of order are recorded
+	data := `{
+		"order_id": "` + orderId + `",
+		"current_step": "Completed",
+		"start_time": "2016-03-27 10:22:31.4492618 +0000 UTC",
+		"complete_time": "2016-03-27 18:22:51.4504397 +0800 CST m=+20.001",
+		"user_id": "user",
+		"service_id": "service",
+		"finished": true,
+		"steps": [
+			{"step_name": "Scheduling", "step_start_time": "2016-03-27 10:22:31.4492618 +0000 UTC",
+				"step_complete_time": "2016-03-27T10:22:36.4500059Z", "step_completed": true},
+			{"step_name": "Completed", "step_start_time": "2016-03-27T10:22:51.4504397Z",
+				"step_complete_time": "2016-03-27T10:22:51.4504397Z", "step_completed": true, "step_rollbacked": false}
+		]
+	}`
+	if err := database.Write(data, OrderTableName, orderId); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := Get(database, orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := time.Date(2016, 3, 27, 10, 22, 31, 449261800, time.UTC)
+	completeTime := time.Date(2016, 3, 27, 10, 22, 51, 450439700, time.UTC)
+	if !record.StartTime.Equal(startTime) || !record.CompleteTime.Equal(completeTime) {
+		t.Errorf("times are [%v] [%v]", record.StartTime, record.CompleteTime)
+	}
+	if !record.Finished || record.FailureOccured || record.RollbackState != UnTriggerred.String() ||
+		record.Workflow != workflow.StandardWorkflow || record.Priority != OP_Normal.String() || record.Attempt != 1 {
+		t.Errorf("migrated order is %+v", record)
+	}
+	if len(record.Steps) != 2 || !record.Steps[0].StartTime.Equal(startTime) || record.Steps[0].StepRollbacked ||
+		!record.Steps[0].StepCompleted {
+		t.Errorf("migrated steps are %+v", record.Steps)
+	}
+
+	// The order is rewritten in current schema version, which reads the same
+	if count, err := MigrateAll(database); err != nil || count != 1 {
+		t.Fatalf("migrated %d orders [%v]", count, err)
+	}
+	hash, err := db.QueryHash(database, OrderTableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated := make(map[string]interface{})
+	json.Unmarshal([]byte(hash[orderId]), &migrated)
+	if schemaVersion(migrated) != CurrentSchemaVersion || migrated["start_time"] != FormatTime(startTime) {
+		t.Errorf("rewritten order is %v", migrated)
+	}
+	rewritten, err := Get(database, orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rewritten.ToMap(), record.ToMap()) {
+		t.Errorf("rewritten order %v differs from %v", rewritten.ToMap(), record.ToMap())
+	}
+}
+
+func TestParseMalformedRecord(t *testing.T) {
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"schema_version":  CurrentSchemaVersion,
+			"order_id":        util.NewUUID(),
+			"current_step":    "Scheduling",
+			"start_time":      "2016-03-27T10:22:31.4492618Z",
+			"user_id":         "user",
+			"service_id":      "service",
+			"finished":        false,
+			"failure_occured": false,
+			"rollback_state":  UnTriggerred.String(),
+			"steps": []interface{}{map[string]interface{}{
+				"step_name": "Scheduling", "step_start_time": "2016-03-27T10:22:31.4492618Z",
+				"step_completed": false, "step_rollbacked": false,
+			}},
+		}
+	}
+	malformed := map[string]func(record map[string]interface{}){
+		"user_id":         func(record map[string]interface{}) { record["user_id"] = 1 },
+		"finished":        func(record map[string]interface{}) { record["finished"] = "no" },
+		"failure_occured": func(record map[string]interface{}) { delete(record, "failure_occured") },
+		"rollback_state":  func(record map[string]interface{}) { record["rollback_state"] = false },
+		"steps":           func(record map[string]interface{}) { record["steps"] = "Scheduling" },
+		"step":            func(record map[string]interface{}) { record["steps"] = []interface{}{"Scheduling"} },
+		"step_name": func(record map[string]interface{}) {
+			delete(record["steps"].([]interface{})[0].(map[string]interface{}), "step_name")
+		},
+		"step_completed": func(record map[string]interface{}) {
+			record["steps"].([]interface{})[0].(map[string]interface{})["step_completed"] = nil
+		},
+	}
+
+	if _, err := generateOrderRecord(nil, valid()); err != nil {
+		t.Fatalf("valid record got [%v]", err)
+	}
+	for name, corrupt := range malformed {
+		record := valid()
+		corrupt(record)
+		data, _ := json.Marshal(record)
+		if _, err := parseOrderRecord(nil, data); err == nil {
+			t.Errorf("record of malformed %s is parsed", name)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package order
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"order_process/process/db"
+)
+
+// The error injected as if the service crashed before the operation
+var errCrash = errors.New("Crash injected")
+
+// The in-memory database which fails the writes from the failAt-th one, 0 means never.
+// The interleave function is called once before the next transaction, to save the orders by others.
+type faultyDatabase struct {
+	*db.MemoryDatabase
+	failAt     int
+	writes     int
+	interleave func()
+}
+
+func (this *faultyDatabase) Write(stmt string, args ...interface{}) error {
+	this.writes++
+	if this.failAt > 0 && this.writes >= this.failAt {
+		return errCrash
+	}
+	return this.MemoryDatabase.Write(stmt, args...)
+}
+
+func (this *faultyDatabase) Transact(conditions []db.Condition, mutations []db.Mutation) error {
+	this.writes++
+	if this.failAt > 0 && this.writes >= this.failAt {
+		return errCrash
+	}
+	if interleave := this.interleave; interleave != nil {
+		this.interleave = nil
+		interleave()
+	}
+	return this.MemoryDatabase.Transact(conditions, mutations)
+}
+
+// Dump all the hashes of database
+func dump(t *testing.T, database db.IDatabase) map[string]map[string]string {
+	keys, err := database.Keys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[string]map[string]string)
+	for _, key := range keys {
+		if hashes[key], err = db.QueryHash(database, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return hashes
+}
+
+// Create the order with line items in the faulty database which never fails
+func newOrderWithItems(t *testing.T, database *faultyDatabase, items int) *OrderRecord {
+	payload := &OrderPayload{}
+	for index := 0; index < items; index++ {
+		payload.LineItems = append(payload.LineItems, LineItem{SKU: "A-100", Quantity: 1, UnitPrice: "1.00"})
+	}
+	record, err := New(database.MemoryDatabase, map[string]interface{}{
+		"user_id":    "user",
+		"service_id": "service",
+		"payload":    payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.database = database
+	return record
+}
+
+func TestSplitLeavesNothingOnCrash(t *testing.T) {
+	database := &faultyDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+	record := newOrderWithItems(t, database, 3)
+	before := dump(t, database)
+
+	database.failAt = database.writes + 1
+	if _, _, err := Split(database, record.OrderID, "service", "user", [][]int{{0, 1}, {2}}); err != errCrash {
+		t.Fatalf("split got [%v]", err)
+	}
+	if after := dump(t, database); !reflect.DeepEqual(before, after) {
+		t.Errorf("partial split survived\nbefore %v\nafter  %v", before, after)
+	}
+
+	database.failAt = 0
+	parent, children, err := Split(database, record.OrderID, "service", "user", [][]int{{0, 1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || len(parent.ChildIDs) != 2 {
+		t.Errorf("split into %d children", len(children))
+	}
+}
+
+func TestMergeLeavesNothingOnCrash(t *testing.T) {
+	database := &faultyDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+	first := newOrderWithItems(t, database, 1)
+	second := newOrderWithItems(t, database, 1)
+	before := dump(t, database)
+
+	database.failAt = database.writes + 1
+	if _, err := Merge(database, "service", "user", []string{first.OrderID, second.OrderID}); err != errCrash {
+		t.Fatalf("merge got [%v]", err)
+	}
+	if after := dump(t, database); !reflect.DeepEqual(before, after) {
+		t.Errorf("partial merge survived\nbefore %v\nafter  %v", before, after)
+	}
+}
+
+func TestSaveRecordsConflict(t *testing.T) {
+	database := &faultyDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+	first := newOrderWithItems(t, database, 1)
+	second := newOrderWithItems(t, database, 1)
+	firstVersion, secondVersion := first.Version, second.Version
+
+	// The second order is saved by others between loading and saving
+	var expected map[string]map[string]string
+	database.interleave = func() {
+		other, err := Get(database.MemoryDatabase, second.OrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Priority = OP_High.String()
+		if err = other.SaveToDB(OSS_Active.String()); err != nil {
+			t.Fatal(err)
+		}
+		expected = dump(t, database)
+	}
+
+	first.Priority = OP_Low.String()
+	first.AddEvent(OrderEvent{Type: ET_Amended.String(), Actor: UserActor("user")})
+	second.Priority = OP_Low.String()
+	err := saveRecords([]*OrderRecord{first, second}, nil, []db.Mutation{{Key: "Extra", HashKey: "field", Value: "value"}})
+	conflict, ok := err.(*VersionConflictError)
+	if !ok || conflict.OrderID != first.OrderID {
+		t.Fatalf("save got [%v]", err)
+	}
+	if first.Version != firstVersion || second.Version != secondVersion {
+		t.Errorf("versions are not restored [%d] [%d]", first.Version, second.Version)
+	}
+	if after := dump(t, database); !reflect.DeepEqual(expected, after) {
+		t.Errorf("partial save survived\nexpected %v\nafter    %v", expected, after)
+	}
+
+	// The order saved by others wins
+	saved, err := Get(database, second.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Priority != OP_High.String() {
+		t.Errorf("priority is [%s]", saved.Priority)
+	}
+}
+
+func TestMergeRetriesOnConflict(t *testing.T) {
+	database := &faultyDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+	first := newOrderWithItems(t, database, 1)
+	second := newOrderWithItems(t, database, 1)
+
+	// The owner of the second order saves it during the first attempt
+	database.interleave = func() {
+		other, err := Get(database.MemoryDatabase, second.OrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Steps[0].StepCompleted = true
+		if err = other.SaveToDB(OSS_Active.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parent, err := Merge(database, "service", "user", []string{first.OrderID, second.OrderID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the parent of the successful attempt is saved
+	orders, err := db.QueryHash(database, OrderTableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 3 {
+		t.Errorf("%d orders saved", len(orders))
+	}
+	merged, err := Get(database, second.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.ParentID != parent.OrderID || !merged.Steps[0].StepCompleted {
+		t.Errorf("merged order is %+v", merged)
+	}
+}
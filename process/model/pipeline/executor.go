@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"order_process/process/model/workflow"
+	"order_process/process/util"
+)
+
+// The interface of executor performing one step of orders
+type IStepExecutor interface {
+	// Perform the step of job, the step succeeds if nil is returned, otherwise the order fails with the error.
+	// The result, such as the reference of shipment, is recorded on the step when it succeeds.
+	// The context is done when the deadline of order or the budget of step is exceeded.
+	Execute(ctx context.Context, job IJob) (string, error)
+
+	// Revoke the step performed for job when the order fails, the compensation is retried until nil is returned.
+	// The context is done when the budget of step is exceeded.
+	Compensate(ctx context.Context, job IJob) error
+}
+
+// The executors registered per step name
+var (
+	stepExecutors     = map[string]IStepExecutor{}
+	stepExecutorsLock sync.RWMutex
+)
+
+// The executor of the steps without registered executor, nil unless the simulation of steps is enabled for demos
+var DefaultStepExecutor IStepExecutor
+
+// Register the executor performing the step of all the workflows, which replaces the previous one
+func RegisterStepExecutor(stepName string, executor IStepExecutor) {
+	defer stepExecutorsLock.Unlock()
+	stepExecutorsLock.Lock()
+	stepExecutors[stepName] = executor
+}
+
+// Get the executor performing the step, the default one if not registered.
+// Fails if neither the executor of step nor the default one is registered.
+func GetStepExecutor(stepName string) (IStepExecutor, error) {
+	defer stepExecutorsLock.RUnlock()
+	stepExecutorsLock.RLock()
+	if executor, found := stepExecutors[stepName]; found {
+		return executor, nil
+	}
+	if DefaultStepExecutor != nil {
+		return DefaultStepExecutor, nil
+	}
+	return nil, fmt.Errorf("No executor is registered for step [%s]", stepName)
+}
+
+// Verify that every step performed by the workflows has its executor
+func VerifyStepExecutors() error {
+	for _, stepName := range workflow.ProcessingStepNames() {
+		if _, err := GetStepExecutor(stepName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The definition of the executor simulating the processing of step for demos
+type SimulatedExecutor struct {
+	// The time taken by the step
+	Duration time.Duration
+	// Whether the step fails at random
+	RandomFailure bool
+}
+
+// The constructor of the executor simulating the processing of step
+func NewSimulatedExecutor(duration time.Duration, randomFailure bool) *SimulatedExecutor {
+	return &SimulatedExecutor{
+		Duration:      duration,
+		RandomFailure: randomFailure,
+	}
+}
+
+// Take the duration of step, which is interrupted when the context is done.
+// The step fails at 5% ratio if random failure is enabled.
+func (this *SimulatedExecutor) Execute(ctx context.Context, job IJob) (string, error) {
+	select {
+	case <-time.After(this.Duration):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	if this.RandomFailure && util.IsEventWithSpecifiedRatioHappens() {
+		return "", errors.New("Random failure")
+	}
+	return "", nil
+}
+
+// Nothing to revoke for the simulated step
+func (this *SimulatedExecutor) Compensate(ctx context.Context, job IJob) error {
+	return nil
+}
+
+// Perform the step of job by executor, the panic of executor fails the step
+func executeStep(executor IStepExecutor, ctx context.Context, job IJob) (result string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Step executor panicked [%v]", r)
+		}
+	}()
+	return executor.Execute(ctx, job)
+}
+
+// Revoke the step of job by executor, the panic of executor fails the compensation
+func compensateStep(executor IStepExecutor, ctx context.Context, job IJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Step executor panicked [%v]", r)
+		}
+	}()
+	return executor.Compensate(ctx, job)
+}
@@ -0,0 +1,300 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/model/order"
+)
+
+// The pipeline recording the dispatched jobs
+type dispatchingPipeline struct {
+	lock       sync.Mutex
+	dispatched []string
+	later      []time.Duration
+}
+
+func (this *dispatchingPipeline) Start()                                 {}
+func (this *dispatchingPipeline) AppendJob(job IJob)                     {}
+func (this *dispatchingPipeline) QueueDepths() map[string]map[string]int { return nil }
+func (this *dispatchingPipeline) Stop()                                  {}
+
+func (this *dispatchingPipeline) DispatchTask(jobId string) {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+	this.dispatched = append(this.dispatched, jobId)
+}
+
+func (this *dispatchingPipeline) DispatchTaskLater(job IJob, wait time.Duration) {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+	this.later = append(this.later, wait)
+}
+
+// The executor returning the specified result and errors, the executions and the deadlines of compensations are recorded
+type scriptedExecutor struct {
+	result        string
+	executeErr    error
+	compensateErr error
+	executions    int
+	deadlines     []time.Time
+}
+
+func (this *scriptedExecutor) Execute(ctx context.Context, job IJob) (string, error) {
+	this.executions++
+	return this.result, this.executeErr
+}
+
+func (this *scriptedExecutor) Compensate(ctx context.Context, job IJob) error {
+	deadline, _ := ctx.Deadline()
+	this.deadlines = append(this.deadlines, deadline)
+	return this.compensateErr
+}
+
+// Register the executor of step until the test is finished
+func registerExecutor(t *testing.T, stepName string, executor IStepExecutor) {
+	RegisterStepExecutor(stepName, executor)
+	t.Cleanup(func() {
+		defer stepExecutorsLock.Unlock()
+		stepExecutorsLock.Lock()
+		delete(stepExecutors, stepName)
+	})
+}
+
+// Handle the step of job by the task handler of step
+func handleStep(pipeline IPipeline, stepName string, job IJob) error {
+	handler := NewStepTaskHandler(stepName, pipeline).(*ProcessStepTaskHandler)
+	handler.CurentStepTask = job
+	return handler.HandleCurrentTask()
+}
+
+// Handle the steps of job in the order dispatched by pipeline until it is finished
+func runJob(t *testing.T, job *ProcessJob) {
+	router, _ := newRecordingPipeline()
+	for index := 0; index < 20; index++ {
+		if state, err := job.GetJobStateInService(job.GetServiceID()); err != nil || state != order.OSS_Active.String() {
+			return
+		}
+		if job.IsJobInFinishingStep() && !job.IsJobRollbacking() {
+			if err := job.FinalizeJob(); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		step, err := router.GetNextStep(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleStep(&dispatchingPipeline{}, step, job)
+	}
+	t.Fatalf("job is not finished %s", job.ToJson())
+}
+
+func TestExecuteStepResult(t *testing.T) {
+	registerExecutor(t, "Scheduling", &scriptedExecutor{result: "shipment-1"})
+	database := db.NewMemoryDatabase()
+	job := newJob(t, database)
+
+	if err := handleStep(&dispatchingPipeline{}, "Scheduling", job); err != nil {
+		t.Fatal(err)
+	}
+	record, err := order.Get(database, job.GetJobID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := record.Steps[len(record.Steps)-1]
+	if step.StepName != "Scheduling" || !step.StepCompleted || step.StepResult != "shipment-1" {
+		t.Errorf("step is %+v", step)
+	}
+	if record.ToMap() == nil || (*record.ToMap())["steps"].([]map[string]interface{})[0]["step_result"] != "shipment-1" {
+		t.Errorf("step result is not serialized")
+	}
+}
+
+func TestExecuteStepFailure(t *testing.T) {
+	registerExecutor(t, "Scheduling", &scriptedExecutor{result: "partial", executeErr: errors.New("Out of stock")})
+	job := newJob(t, db.NewMemoryDatabase())
+
+	if err := handleStep(&dispatchingPipeline{}, "Scheduling", job); err == nil || err.Error() != "Out of stock" {
+		t.Fatalf("handle step got [%v]", err)
+	}
+	if !job.IsErrorOccured() || !job.IsJobRollbacking() || job.IsCurrentStepCompleted() {
+		t.Errorf("failed job is %s", job.ToJson())
+	}
+	if result := job.record.Steps[len(job.record.Steps)-1].StepResult; result != "" {
+		t.Errorf("result [%s] of failed step is recorded", result)
+	}
+}
+
+func TestCompensateStep(t *testing.T) {
+	budget := StepBudgets["Scheduling"]
+	StepBudgets["Scheduling"] = time.Minute
+	defer func() { StepBudgets["Scheduling"] = budget }()
+
+	executor := &scriptedExecutor{executeErr: errors.New("Out of stock"), compensateErr: errors.New("Warehouse unreachable")}
+	registerExecutor(t, "Scheduling", executor)
+	job := newJob(t, db.NewMemoryDatabase())
+	pipeline := &dispatchingPipeline{}
+	handleStep(pipeline, "Scheduling", job)
+
+	// The failed compensation is retried later, the step is not rolled back
+	start := time.Now()
+	if err := handleStep(pipeline, "Scheduling", job); err != executor.compensateErr {
+		t.Fatalf("rollback got [%v]", err)
+	}
+	if len(pipeline.later) != 1 || pipeline.later[0] != time.Second*CompensateRetryInterval {
+		t.Errorf("compensation retried after %v", pipeline.later)
+	}
+	if !job.IsJobRollbacking() {
+		t.Errorf("step is rolled back by failed compensation")
+	}
+
+	executor.compensateErr = nil
+	if err := handleStep(pipeline, "Scheduling", job); err != nil {
+		t.Fatalf("rollback got [%v]", err)
+	}
+	if job.IsJobRollbacking() || !job.record.Steps[len(job.record.Steps)-1].StepRollbacked {
+		t.Errorf("step is not rolled back %s", job.ToJson())
+	}
+
+	// The compensation is bounded by the budget of step
+	for _, deadline := range executor.deadlines {
+		if deadline.Before(start) || deadline.After(time.Now().Add(time.Minute)) {
+			t.Errorf("compensation deadline is %v", deadline)
+		}
+	}
+	if len(executor.deadlines) != 2 {
+		t.Errorf("%d compensations performed", len(executor.deadlines))
+	}
+}
+
+func TestRetryResumesFailedStep(t *testing.T) {
+	executors := map[string]*scriptedExecutor{}
+	for _, step := range []string{"Scheduling", "Pre-Processing", "Processing", "Post-Processing"} {
+		executors[step] = &scriptedExecutor{}
+		registerExecutor(t, step, executors[step])
+	}
+	executors["Processing"].executeErr = errors.New("Machine broken")
+	database := db.NewMemoryDatabase()
+	job := newJob(t, database)
+
+	// The failed order is rolled back
+	runJob(t, job)
+	failed, err := order.Get(database, job.GetJobID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failed.Finished || !failed.FailureOccured || failed.FailureStep != "Processing" {
+		t.Fatalf("failed order is %+v", failed)
+	}
+	for _, step := range []string{"Scheduling", "Pre-Processing", "Processing"} {
+		if len(executors[step].deadlines) != 1 {
+			t.Errorf("step [%s] is compensated %d times", step, len(executors[step].deadlines))
+		}
+	}
+
+	// The attempt resumes from the failed step
+	executors["Processing"].executeErr = nil
+	attempt, err := order.Retry(database, failed.OrderID, "service", order.UserActor("user"), true, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.CurrentStep != "Processing" {
+		t.Fatalf("attempt starts at [%s]", attempt.CurrentStep)
+	}
+	runJob(t, NewProcessJob(attempt))
+	completed, err := order.Get(database, attempt.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !completed.Finished || completed.FailureOccured || completed.CurrentStep != "Completed" {
+		t.Errorf("attempt is %+v", completed)
+	}
+	for step, executions := range map[string]int{"Scheduling": 1, "Pre-Processing": 1, "Processing": 2, "Post-Processing": 1} {
+		if executors[step].executions != executions {
+			t.Errorf("step [%s] is performed %d times, want %d", step, executors[step].executions, executions)
+		}
+	}
+}
+
+func TestCompensationGivenUp(t *testing.T) {
+	executor := &scriptedExecutor{executeErr: errors.New("Out of stock"), compensateErr: errors.New("Warehouse unreachable")}
+	registerExecutor(t, "Scheduling", executor)
+	database := db.NewMemoryDatabase()
+	job := newJob(t, database)
+	pipeline := &dispatchingPipeline{}
+	handleStep(pipeline, "Scheduling", job)
+
+	// The failed compensation is retried later until the attempts run out
+	for attempt := 1; attempt < MaxCompensateAttempts; attempt++ {
+		if err := handleStep(pipeline, "Scheduling", job); err != executor.compensateErr {
+			t.Fatalf("rollback attempt %d got [%v]", attempt, err)
+		}
+	}
+	if len(pipeline.later) != MaxCompensateAttempts-1 || !job.IsJobRollbacking() {
+		t.Fatalf("compensation retried %d times", len(pipeline.later))
+	}
+	record, err := order.Get(database, job.GetJobID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts := record.Steps[len(record.Steps)-1].CompensateAttempts; attempts != MaxCompensateAttempts-1 {
+		t.Errorf("%d failed attempts are saved", attempts)
+	}
+
+	// The last attempt gives up the step, which is left not rolled back
+	if err = handleStep(pipeline, "Scheduling", job); err != nil {
+		t.Fatalf("last rollback attempt got [%v]", err)
+	}
+	if len(pipeline.later) != MaxCompensateAttempts-1 || job.IsJobRollbacking() {
+		t.Errorf("compensation is not given up %s", job.ToJson())
+	}
+	step := job.record.Steps[len(job.record.Steps)-1]
+	if !step.CompensateFailed || step.StepRollbacked {
+		t.Errorf("step is %+v", step)
+	}
+	events, _, err := order.GetEvents(database, job.GetJobID(), "", order.MaxEventsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := events[len(events)-1]
+	if last.Type != order.ET_CompensateFailed.String() || last.Step != "Scheduling" || last.Message != executor.compensateErr.Error() {
+		t.Errorf("last event is %+v", last)
+	}
+
+	// The order fails without compensating the step any more
+	runJob(t, job)
+	if record, err = order.Get(database, job.GetJobID()); err != nil {
+		t.Fatal(err)
+	}
+	if !record.Finished || !record.FailureOccured || len(executor.deadlines) != MaxCompensateAttempts {
+		t.Errorf("order is %s after %d compensations", job.ToJson(), len(executor.deadlines))
+	}
+}
+
+func TestMissingStepExecutor(t *testing.T) {
+	defaultExecutor := DefaultStepExecutor
+	DefaultStepExecutor = nil
+	defer func() { DefaultStepExecutor = defaultExecutor }()
+
+	if err := VerifyStepExecutors(); err == nil {
+		t.Errorf("steps without executor are verified")
+	}
+	job := newJob(t, db.NewMemoryDatabase())
+	if err := handleStep(&dispatchingPipeline{}, "Scheduling", job); err == nil {
+		t.Errorf("step without executor succeeded")
+	}
+	if !job.IsErrorOccured() || job.record.FailureMessage != "No executor is registered for step [Scheduling]" {
+		t.Errorf("job is %s", job.ToJson())
+	}
+
+	// The simulated steps are performed only if enabled
+	DefaultStepExecutor = NewSimulatedExecutor(0, false)
+	if err := VerifyStepExecutors(); err != nil {
+		t.Errorf("simulated steps got [%v]", err)
+	}
+}
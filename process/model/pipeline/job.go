@@ -3,7 +3,10 @@ package pipeline
 import (
 	"errors"
 	"order_process/process/model/order"
+	"order_process/process/model/workflow"
 	"time"
+
+	"github.com/Sirupsen/logrus"
 )
 
 // The job interface
@@ -15,34 +18,65 @@ type IJob interface {
 	GetServiceID() string
 	SetServiceID(string)
 
+	// Priority
+	GetPriority() order.OrderPriority
+
+	// Workflow
+	GetWorkflow() *workflow.Workflow
+
 	// Step status
 	GetCurrentStep() string
 	IsCurrentStepCompleted() bool
 
 	// Step
 	StartStep(stepName string) error
+	SetStepResult(result string)
 	FinishCurrentStep() error
 
 	// Job status
 	IsJobInFinishingStep() bool
 	IsJobFinished() bool
 
+	// Delay
+	IsJobDelayed() bool
+	GetNotBefore() time.Time
+
+	// Deadline
+	GetStepDeadline() time.Time
+	CheckDeadline() error
+
 	// state in service
 	GetJobStateInService(serviceID string) (string, error)
 
 	// Failure
 	IsErrorOccured() bool
-	MarkJobAsFailure()
+	MarkJobAsFailure(reason order.FailureReason, message string)
+
+	// Cancellation
+	IsJobCancelled() bool
+
+	// Family
+	IsJobParent() bool
+	IsJobChild() bool
+	FollowChildren() error
+	CheckParent() (bool, error)
 
 	// Rollback
 	StartRollback()
 	IsJobRollbacking() bool
 	GetRollbackStep() (string, error)
 	RollbackStep(stepName string) error
+	FailCompensation(stepName string, maxAttempts int, message string) (bool, error)
+
+	// Recompute and check the totals of order
+	VerifyTotals() error
 
 	// Save to database
 	UpdateDatabase() error
 
+	// Reload from database
+	Refresh() error
+
 	// Finalize
 	FinalizeJob() error
 
@@ -77,6 +111,16 @@ func (this *ProcessJob) GetServiceID() string {
 	return this.ServiceId
 }
 
+// Get the priority of order
+func (this *ProcessJob) GetPriority() order.OrderPriority {
+	return this.record.GetPriority()
+}
+
+// Get the workflow of order, nil if not defined
+func (this *ProcessJob) GetWorkflow() *workflow.Workflow {
+	return this.record.GetWorkflow()
+}
+
 // Get current order step
 func (this *ProcessJob) GetCurrentStep() string {
 	return this.record.CurrentStep
@@ -92,9 +136,30 @@ func (this *ProcessJob) IsJobFinished() bool {
 	return this.record.Finished
 }
 
-// Check whether order is in final step("Completed" or "Failed")
+// Check whether order is in the success or failure step of its workflow
 func (this *ProcessJob) IsJobInFinishingStep() bool {
-	return this.record.CurrentStep == Completed.String() || this.record.CurrentStep == Failed.String()
+	return this.GetWorkflow().IsTerminal(this.record.CurrentStep)
+}
+
+// Check whether the job is waiting to be started
+func (this *ProcessJob) IsJobDelayed() bool {
+	delayedStep := this.GetWorkflow().DelayedStep
+	return delayedStep != "" && this.record.CurrentStep == delayedStep && !this.IsCurrentStepCompleted() && !this.IsErrorOccured()
+}
+
+// Get the time when the job can be started
+func (this *ProcessJob) GetNotBefore() time.Time {
+	return this.record.NotBefore
+}
+
+// Get the time by which current step must be finished, zero time if unbounded
+func (this *ProcessJob) GetStepDeadline() time.Time {
+	return this.record.StepDeadline(StepBudgets[this.record.CurrentStep])
+}
+
+// Check whether the deadline of order or the budget of current step is exceeded
+func (this *ProcessJob) CheckDeadline() error {
+	return this.record.CheckDeadline(StepBudgets[this.record.CurrentStep])
 }
 
 // To map format
@@ -124,31 +189,49 @@ func (this *ProcessJob) StartStep(stepName string) error {
 
 	orderStep := order.OrderStep{
 		StepName:  stepName,
-		StartTime: time.Now().UTC().String(),
+		StartTime: time.Now().UTC(),
 	}
 	this.record.CurrentStep = orderStep.StepName
 	this.record.Steps = append(this.record.Steps, orderStep)
+	this.record.AddEvent(order.OrderEvent{Type: order.ET_StepStarted.String(), Step: stepName})
 
 	return this.UpdateDatabase()
 }
 
+// Record the result of current step, which is saved when the step is finished
+func (this *ProcessJob) SetStepResult(result string) {
+	this.record.Steps[len(this.record.Steps)-1].StepResult = result
+}
+
 //Finish the Current Step
 func (this *ProcessJob) FinishCurrentStep() error {
 	step := &this.record.Steps[len(this.record.Steps)-1]
 	step.StepCompleted = true
-	step.CompleteTime = time.Now().UTC().String()
+	step.CompleteTime = time.Now().UTC()
+	this.record.AddEvent(order.OrderEvent{Type: order.ET_StepFinished.String(), Step: step.StepName})
 
 	if this.IsJobInFinishingStep() && !this.IsJobRollbacking() {
 		this.record.CompleteTime = step.CompleteTime
 		this.record.Finished = true
 	}
-	return this.UpdateDatabase()
+	err := this.UpdateDatabase()
+	if err == nil && !this.IsJobParent() {
+		// The steps of parent follow its children, which are not measured
+		for _, progressStep := range this.GetWorkflow().ProcessingSteps() {
+			if progressStep == step.StepName {
+				if e := this.record.RecordStepDuration(*step); e != nil {
+					logrus.Errorf("[%s]Record duration of step [%s] failed [%v]", this.JobId, step.StepName, e)
+				}
+			}
+		}
+	}
+	return err
 }
 
 // Finalize job
 func (this *ProcessJob) FinalizeJob() error {
 	if this.IsJobInFinishingStep() && !this.IsJobRollbacking() {
-		this.record.CompleteTime = time.Now().UTC().String()
+		this.record.CompleteTime = time.Now().UTC()
 		this.record.Finished = true
 
 		return this.UpdateDatabase()
@@ -161,9 +244,112 @@ func (this *ProcessJob) IsErrorOccured() bool {
 	return this.record.FailureOccured
 }
 
-// Mark the job as failure if error occurs
-func (this *ProcessJob) MarkJobAsFailure() {
+// Mark the job as failure with reason if error occurs
+func (this *ProcessJob) MarkJobAsFailure(reason order.FailureReason, message string) {
+	if !this.record.FailureOccured {
+		// The step which the retry of order resumes from
+		this.record.FailureStep = this.record.CurrentStep
+	}
 	this.record.FailureOccured = true
+	this.record.FailureReason = reason.String()
+	this.record.FailureMessage = message
+	this.record.AddEvent(order.OrderEvent{
+		Type:    order.ET_StepFailed.String(),
+		Step:    this.record.CurrentStep,
+		Reason:  reason.String(),
+		Message: message,
+	})
+}
+
+// Check whether the order is cancelled by customer
+func (this *ProcessJob) IsJobCancelled() bool {
+	return this.record.Cancelled
+}
+
+// Check whether the job is the parent following its children
+func (this *ProcessJob) IsJobParent() bool {
+	return this.record.IsParent()
+}
+
+// Check whether the job is the child of other order
+func (this *ProcessJob) IsJobChild() bool {
+	return this.record.ParentID != ""
+}
+
+// Follow the least advanced step of the children, the parent enters the success step when all the children
+// have finished the last step before it, and finishes when all of them are completed.
+// The parent fails if it is cancelled or any child fails.
+func (this *ProcessJob) FollowChildren() error {
+	// Catch the cancellation of parent
+	if err := this.Refresh(); err != nil {
+		return err
+	}
+	if this.IsJobCancelled() {
+		this.MarkJobAsFailure(order.FR_Cancelled, order.ErrOrderCancelled.Error())
+		this.StartRollback()
+		return nil
+	}
+
+	children, err := this.record.GetChildren()
+	if err != nil {
+		return err
+	}
+	orderWorkflow := this.GetWorkflow()
+	least, leastCompleted := orderWorkflow.SuccessStep, true
+	for _, child := range children {
+		if child.FailureOccured {
+			err := &order.FamilyError{OrderID: this.JobId, MemberID: child.OrderID}
+			this.MarkJobAsFailure(order.FailureReasonOf(err), err.Error())
+			this.StartRollback()
+			return nil
+		}
+		step := child.CurrentStep
+		completed := child.Steps[len(child.Steps)-1].StepCompleted
+		if orderWorkflow.Before(step, least) {
+			least, leastCompleted = step, completed
+		} else if step == least {
+			leastCompleted = leastCompleted && completed
+		}
+	}
+
+	current := this.GetCurrentStep()
+	if current == orderWorkflow.SuccessStep {
+		if least == orderWorkflow.SuccessStep && leastCompleted {
+			return this.FinishCurrentStep()
+		}
+		return nil
+	}
+	if orderWorkflow.IsLastStep(least) && leastCompleted {
+		// Release the children to be completed
+		least, leastCompleted = orderWorkflow.SuccessStep, false
+	}
+	if orderWorkflow.Before(current, least) {
+		if !this.IsCurrentStepCompleted() {
+			if err = this.FinishCurrentStep(); err != nil {
+				return err
+			}
+		}
+		if err = this.StartStep(least); err != nil {
+			return err
+		}
+	}
+	if least == this.GetCurrentStep() && leastCompleted && !this.IsCurrentStepCompleted() {
+		return this.FinishCurrentStep()
+	}
+	return nil
+}
+
+// Check whether the child is released to be completed by its parent,
+// *order.FamilyError is returned if the parent has failed.
+func (this *ProcessJob) CheckParent() (bool, error) {
+	parent, err := this.record.GetParent()
+	if err != nil {
+		return false, err
+	}
+	if parent.FailureOccured {
+		return false, &order.FamilyError{OrderID: this.JobId, MemberID: parent.OrderID}
+	}
+	return parent.CurrentStep == this.GetWorkflow().SuccessStep, nil
 }
 
 // Trigger the rollback process
@@ -174,29 +360,28 @@ func (this *ProcessJob) StartRollback() {
 // Check whether job is rollbacking.
 func (this *ProcessJob) IsJobRollbacking() bool {
 	if this.record.RollbackState == order.Triggerred.String() {
-		index := len(this.record.Steps) - 1
-		for ; index >= 0; index-- {
-			if this.record.Steps[index].StepName != Completed.String() &&
-				this.record.Steps[index].StepName != Failed.String() &&
-				!this.record.Steps[index].StepRollbacked {
-				break
-			}
-		}
-		return index >= 0
+		return this.rollbackIndex() >= 0
 	}
 	return false
 }
 
-// Get the step which needs rollback
-func (this *ProcessJob) GetRollbackStep() (string, error) {
+// Get the index of the latest step which is compensatable in workflow and not rolled back, -1 if none.
+// The step whose compensation is given up is not rolled back any more.
+func (this *ProcessJob) rollbackIndex() int {
+	orderWorkflow := this.GetWorkflow()
 	index := len(this.record.Steps) - 1
 	for ; index >= 0; index-- {
-		if this.record.Steps[index].StepName != Completed.String() &&
-			this.record.Steps[index].StepName != Failed.String() &&
-			!this.record.Steps[index].StepRollbacked {
+		if orderWorkflow.IsCompensatable(this.record.Steps[index].StepName) &&
+			!this.record.Steps[index].StepRollbacked && !this.record.Steps[index].CompensateFailed {
 			break
 		}
 	}
+	return index
+}
+
+// Get the step which needs rollback
+func (this *ProcessJob) GetRollbackStep() (string, error) {
+	index := this.rollbackIndex()
 	if index >= 0 {
 		return this.record.Steps[index].StepName, nil
 	} else {
@@ -211,19 +396,61 @@ func (this *ProcessJob) RollbackStep(stepName string) error {
 		if this.record.Steps[index].StepName == stepName &&
 			!this.record.Steps[index].StepRollbacked {
 			this.record.Steps[index].StepRollbacked = true
+			this.record.AddEvent(order.OrderEvent{Type: order.ET_StepRolledBack.String(), Step: stepName})
 			break
 		}
 	}
 	return this.UpdateDatabase()
 }
 
+// Record the failed compensation of specified step, the compensation is given up once the attempts reach
+// maxAttempts, then the rollback goes on with the previous steps. Returns whether the compensation is given up.
+func (this *ProcessJob) FailCompensation(stepName string, maxAttempts int, message string) (bool, error) {
+	index := this.rollbackIndex()
+	if index < 0 || this.record.Steps[index].StepName != stepName {
+		return false, errors.New("Step is not being rolled back")
+	}
+	step := &this.record.Steps[index]
+	step.CompensateAttempts++
+	if step.CompensateAttempts >= maxAttempts {
+		step.CompensateFailed = true
+		this.record.AddEvent(order.OrderEvent{Type: order.ET_CompensateFailed.String(), Step: stepName, Message: message})
+	}
+	giveUp := step.CompensateFailed
+	return giveUp, this.UpdateDatabase()
+}
+
+// Recompute and check the totals of order
+func (this *ProcessJob) VerifyTotals() error {
+	return this.record.VerifyTotals()
+}
+
 // Update current job data to database
 func (this *ProcessJob) UpdateDatabase() error {
 	orderStateInService := order.OSS_Active.String()
 	if this.IsJobFinished() && !this.IsJobRollbacking() {
 		orderStateInService = order.OSS_Completed.String()
 	}
-	return this.record.SaveToDB(orderStateInService)
+	err := this.record.SaveToDB(orderStateInService)
+	if _, ok := err.(*order.VersionConflictError); ok {
+		// The order is saved by others, discard local changes
+		logrus.Debugf("[%s]Reload job on conflict [%v]", this.JobId, err)
+		if e := this.Refresh(); e != nil {
+			logrus.Errorf("[%s]Reload job failed [%v]", this.JobId, e)
+		}
+	}
+	return err
+}
+
+// Reload the latest saved order data from database
+func (this *ProcessJob) Refresh() error {
+	record, err := this.record.Reload()
+	if err != nil {
+		return err
+	}
+	record.ServiceID = this.ServiceId
+	this.record = record
+	return nil
 }
 
 func (this *ProcessJob) GetJobStateInService(serviceID string) (string, error) {
@@ -1,6 +1,7 @@
 package pipeline
 
 import (
+	"order_process/process/db"
 	"order_process/process/model/order"
 	"order_process/process/model/transfer"
 )
@@ -13,6 +14,9 @@ type IPipelineManager interface {
 	// Dispatch orders
 	DispatchOrder(orderRecord *order.OrderRecord)
 
+	// The count of pending tasks per step and priority of all pipelines
+	QueueDepths() map[string]map[string]int
+
 	// Stop the pipeline manager
 	Stop()
 }
@@ -22,15 +26,17 @@ type ProcessPipelineManager struct {
 	pipelines                 []IPipeline
 	lastPipelineSelectedIndex int
 	serviceID                 string
+	database                  db.IDatabase
 }
 
 // The constructor of Order Process Pipeline Manager
-func NewProcessPipelineManager(serviceID string, MaxPipelineCount int,
+func NewProcessPipelineManager(database db.IDatabase, serviceID string, MaxPipelineCount int,
 	NewPipeline func(func(string, IPipeline) ITaskHandler) IPipeline,
 	NewTaskHandler func(string, IPipeline) ITaskHandler) *ProcessPipelineManager {
 	pipelineManager := ProcessPipelineManager{
 		serviceID:                 serviceID,
 		lastPipelineSelectedIndex: -1,
+		database:                  database,
 	}
 	for i := 0; i < MaxPipelineCount; i++ {
 		pipelineManager.pipelines = append(pipelineManager.pipelines, NewPipeline(NewTaskHandler))
@@ -48,7 +54,7 @@ func (this *ProcessPipelineManager) Start() error {
 	fn := func(orderRecord *order.OrderRecord) {
 		this.DispatchOrder(orderRecord)
 	}
-	return transfer.Reload(this.serviceID, this.serviceID, fn)
+	return transfer.Reload(this.database, this.serviceID, this.serviceID, fn)
 }
 
 // Dispatch order assigned to pipeline manager
@@ -57,6 +63,22 @@ func (this *ProcessPipelineManager) DispatchOrder(orderRecord *order.OrderRecord
 	this.SelectPipeline().AppendJob(processJob)
 }
 
+// Get the count of pending tasks per step and priority of all pipelines
+func (this *ProcessPipelineManager) QueueDepths() map[string]map[string]int {
+	depths := make(map[string]map[string]int)
+	for _, pipeline := range this.pipelines {
+		for step, stepDepths := range pipeline.QueueDepths() {
+			if depths[step] == nil {
+				depths[step] = make(map[string]int)
+			}
+			for priority, depth := range stepDepths {
+				depths[step][priority] += depth
+			}
+		}
+	}
+	return depths
+}
+
 // Stop the pipeline management and pipelines
 func (this *ProcessPipelineManager) Stop() {
 	for _, pipeline := range this.pipelines {
@@ -64,7 +86,8 @@ func (this *ProcessPipelineManager) Stop() {
 	}
 }
 
-// Round Robin Select pipeline
+// Round Robin Select pipeline, regardless of the priority of order,
+// which orders the tasks within the selected pipeline only
 func (this *ProcessPipelineManager) SelectPipeline() IPipeline {
 	if this.lastPipelineSelectedIndex+1 < len(this.pipelines) {
 		this.lastPipelineSelectedIndex++
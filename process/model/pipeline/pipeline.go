@@ -3,9 +3,11 @@ package pipeline
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"order_process/process/model/order"
+	"order_process/process/model/workflow"
 )
 
 // The inteface of pipeline for Order Processing Service
@@ -16,83 +18,23 @@ type IPipeline interface {
 	AppendJob(job IJob)
 	// Dispatch task to next step
 	DispatchTask(jobId string)
+	// Dispatch task of the job after the wait, unless the job is removed or replaced meanwhile
+	DispatchTaskLater(job IJob, wait time.Duration)
+	// The count of pending tasks per step and priority
+	QueueDepths() map[string]map[string]int
 	// Stop the pipeline
 	Stop()
 }
 
-type ProcessStep int
-
-const (
-	Scheduling ProcessStep = iota
-	PreProcessing
-	Processing
-	PostProcessing
-	Completed
-	Failed
-	Unknown
-)
-
-var ProcessSteps = []ProcessStep{
-	Scheduling,
-	PreProcessing,
-	Processing,
-	PostProcessing,
-	Completed,
-	Failed,
-}
-
-var ProcessStepNames = map[ProcessStep]string{
-	Scheduling:     "Scheduling",
-	PreProcessing:  "Pre-Processing",
-	Processing:     "Processing",
-	PostProcessing: "Post-Processing",
-	Completed:      "Completed",
-	Failed:         "Failed",
-}
-
-func (s ProcessStep) String() string {
-	return ProcessStepNames[s]
-}
-
-func ParseProcessStep(step string) ProcessStep {
-	if step == Scheduling.String() {
-		return Scheduling
-	} else if step == PreProcessing.String() {
-		return PreProcessing
-	} else if step == Processing.String() {
-		return Processing
-	} else if step == PostProcessing.String() {
-		return PostProcessing
-	} else if step == Completed.String() {
-		return Completed
-	} else if step == Failed.String() {
-		return Failed
-	} else {
-		logrus.Error("Parse ProcessStep failed")
-		return Unknown
-	}
-}
-
-var StepsSwitchMap = map[ProcessStep][]ProcessStep{
-	Scheduling:     {Scheduling, PreProcessing, Failed},
-	PreProcessing:  {PreProcessing, Processing, Failed},
-	Processing:     {Processing, PostProcessing, Failed},
-	PostProcessing: {PostProcessing, Completed, Failed},
-	Completed:      {Completed},
-	Failed:         {Failed},
-}
-
-var StepsSwitchNextMap = map[ProcessStep][]ProcessStep{
-	Scheduling:     {PreProcessing, Failed},
-	PreProcessing:  {Processing, Failed},
-	Processing:     {PostProcessing, Failed},
-	PostProcessing: {Completed, Failed},
-	Completed:      {Completed},
-	Failed:         {Failed},
-}
+// The time budgets of steps, the step exceeding its budget fails with timeout
+var StepBudgets = map[string]time.Duration{}
 
 const (
 	MaxProcessJobsCountPerPipeline = 10000
+	// The delayed job is refreshed at the interval to catch the cancellation
+	DelayCheckInterval = 60 // in seconds
+	// The family of orders is checked at the interval
+	FamilyCheckInterval = 5 // in seconds
 )
 
 // The definition of Order Processing Pipeline
@@ -102,14 +44,14 @@ type ProcessPipeline struct {
 	lock         sync.Mutex
 }
 
-// The constructor of pipeline for Order Processing Service
+// The constructor of pipeline for Order Processing Service, which handles the steps of all the loaded workflows
 func NewProcessPipeline(NewTaskHandler func(string, IPipeline) ITaskHandler) IPipeline {
 	pipeline := ProcessPipeline{
 		Jobs:         make(map[string]IJob),
 		TaskHandlers: make(map[string]ITaskHandler),
 	}
-	for _, step := range ProcessSteps {
-		pipeline.TaskHandlers[step.String()] = NewTaskHandler(step.String(), &pipeline)
+	for _, step := range workflow.StepNames() {
+		pipeline.TaskHandlers[step] = NewTaskHandler(step, &pipeline)
 	}
 	return &pipeline
 }
@@ -123,16 +65,10 @@ func (this *ProcessPipeline) Start() {
 
 // Append process job to pipeline
 func (this *ProcessPipeline) AppendJob(job IJob) {
-	if _, found := this.Jobs[job.GetJobID()]; found {
+	if !this.addJob(job) {
 		logrus.Errorf("ProcessJob existed:[%v]", job.GetJobID())
 		return
 	}
-	{
-		defer this.lock.Unlock()
-		this.lock.Lock()
-		// Insert job
-		this.Jobs[job.GetJobID()] = job
-	}
 	// Schedule the job immediately
 	logrus.Debugf("Scheduling the job [%v]", job.GetJobID())
 	this.DispatchTask(job.GetJobID())
@@ -140,7 +76,12 @@ func (this *ProcessPipeline) AppendJob(job IJob) {
 
 // Dispatch the task to next task handler
 func (this *ProcessPipeline) DispatchTask(jobId string) {
-	job := this.Jobs[jobId]
+	job := this.getJob(jobId)
+	if job == nil {
+		// The job has been finished or removed
+		logrus.Debugf("[%s]Job not found for dispatching", jobId)
+		return
+	}
 
 	state, e := job.GetJobStateInService(job.GetServiceID())
 	if e == nil && state != order.OSS_Active.String() {
@@ -148,12 +89,68 @@ func (this *ProcessPipeline) DispatchTask(jobId string) {
 		return
 	}
 
+	orderWorkflow := job.GetWorkflow()
+	if orderWorkflow == nil {
+		// Leave the order active, it is resumed once its workflow is defined again
+		logrus.Errorf("[%s]%v", jobId, order.ErrWorkflowUndefined)
+		this.removeJob(jobId)
+		return
+	}
+
+	if job.IsJobParent() && !job.IsJobFinished() && !job.IsErrorOccured() {
+		// The parent follows its children instead of processing the steps
+		err := job.FollowChildren()
+		if err != nil {
+			logrus.Errorf("[%s]Follow children failed [%v]", jobId, err)
+		}
+		if err != nil || !job.IsJobFinished() && !job.IsErrorOccured() {
+			this.checkFamilyLater(job)
+			return
+		}
+	}
+
 	if job.IsJobInFinishingStep() && !job.IsJobRollbacking() {
 		this.FinishJob(jobId, order.OSS_Active.String())
 		return
 	}
 
-	nextStep, err := this.GetNextStep(jobId)
+	if job.IsJobChild() && !job.IsErrorOccured() {
+		released, err := job.CheckParent()
+		if _, ok := err.(*order.FamilyError); ok {
+			// Fail with the family, the rollback is triggered as other failures
+			job.MarkJobAsFailure(order.FailureReasonOf(err), err.Error())
+			job.StartRollback()
+		} else if err != nil {
+			logrus.Errorf("[%s]Check parent failed [%v]", jobId, err)
+			this.checkFamilyLater(job)
+			return
+		} else if !released && orderWorkflow.IsLastStep(job.GetCurrentStep()) && job.IsCurrentStepCompleted() {
+			// Wait for the siblings before being completed
+			this.checkFamilyLater(job)
+			return
+		}
+	}
+
+	if job.IsJobDelayed() {
+		if err := job.Refresh(); err != nil {
+			logrus.Errorf("[%s]Refresh delayed job failed [%v]", jobId, err)
+		}
+
+		// Wait until due unless cancelled, the order may time out before due
+		due := job.GetNotBefore()
+		if deadline := job.GetStepDeadline(); !deadline.IsZero() && deadline.Before(due) {
+			due = deadline
+		}
+		if wait := due.Sub(time.Now()); wait > 0 && !job.IsJobCancelled() {
+			if wait > time.Second*DelayCheckInterval {
+				wait = time.Second * DelayCheckInterval
+			}
+			this.DispatchTaskLater(job, wait)
+			return
+		}
+	}
+
+	nextStep, err := this.GetNextStep(job)
 	if err != nil {
 		logrus.Errorf("[%s]DispatchStepTask,current step: [%s], error:[%v]",
 			job.GetJobID(), job.GetCurrentStep(), err)
@@ -166,10 +163,22 @@ func (this *ProcessPipeline) DispatchTask(jobId string) {
 	this.TaskHandlers[nextStep].AppendTask(job)
 }
 
-// Get next processing step
-func (this *ProcessPipeline) GetNextStep(jobId string) (string, error) {
-	job := this.Jobs[jobId]
+// Dispatch the task of the job in family after the check interval, unless the job is finished meanwhile
+func (this *ProcessPipeline) checkFamilyLater(job IJob) {
+	this.DispatchTaskLater(job, time.Second*FamilyCheckInterval)
+}
 
+// Dispatch task of the job after the wait, the job removed or replaced by a reloaded one meanwhile is skipped
+func (this *ProcessPipeline) DispatchTaskLater(job IJob, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		if this.getJob(job.GetJobID()) == job {
+			this.DispatchTask(job.GetJobID())
+		}
+	})
+}
+
+// Get next processing step
+func (this *ProcessPipeline) GetNextStep(job IJob) (string, error) {
 	if !job.IsCurrentStepCompleted() && !job.IsErrorOccured() {
 		return job.GetCurrentStep(), nil
 	}
@@ -182,15 +191,12 @@ func (this *ProcessPipeline) GetNextStep(jobId string) (string, error) {
 		return nextRollbackStep, nil
 	}
 
-	if nextSteps, found := StepsSwitchNextMap[ParseProcessStep(job.GetCurrentStep())]; found {
-		if !job.IsJobInFinishingStep() {
-			if !job.IsErrorOccured() {
-				return nextSteps[0].String(), nil
-			} else {
-				return nextSteps[1].String(), nil
-			}
+	orderWorkflow := job.GetWorkflow()
+	if orderWorkflow.HasStep(job.GetCurrentStep()) {
+		if !job.IsJobInFinishingStep() && job.IsErrorOccured() {
+			return orderWorkflow.FailureStep, nil
 		}
-		return nextSteps[0].String(), nil
+		return orderWorkflow.NextStep(job.GetCurrentStep()), nil
 	}
 
 	return "", errors.New("cannot find next step")
@@ -199,16 +205,45 @@ func (this *ProcessPipeline) GetNextStep(jobId string) (string, error) {
 // Finalize the order if no more process is needed.
 func (this *ProcessPipeline) FinishJob(jobId string, stateInService string) {
 	logrus.Debugf("[%s]Finish Order", jobId)
-	if stateInService == order.OSS_Active.String() {
-		this.Jobs[jobId].FinalizeJob()
+	if job := this.getJob(jobId); job != nil && stateInService == order.OSS_Active.String() {
+		job.FinalizeJob()
 	}
 	logrus.Debugln()
-	{
-		defer this.lock.Unlock()
-		this.lock.Lock()
-		// Remove job from cached mapping
-		delete(this.Jobs, jobId)
+	this.removeJob(jobId)
+}
+
+// Insert job into cached mapping, false if the job existed
+func (this *ProcessPipeline) addJob(job IJob) bool {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+	if _, found := this.Jobs[job.GetJobID()]; found {
+		return false
 	}
+	this.Jobs[job.GetJobID()] = job
+	return true
+}
+
+// Get the job from cached mapping, nil if not found
+func (this *ProcessPipeline) getJob(jobId string) IJob {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+	return this.Jobs[jobId]
+}
+
+// Remove job from cached mapping
+func (this *ProcessPipeline) removeJob(jobId string) {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+	delete(this.Jobs, jobId)
+}
+
+// Get the count of pending tasks per step and priority
+func (this *ProcessPipeline) QueueDepths() map[string]map[string]int {
+	depths := make(map[string]map[string]int)
+	for step, handler := range this.TaskHandlers {
+		depths[step] = handler.QueueDepths()
+	}
+	return depths
 }
 
 // Stop the pipeline
@@ -218,12 +253,10 @@ func (this *ProcessPipeline) Stop() {
 	}
 }
 
-// Verify whether the step switch is valid
-func VerifyStepSwitch(previousStep string, currentStep string) error {
-	for _, step := range StepsSwitchMap[ParseProcessStep(previousStep)] {
-		if step.String() == currentStep {
-			return nil
-		}
+// Verify whether the step switch is valid in workflow
+func VerifyStepSwitch(orderWorkflow *workflow.Workflow, previousStep string, currentStep string) error {
+	if orderWorkflow.CanSwitch(previousStep, currentStep) {
+		return nil
 	}
 	return errors.New("Step switch verification failed")
 }
@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/model/order"
+)
+
+// The task handler recording the tasks appended instead of performing them
+type recordingHandler struct {
+	lock  sync.Mutex
+	tasks []IJob
+}
+
+func (this *recordingHandler) AppendTask(job IJob) error {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+	this.tasks = append(this.tasks, job)
+	return nil
+}
+
+func (this *recordingHandler) PerformTasks()               {}
+func (this *recordingHandler) Rollback() error             { return nil }
+func (this *recordingHandler) QueueDepths() map[string]int { return nil }
+func (this *recordingHandler) Stop()                       {}
+
+// The count of tasks appended
+func (this *recordingHandler) count() int {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+	return len(this.tasks)
+}
+
+// Create the pipeline whose steps are recorded by the handlers
+func newRecordingPipeline() (*ProcessPipeline, map[string]*recordingHandler) {
+	handlers := map[string]*recordingHandler{}
+	pipeline := NewProcessPipeline(func(step string, pipeline IPipeline) ITaskHandler {
+		handlers[step] = &recordingHandler{}
+		return handlers[step]
+	})
+	return pipeline.(*ProcessPipeline), handlers
+}
+
+// Create the job of new order in service
+func newJob(t *testing.T, database db.IDatabase) *ProcessJob {
+	record, err := order.New(database, map[string]interface{}{"user_id": "user", "service_id": "service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProcessJob(record)
+}
+
+func TestDispatchRemovedJob(t *testing.T) {
+	pipeline, handlers := newRecordingPipeline()
+	job := newJob(t, db.NewMemoryDatabase())
+	pipeline.AppendJob(job)
+	if handlers["Scheduling"].count() != 1 {
+		t.Fatalf("%d tasks scheduled", handlers["Scheduling"].count())
+	}
+
+	// The timers of the job fire after it is finished
+	pipeline.removeJob(job.GetJobID())
+	pipeline.DispatchTask(job.GetJobID())
+	if handlers["Scheduling"].count() != 1 {
+		t.Errorf("removed job is dispatched")
+	}
+}
+
+func TestDispatchLaterSkipsReplacedJob(t *testing.T) {
+	pipeline, handlers := newRecordingPipeline()
+	database := db.NewMemoryDatabase()
+	job := newJob(t, database)
+	pipeline.AppendJob(job)
+
+	// The job is reloaded before the timer fires
+	pipeline.DispatchTaskLater(job, 10*time.Millisecond)
+	pipeline.removeJob(job.GetJobID())
+	record, err := order.Get(database, job.GetJobID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewProcessJob(record)
+	pipeline.AppendJob(reloaded)
+	pipeline.DispatchTaskLater(reloaded, 10*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	if handlers["Scheduling"].count() != 3 {
+		t.Errorf("%d tasks scheduled", handlers["Scheduling"].count())
+	}
+	for _, task := range handlers["Scheduling"].tasks[1:] {
+		if task != reloaded {
+			t.Errorf("replaced job is dispatched")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"order_process/process/model/order"
+)
+
+const (
+	// The task waiting longer than the seconds is served regardless of its priority
+	MaxTaskWaitTime = 120
+)
+
+// The definition of the task waiting in queue
+type pendingTask struct {
+	job         IJob
+	enqueueTime time.Time
+}
+
+// The priority-aware queue of pending tasks.
+// The tasks of higher priority are served first and the tasks of same priority are served in order,
+// except that the task starving longer than MaxTaskWaitTime is served first to avoid starvation.
+// Each step of pipeline has its own queue, so the priority orders the tasks within one pipeline only,
+// the urgent task does not overtake the tasks queued in other pipelines.
+type TaskQueue struct {
+	queues   [][]pendingTask
+	count    int
+	capacity int
+	closed   bool
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+}
+
+// The constructor of task queue
+func NewTaskQueue(capacity int) *TaskQueue {
+	queue := TaskQueue{
+		queues:   make([][]pendingTask, len(order.OrderPriorities)),
+		capacity: capacity,
+	}
+	queue.notEmpty = sync.NewCond(&queue.lock)
+	queue.notFull = sync.NewCond(&queue.lock)
+	return &queue
+}
+
+// Push the task of job, it blocks if the queue is full
+func (this *TaskQueue) Push(job IJob) error {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+
+	for this.count >= this.capacity && !this.closed {
+		this.notFull.Wait()
+	}
+	if this.closed {
+		return errors.New("The task queue has been closed.")
+	}
+
+	priority := job.GetPriority()
+	this.queues[priority] = append(this.queues[priority], pendingTask{job: job, enqueueTime: time.Now()})
+	this.count++
+	this.notEmpty.Signal()
+	return nil
+}
+
+// Pop the next task to serve, it blocks if the queue is empty.
+// false is returned if the queue has been closed.
+func (this *TaskQueue) Pop() (IJob, bool) {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+
+	for this.count == 0 && !this.closed {
+		this.notEmpty.Wait()
+	}
+	if this.closed {
+		return nil, false
+	}
+
+	// The starving task which waited longest goes first
+	selected := -1
+	deadline := time.Now().Add(-time.Second * MaxTaskWaitTime)
+	for priority, tasks := range this.queues {
+		if len(tasks) > 0 && tasks[0].enqueueTime.Before(deadline) &&
+			(selected < 0 || tasks[0].enqueueTime.Before(this.queues[selected][0].enqueueTime)) {
+			selected = priority
+		}
+	}
+	// Otherwise the highest priority goes first
+	for priority := len(this.queues) - 1; selected < 0 && priority >= 0; priority-- {
+		if len(this.queues[priority]) > 0 {
+			selected = priority
+		}
+	}
+
+	task := this.queues[selected][0]
+	this.queues[selected][0] = pendingTask{}
+	this.queues[selected] = this.queues[selected][1:]
+	this.count--
+	this.notFull.Signal()
+	return task.job, true
+}
+
+// Get the count of pending tasks per priority
+func (this *TaskQueue) Depths() map[string]int {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+
+	depths := make(map[string]int)
+	for _, priority := range order.OrderPriorities {
+		depths[priority.String()] = len(this.queues[priority])
+	}
+	return depths
+}
+
+// Close the queue, the blocked callers are waked up
+func (this *TaskQueue) Close() {
+	defer this.lock.Unlock()
+	this.lock.Lock()
+
+	this.closed = true
+	this.notEmpty.Broadcast()
+	this.notFull.Broadcast()
+}
@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"order_process/process/db"
+	"order_process/process/model/order"
+)
+
+// Create the job of order with the priority
+func newPriorityJob(t *testing.T, database db.IDatabase, priority order.OrderPriority) *ProcessJob {
+	job := newJob(t, database)
+	job.record.Priority = priority.String()
+	return job
+}
+
+// Pop the jobs of queue, which should not block
+func popJobs(t *testing.T, queue *TaskQueue, count int) []string {
+	jobIds := []string{}
+	for index := 0; index < count; index++ {
+		job, ok := queue.Pop()
+		if !ok {
+			t.Fatalf("pop from closed queue")
+		}
+		jobIds = append(jobIds, job.GetJobID())
+	}
+	return jobIds
+}
+
+func TestTaskQueuePriority(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	queue := NewTaskQueue(10)
+	jobs := []*ProcessJob{
+		newPriorityJob(t, database, order.OP_Low),
+		newPriorityJob(t, database, order.OP_Normal),
+		newPriorityJob(t, database, order.OP_Urgent),
+		newPriorityJob(t, database, order.OP_Normal),
+		newPriorityJob(t, database, order.OP_High),
+	}
+	for _, job := range jobs {
+		if err := queue.Push(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depths := queue.Depths(); depths[order.OP_Normal.String()] != 2 || depths[order.OP_Low.String()] != 1 {
+		t.Errorf("depths are %v", depths)
+	}
+
+	// The higher priority goes first, the same priority in order
+	expected := []string{jobs[2].GetJobID(), jobs[4].GetJobID(), jobs[1].GetJobID(), jobs[3].GetJobID(), jobs[0].GetJobID()}
+	if popped := popJobs(t, queue, len(jobs)); !reflect.DeepEqual(popped, expected) {
+		t.Errorf("popped %v, expected %v", popped, expected)
+	}
+}
+
+func TestTaskQueueStarvation(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	queue := NewTaskQueue(10)
+	low := newPriorityJob(t, database, order.OP_Low)
+	normal := newPriorityJob(t, database, order.OP_Normal)
+	urgent := newPriorityJob(t, database, order.OP_Urgent)
+	for _, job := range []*ProcessJob{low, normal, urgent} {
+		if err := queue.Push(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both the low and the normal ones are starving, the one waited longest goes first
+	queue.queues[order.OP_Normal][0].enqueueTime = time.Now().Add(-time.Second * (MaxTaskWaitTime + 1))
+	queue.queues[order.OP_Low][0].enqueueTime = time.Now().Add(-time.Second * (MaxTaskWaitTime + 2))
+	expected := []string{low.GetJobID(), normal.GetJobID(), urgent.GetJobID()}
+	if popped := popJobs(t, queue, 3); !reflect.DeepEqual(popped, expected) {
+		t.Errorf("popped %v, expected %v", popped, expected)
+	}
+}
+
+func TestTaskQueueCapacity(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	queue := NewTaskQueue(1)
+	first, second := newJob(t, database), newJob(t, database)
+	if err := queue.Push(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The push blocks until the queue is not full
+	pushed := make(chan error)
+	go func() {
+		pushed <- queue.Push(second)
+	}()
+	select {
+	case err := <-pushed:
+		t.Fatalf("push into full queue returned [%v]", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if popped := popJobs(t, queue, 1); popped[0] != first.GetJobID() {
+		t.Errorf("popped %v", popped)
+	}
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Errorf("push got [%v]", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("push is not waked up")
+	}
+	if popped := popJobs(t, queue, 1); popped[0] != second.GetJobID() {
+		t.Errorf("popped %v", popped)
+	}
+}
+
+func TestTaskQueueClose(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	queue := NewTaskQueue(1)
+
+	// The blocked pop is waked up by close
+	popped := make(chan bool)
+	go func() {
+		_, ok := queue.Pop()
+		popped <- ok
+	}()
+	time.Sleep(50 * time.Millisecond)
+	queue.Close()
+	select {
+	case ok := <-popped:
+		if ok {
+			t.Errorf("pop from closed queue succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("pop is not waked up")
+	}
+
+	if err := queue.Push(newJob(t, database)); err == nil {
+		t.Errorf("push into closed queue succeeded")
+	}
+	if _, ok := queue.Pop(); ok {
+		t.Errorf("pop from closed queue succeeded")
+	}
+}
@@ -1,8 +1,9 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
-	"order_process/process/util"
+	"order_process/process/model/order"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -19,6 +20,9 @@ type ITaskHandler interface {
 	// Rollback current task if failure
 	Rollback() error
 
+	// The count of pending tasks per priority
+	QueueDepths() map[string]int
+
 	// Stop the task handler
 	Stop()
 }
@@ -26,7 +30,7 @@ type ITaskHandler interface {
 // The dedicated step task handler
 type ProcessStepTaskHandler struct {
 	StepTaskType   string
-	PendingTasks   chan IJob
+	PendingTasks   *TaskQueue
 	CurentStepTask IJob
 	PipeLine       IPipeline
 	stopped        bool
@@ -35,13 +39,19 @@ type ProcessStepTaskHandler struct {
 const (
 	MaxPendingTasksCount = 10000
 	StepProcessTime      = 5 //seconds
+	// The failed compensation of step is retried at the interval
+	CompensateRetryInterval = 10 // in seconds
+	// The compensation of step is given up after the failed attempts, the step should be revoked manually
+	MaxCompensateAttempts = 30
+	// The time budget of compensation for the step without budget
+	DefaultCompensateBudget = 60 // in seconds
 )
 
 // The constructor of task handler for Order Step Processing
 func NewStepTaskHandler(stepTaskType string, pipeLine IPipeline) ITaskHandler {
 	return &ProcessStepTaskHandler{
 		StepTaskType: stepTaskType,
-		PendingTasks: make(chan IJob, MaxPendingTasksCount),
+		PendingTasks: NewTaskQueue(MaxPendingTasksCount),
 		PipeLine:     pipeLine,
 		stopped:      false,
 	}
@@ -50,15 +60,19 @@ func NewStepTaskHandler(stepTaskType string, pipeLine IPipeline) ITaskHandler {
 // Append task to pending list
 func (this *ProcessStepTaskHandler) AppendTask(job IJob) error {
 	if !this.stopped {
-		this.PendingTasks <- job.(*ProcessJob)
-		return nil
+		return this.PendingTasks.Push(job)
 	}
 	return errors.New("The target task handler has been stopped.")
 }
 
 // Loop the pending list and process
 func (this *ProcessStepTaskHandler) PerformTasks() {
-	for this.CurentStepTask = range this.PendingTasks {
+	for {
+		job, ok := this.PendingTasks.Pop()
+		if !ok {
+			break
+		}
+		this.CurentStepTask = job
 		this.HandleCurrentTask()
 
 		if this.stopped {
@@ -72,29 +86,58 @@ func (this *ProcessStepTaskHandler) HandleCurrentTask() error {
 	logrus.Debugf("[%s]handling step[%s]", this.CurentStepTask.GetJobID(), this.StepTaskType)
 
 	var err error
+	orderWorkflow := this.CurentStepTask.GetWorkflow()
 
-	if this.CurentStepTask.IsJobRollbacking() && this.StepTaskType != "Failed" {
+	if this.CurentStepTask.IsJobRollbacking() && this.StepTaskType != orderWorkflow.FailureStep {
 		err = this.Rollback()
+		if _, ok := err.(*order.VersionConflictError); err != nil && !ok {
+			// The order has failed already, retry the compensation later until the attempts run out
+			logrus.Errorf("[%s]Rollback step[%s] failed [%v]", this.CurentStepTask.GetJobID(), this.StepTaskType, err)
+			compensateErr := err
+			var giveUp bool
+			giveUp, err = this.CurentStepTask.FailCompensation(this.StepTaskType, MaxCompensateAttempts, compensateErr.Error())
+			if _, ok := err.(*order.VersionConflictError); !ok && (err != nil || !giveUp) {
+				this.PipeLine.DispatchTaskLater(this.CurentStepTask, time.Second*CompensateRetryInterval)
+				return compensateErr
+			}
+			if err == nil {
+				// Alert that the step is left not revoked, the rollback goes on with the previous steps
+				logrus.Errorf("[%s]Compensation of step[%s] is given up after [%d] attempts, the step should be revoked manually",
+					this.CurentStepTask.GetJobID(), this.StepTaskType, MaxCompensateAttempts)
+			}
+		}
+	} else if this.CurentStepTask.IsJobCancelled() && !this.CurentStepTask.IsErrorOccured() {
+		// Fail the cancelled order, the rollback is triggered as other failures
+		err = order.ErrOrderCancelled
 	} else {
 		err = this.StartStep()
-		if err == nil {
-			// Simulate the processing of current order step
-			if !this.CurentStepTask.IsJobInFinishingStep() {
-				time.Sleep(time.Second * StepProcessTime)
-			}
-
-			// Simulate the processing failure occurs at 5% ratio
-			if util.IsEventWithSpecifiedRatioHappens() && !this.CurentStepTask.IsJobInFinishingStep() {
-				err = errors.New("Random failure")
-			} else {
-				err = this.FinishStep()
+		if err == nil && !this.CurentStepTask.IsJobInFinishingStep() {
+			// The order exceeding its deadline or step budget is not processed any more
+			err = this.CurentStepTask.CheckDeadline()
+		}
+		if err == nil && this.StepTaskType == orderWorkflow.InitialStep {
+			// The order must be scheduled with the authoritative totals
+			err = this.CurentStepTask.VerifyTotals()
+		}
+		if err == nil && !this.CurentStepTask.IsJobInFinishingStep() && this.StepTaskType != orderWorkflow.DelayedStep {
+			// Perform current order step, nothing to perform when the delayed order is due
+			var result string
+			if result, err = this.ExecuteStep(); err == nil {
+				this.CurentStepTask.SetStepResult(result)
 			}
 		}
+		if err == nil {
+			err = this.FinishStep()
+		}
 
 	}
 
-	if err != nil {
-		this.CurentStepTask.MarkJobAsFailure()
+	if _, ok := err.(*order.VersionConflictError); ok {
+		// Abort the step, the job has been reloaded with the latest order data
+		logrus.Debugf("[%s]Abort step[%s][%v]",
+			this.CurentStepTask.GetJobID(), this.StepTaskType, err)
+	} else if err != nil {
+		this.CurentStepTask.MarkJobAsFailure(order.FailureReasonOf(err), err.Error())
 		// Trigger roll back
 		this.CurentStepTask.StartRollback()
 
@@ -106,17 +149,60 @@ func (this *ProcessStepTaskHandler) HandleCurrentTask() error {
 	return err
 }
 
-// Handle the rollback operation
+// Perform current step by its executor, which is interrupted when the step is out of time.
+// Returns the result of step reported by the executor.
+func (this *ProcessStepTaskHandler) ExecuteStep() (string, error) {
+	job := this.CurentStepTask
+	ctx := context.Background()
+	if deadline := job.GetStepDeadline(); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	executor, err := GetStepExecutor(this.StepTaskType)
+	if err != nil {
+		return "", err
+	}
+	result, err := executeStep(executor, ctx, job)
+	if err != nil && ctx.Err() != nil {
+		// Report the timeout instead of the interruption
+		if e := job.CheckDeadline(); e != nil {
+			return "", e
+		}
+	}
+	return result, err
+}
+
+// Handle the rollback operation, the step is revoked by its executor within the budget of step
+// before being marked as rolled back
 func (this *ProcessStepTaskHandler) Rollback() error {
 	logrus.Debugf("[%s]Rollback step[%s]", this.CurentStepTask.GetJobID(), this.StepTaskType)
 
+	if !this.CurentStepTask.IsJobParent() {
+		// The steps of parent are performed by its children, which roll back themselves
+		budget := StepBudgets[this.StepTaskType]
+		if budget <= 0 {
+			budget = time.Second * DefaultCompensateBudget
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), budget)
+		defer cancel()
+
+		executor, err := GetStepExecutor(this.StepTaskType)
+		if err == nil {
+			err = compensateStep(executor, ctx, this.CurentStepTask)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return this.CurentStepTask.RollbackStep(this.StepTaskType)
 }
 
 // Start current step
 func (this *ProcessStepTaskHandler) StartStep() error {
 	job := this.CurentStepTask
-	err := VerifyStepSwitch(job.GetCurrentStep(), this.StepTaskType)
+	err := VerifyStepSwitch(job.GetWorkflow(), job.GetCurrentStep(), this.StepTaskType)
 	if err != nil {
 		return err
 	}
@@ -142,6 +228,11 @@ func (this *ProcessStepTaskHandler) FinishStep() error {
 func (this *ProcessStepTaskHandler) Stop() {
 	if !this.stopped {
 		this.stopped = true
-		close(this.PendingTasks)
+		this.PendingTasks.Close()
 	}
 }
+
+// Get the count of pending tasks per priority
+func (this *ProcessStepTaskHandler) QueueDepths() map[string]int {
+	return this.PendingTasks.Depths()
+}
@@ -0,0 +1,66 @@
+package retention
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"order_process/process/db"
+	"order_process/process/model/order"
+)
+
+// The interval of archiving
+const (
+	ArchiveInterval = 3600 // in seconds
+)
+
+// The definition of retention, which archives the finished orders periodically
+type Retention struct {
+	database  db.IDatabase
+	serviceID string
+	maxAge    time.Duration
+	stop      chan bool
+}
+
+// The constructor of retention
+func New(database db.IDatabase, serviceID string, maxAge time.Duration) *Retention {
+	return &Retention{
+		database:  database,
+		serviceID: serviceID,
+		maxAge:    maxAge,
+		stop:      make(chan bool),
+	}
+}
+
+// Start archiving in background
+func (this *Retention) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Second * ArchiveInterval)
+		defer ticker.Stop()
+
+		for {
+			this.Archive()
+			select {
+			case <-ticker.C:
+			case <-this.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Archive the orders finished before max age
+func (this *Retention) Archive() {
+	count, err := order.Archive(this.database, this.serviceID, time.Now().Add(-this.maxAge))
+	if err != nil {
+		logrus.Errorf("Archive orders failed [%v]", err)
+	}
+	if count > 0 {
+		logrus.Printf("Archived [%d] orders", count)
+	}
+}
+
+// Stop archiving
+func (this *Retention) Stop() {
+	close(this.stop)
+}
@@ -8,21 +8,24 @@ import (
 )
 
 // Transfer orders to current service
-func Transfer(currentServiceId string, tranferredServiceId string, fn func(*order.OrderRecord)) error {
-	return Reload(currentServiceId, tranferredServiceId, fn)
+func Transfer(database db.IDatabase, currentServiceId string, tranferredServiceId string, fn func(*order.OrderRecord)) error {
+	return Reload(database, currentServiceId, tranferredServiceId, fn)
 }
 
 // Load orders to current service
-func Reload(currentServiceId string, tranferredServiceId string, fn func(orderRecord *order.OrderRecord)) error {
+func Reload(database db.IDatabase, currentServiceId string, tranferredServiceId string, fn func(orderRecord *order.OrderRecord)) error {
 	// Retrieve the orders from the transferred servive
-	rawMaps, _ := db.Query("", order.OrderStateInServiceTable+":"+tranferredServiceId)
+	rawMaps, err := database.Query("", order.OrderStateInServiceTable+":"+tranferredServiceId)
+	if err != nil {
+		return err
+	}
 
 	// Parse orders
 	var ordersMap []map[string]interface{}
 	for index, val := range rawMaps {
 		if index%2 != 0 {
 			t := make(map[string]interface{})
-			err := json.Unmarshal([]byte(val[string(index)].(string)), &t)
+			err := json.Unmarshal([]byte(val[db.QueryRecordKey(index)].(string)), &t)
 			if err != nil {
 				return err
 			}
@@ -34,16 +37,26 @@ func Reload(currentServiceId string, tranferredServiceId string, fn func(orderRe
 	for _, orderMap := range ordersMap {
 		if orderMap["order_state_in_service"].(string) == order.OSS_Active.String() {
 			logrus.Debugf("Reload: [%v]", orderMap)
-			record, err := order.Get(orderMap["order_id"].(string))
+			record, err := order.Get(database, orderMap["order_id"].(string))
+			if _, ok := err.(*order.NotFoundError); ok {
+				// The entry left by the order failed to be created
+				logrus.Warnf("Reload: order [%v] not found", orderMap["order_id"])
+				continue
+			}
 			if err != nil {
 				return err
 			}
 
 			// Update the service order map
 			if currentServiceId != tranferredServiceId {
-				// Transaction should be introduced here
-				order.UpdateOrderStateInService(tranferredServiceId, record.OrderID, order.OSS_Transferred.String())
-				order.UpdateOrderStateInService(currentServiceId, record.OrderID, order.OSS_Active.String())
+				err = order.TransferOrderStateInService(database, tranferredServiceId, currentServiceId, record.OrderID)
+				if err == db.ErrConditionFailed {
+					logrus.Debugf("Reload: order [%v] has been taken over by other service", record.OrderID)
+					continue
+				}
+				if err != nil {
+					return err
+				}
 			}
 			record.ServiceID = currentServiceId
 
@@ -0,0 +1,200 @@
+package transfer
+
+import (
+	"errors"
+	"testing"
+
+	"order_process/process/db"
+	"order_process/process/model/order"
+	"order_process/process/util"
+)
+
+// The error injected as if the service crashed before the operation
+var errCrash = errors.New("Crash injected")
+
+// The in-memory database which fails the writes from the failAt-th one, 0 means never
+type faultyDatabase struct {
+	*db.MemoryDatabase
+	failAt   int
+	writes   int
+	queryErr error
+}
+
+func (this *faultyDatabase) Query(stmt string, args ...interface{}) ([]map[string]interface{}, error) {
+	if this.queryErr != nil {
+		return nil, this.queryErr
+	}
+	return this.MemoryDatabase.Query(stmt, args...)
+}
+
+func (this *faultyDatabase) Write(stmt string, args ...interface{}) error {
+	this.writes++
+	if this.failAt > 0 && this.writes >= this.failAt {
+		return errCrash
+	}
+	return this.MemoryDatabase.Write(stmt, args...)
+}
+
+func (this *faultyDatabase) Transact(conditions []db.Condition, mutations []db.Mutation) error {
+	this.writes++
+	if this.failAt > 0 && this.writes >= this.failAt {
+		return errCrash
+	}
+	return this.MemoryDatabase.Transact(conditions, mutations)
+}
+
+// Get the state of order in service, empty if the service never owned it
+func stateInService(t *testing.T, database db.IDatabase, serviceID string, orderId string) string {
+	hash, err := db.QueryHash(database, order.OrderStateInServiceTable+":"+serviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := hash[orderId]; !found {
+		return ""
+	}
+	state, err := order.GetOrderStateInService(database, serviceID, orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// Check that the order is owned by exactly one of the services, and the transfer is recorded once it is moved
+func checkOwnership(t *testing.T, database db.IDatabase, orderId string) bool {
+	dead := stateInService(t, database, "dead", orderId)
+	alive := stateInService(t, database, "alive", orderId)
+
+	events, _, err := order.GetEvents(database, orderId, "", order.MaxEventsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfers := 0
+	for _, event := range events {
+		if event.Type == order.ET_Transferred.String() {
+			transfers++
+		}
+	}
+
+	switch {
+	case dead == order.OSS_Active.String() && alive == "" && transfers == 0:
+		return false
+	case dead == order.OSS_Transferred.String() && alive == order.OSS_Active.String() && transfers == 1:
+		return true
+	}
+	t.Errorf("order [%s] is [%s] in dead service and [%s] in alive service with %d transfers", orderId, dead, alive, transfers)
+	return false
+}
+
+func TestReloadSurvivesCrash(t *testing.T) {
+	const orders = 3
+
+	// Crash before each write until the transfer completes without crash
+	for failAt := 1; ; failAt++ {
+		database := &faultyDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+		orderIds := []string{}
+		for index := 0; index < orders; index++ {
+			record, err := order.New(database.MemoryDatabase, map[string]interface{}{"user_id": "user", "service_id": "dead"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			orderIds = append(orderIds, record.OrderID)
+		}
+
+		database.failAt = failAt
+		dispatched := 0
+		err := Reload(database, "alive", "dead", func(record *order.OrderRecord) {
+			dispatched++
+		})
+		if err != nil && err != errCrash {
+			t.Fatalf("crash at write %d: reload got [%v]", failAt, err)
+		}
+
+		moved := 0
+		for _, orderId := range orderIds {
+			if checkOwnership(t, database, orderId) {
+				moved++
+			}
+		}
+		if moved != dispatched {
+			t.Errorf("crash at write %d: %d orders moved, %d dispatched", failAt, moved, dispatched)
+		}
+
+		// The orders left behind are moved by the next reload
+		database.failAt = 0
+		if err = Reload(database, "alive", "dead", func(record *order.OrderRecord) {}); err != nil {
+			t.Fatal(err)
+		}
+		for _, orderId := range orderIds {
+			if !checkOwnership(t, database, orderId) {
+				t.Errorf("crash at write %d: order [%s] is not moved by the next reload", failAt, orderId)
+			}
+		}
+
+		if err == nil && moved == orders {
+			break
+		}
+	}
+}
+
+func TestReloadSkipsTakenOrder(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	record, err := order.New(database, map[string]interface{}{"user_id": "user", "service_id": "dead"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another service has taken over the order
+	if err = order.TransferOrderStateInService(database, "dead", "other", record.OrderID); err != nil {
+		t.Fatal(err)
+	}
+	dispatched := 0
+	if err = Reload(database, "alive", "dead", func(record *order.OrderRecord) { dispatched++ }); err != nil {
+		t.Fatal(err)
+	}
+	if dispatched != 0 || stateInService(t, database, "alive", record.OrderID) != "" {
+		t.Errorf("taken order is moved again")
+	}
+}
+
+func TestReloadSkipsMissingOrder(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	missing := util.NewUUID()
+	if err := order.UpdateOrderStateInService(database, "dead", missing, order.OSS_Active.String()); err != nil {
+		t.Fatal(err)
+	}
+	records := []string{}
+	for index := 0; index < 2; index++ {
+		record, err := order.New(database, map[string]interface{}{"user_id": "user", "service_id": "dead"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record.OrderID)
+	}
+
+	// The orders are reloaded regardless of the entry without order
+	dispatched := 0
+	if err := Reload(database, "alive", "dead", func(record *order.OrderRecord) { dispatched++ }); err != nil {
+		t.Fatal(err)
+	}
+	if dispatched != len(records) {
+		t.Errorf("%d orders dispatched", dispatched)
+	}
+	if state := stateInService(t, database, "alive", missing); state != "" {
+		t.Errorf("missing order is [%s] in service", state)
+	}
+}
+
+func TestReloadQueryFailed(t *testing.T) {
+	database := &faultyDatabase{MemoryDatabase: db.NewMemoryDatabase(), queryErr: errCrash}
+	if _, err := order.New(database.MemoryDatabase, map[string]interface{}{"user_id": "user", "service_id": "dead"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatched := 0
+	if err := Reload(database, "alive", "dead", func(record *order.OrderRecord) { dispatched++ }); err != errCrash {
+		t.Errorf("reload got [%v]", err)
+	}
+	if dispatched != 0 {
+		t.Errorf("%d orders dispatched", dispatched)
+	}
+}
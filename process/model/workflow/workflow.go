@@ -0,0 +1,293 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// The workflow which the orders recorded without workflow ran under
+const StandardWorkflow = "standard"
+
+// The definition of step in workflow
+type Step struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	// The step entered when the step succeeds, empty for the terminal steps.
+	// The step fails to the failure step of workflow.
+	Next string `json:"next"`
+	// Whether the step is rolled back when the order fails
+	Compensatable bool `json:"compensatable"`
+}
+
+// The definition of workflow, the order enters the initial step, or the delayed step if it is started later,
+// then follows the next steps until the success step, and enters the failure step once any step fails.
+type Workflow struct {
+	Name        string `json:"name"`
+	InitialStep string `json:"initial_step"`
+	DelayedStep string `json:"delayed_step"`
+	SuccessStep string `json:"success_step"`
+	FailureStep string `json:"failure_step"`
+	Steps       []Step `json:"steps"`
+
+	steps map[string]*Step
+	// The steps from initial step to the one before success step
+	processingSteps []string
+}
+
+// The definition of workflows file
+type Definitions struct {
+	// The workflow of the order submitted without workflow
+	Default   string      `json:"default"`
+	Workflows []*Workflow `json:"workflows"`
+}
+
+// The loaded workflows
+var (
+	workflows       = map[string]*Workflow{StandardWorkflow: standard()}
+	defaultWorkflow = StandardWorkflow
+)
+
+// The workflow of Scheduling, Pre-Processing, Processing and Post-Processing
+func standard() *Workflow {
+	workflow := &Workflow{
+		Name:        StandardWorkflow,
+		InitialStep: "Scheduling",
+		DelayedStep: "Delayed",
+		SuccessStep: "Completed",
+		FailureStep: "Failed",
+		Steps: []Step{
+			{Name: "Delayed", DisplayName: "Waiting to start", Next: "Scheduling"},
+			{Name: "Scheduling", DisplayName: "Order received", Next: "Pre-Processing", Compensatable: true},
+			{Name: "Pre-Processing", DisplayName: "Preparing your order", Next: "Processing", Compensatable: true},
+			{Name: "Processing", DisplayName: "Processing your order", Next: "Post-Processing", Compensatable: true},
+			{Name: "Post-Processing", DisplayName: "Getting ready to ship", Next: "Completed", Compensatable: true},
+			{Name: "Completed", DisplayName: "Completed"},
+			{Name: "Failed", DisplayName: "Not completed"},
+		},
+	}
+	if err := workflow.build(); err != nil {
+		panic(err)
+	}
+	return workflow
+}
+
+// Load the workflows from definitions file, the standard workflow is kept unless it is redefined
+func Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	definitions, err := Parse(data)
+	if err != nil {
+		return err
+	}
+
+	loaded := map[string]*Workflow{StandardWorkflow: standard()}
+	for _, workflow := range definitions.Workflows {
+		loaded[workflow.Name] = workflow
+	}
+	workflows = loaded
+	defaultWorkflow = definitions.Default
+	return nil
+}
+
+// Parse and verify the workflows from json of definitions
+func Parse(data []byte) (*Definitions, error) {
+	definitions := Definitions{}
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, workflow := range definitions.Workflows {
+		if names[workflow.Name] {
+			return nil, fmt.Errorf("Workflow [%s] is defined more than once", workflow.Name)
+		}
+		names[workflow.Name] = true
+		if err := workflow.build(); err != nil {
+			return nil, err
+		}
+	}
+	if definitions.Default == "" {
+		definitions.Default = StandardWorkflow
+	}
+	if !names[definitions.Default] && definitions.Default != StandardWorkflow {
+		return nil, fmt.Errorf("Default workflow [%s] is not defined", definitions.Default)
+	}
+	return &definitions, nil
+}
+
+// Get the workflow by name, the standard workflow for empty name, nil if not defined
+func Get(name string) *Workflow {
+	if name == "" {
+		name = StandardWorkflow
+	}
+	return workflows[name]
+}
+
+// Get the workflow of the order submitted without workflow
+func Default() *Workflow {
+	return workflows[defaultWorkflow]
+}
+
+// Get the names of steps of all the workflows
+func StepNames() []string {
+	names := []string{}
+	found := make(map[string]bool)
+	for _, workflow := range workflows {
+		for _, step := range workflow.Steps {
+			if !found[step.Name] {
+				found[step.Name] = true
+				names = append(names, step.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get the names of steps performed in processing of all the workflows
+func ProcessingStepNames() []string {
+	names := []string{}
+	found := make(map[string]bool)
+	for _, workflow := range workflows {
+		for _, name := range workflow.processingSteps {
+			if !found[name] {
+				found[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Index and verify the steps of workflow
+func (this *Workflow) build() error {
+	if this.Name == "" {
+		return errors.New("Workflow name is required")
+	}
+	this.steps = make(map[string]*Step)
+	for index := range this.Steps {
+		step := &this.Steps[index]
+		if step.Name == "" {
+			return fmt.Errorf("Step name is required in workflow [%s]", this.Name)
+		}
+		if this.steps[step.Name] != nil {
+			return fmt.Errorf("Step [%s] is defined more than once in workflow [%s]", step.Name, this.Name)
+		}
+		this.steps[step.Name] = step
+	}
+
+	for _, name := range []string{this.InitialStep, this.SuccessStep, this.FailureStep} {
+		if this.steps[name] == nil {
+			return fmt.Errorf("Step [%s] is not defined in workflow [%s]", name, this.Name)
+		}
+	}
+	for _, name := range []string{this.SuccessStep, this.FailureStep} {
+		if this.steps[name].Next != "" || this.steps[name].Compensatable {
+			return fmt.Errorf("Terminal step [%s] has next step or is compensatable in workflow [%s]", name, this.Name)
+		}
+	}
+	if this.DelayedStep != "" {
+		if this.steps[this.DelayedStep] == nil || this.steps[this.DelayedStep].Next != this.InitialStep {
+			return fmt.Errorf("Delayed step [%s] should be followed by initial step in workflow [%s]", this.DelayedStep, this.Name)
+		}
+	}
+
+	// The steps from initial step should reach success step one by one
+	this.processingSteps = nil
+	visited := map[string]bool{this.SuccessStep: true, this.FailureStep: true}
+	if this.DelayedStep != "" {
+		visited[this.DelayedStep] = true
+	}
+	for name := this.InitialStep; name != this.SuccessStep; name = this.steps[name].Next {
+		if visited[name] || this.steps[name] == nil {
+			return fmt.Errorf("Step [%s] cannot lead to success step in workflow [%s]", name, this.Name)
+		}
+		visited[name] = true
+		this.processingSteps = append(this.processingSteps, name)
+	}
+	if len(visited) != len(this.Steps) {
+		return fmt.Errorf("Some steps are not reachable in workflow [%s]", this.Name)
+	}
+	return nil
+}
+
+// Check whether the step is defined in workflow
+func (this *Workflow) HasStep(name string) bool {
+	return this.steps[name] != nil
+}
+
+// Check whether the step is the success or failure step
+func (this *Workflow) IsTerminal(name string) bool {
+	return name == this.SuccessStep || name == this.FailureStep
+}
+
+// Check whether the step is followed by success step
+func (this *Workflow) IsLastStep(name string) bool {
+	return this.steps[name] != nil && this.steps[name].Next == this.SuccessStep
+}
+
+// Check whether the step is rolled back when the order fails
+func (this *Workflow) IsCompensatable(name string) bool {
+	return this.steps[name] != nil && this.steps[name].Compensatable
+}
+
+// Get the step entered when the step succeeds, the terminal step stays
+func (this *Workflow) NextStep(name string) string {
+	if this.IsTerminal(name) || this.steps[name] == nil {
+		return name
+	}
+	return this.steps[name].Next
+}
+
+// Verify whether the order can switch from one step to another
+func (this *Workflow) CanSwitch(from string, to string) bool {
+	if this.steps[from] == nil {
+		return false
+	}
+	if from == to || this.IsTerminal(from) {
+		return from == to
+	}
+	return to == this.steps[from].Next || to == this.FailureStep
+}
+
+// Get the steps from initial step to the one before success step, in order of processing
+func (this *Workflow) ProcessingSteps() []string {
+	return this.processingSteps
+}
+
+// Check whether one step is before another in processing, the unknown step is after all
+func (this *Workflow) Before(step string, other string) bool {
+	return this.stepOrder(step) < this.stepOrder(other)
+}
+
+// Get the order of step in processing
+func (this *Workflow) stepOrder(name string) int {
+	switch name {
+	case this.DelayedStep:
+		return -1
+	case this.SuccessStep:
+		return len(this.processingSteps)
+	case this.FailureStep:
+		return len(this.processingSteps) + 1
+	}
+	for index, step := range this.processingSteps {
+		if step == name {
+			return index
+		}
+	}
+	return len(this.processingSteps) + 2
+}
+
+// Get the name of step shown to customer
+func (this *Workflow) DisplayName(name string) string {
+	if step := this.steps[name]; step != nil && step.DisplayName != "" {
+		return step.DisplayName
+	}
+	return name
+}
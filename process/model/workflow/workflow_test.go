@@ -0,0 +1,97 @@
+package workflow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The steps of workflow in json, the step named "-" is dropped
+func workflowJson(name string, steps ...string) string {
+	defined := []string{}
+	for _, step := range steps {
+		if step != "-" {
+			defined = append(defined, step)
+		}
+	}
+	return `{"name": "` + name + `", "initial_step": "Pick", "success_step": "Done", "failure_step": "Lost", "steps": [` +
+		strings.Join(defined, ", ") + `]}`
+}
+
+const (
+	pickStep = `{"name": "Pick", "next": "Pack", "compensatable": true}`
+	packStep = `{"name": "Pack", "next": "Done"}`
+	doneStep = `{"name": "Done"}`
+	lostStep = `{"name": "Lost"}`
+)
+
+func TestParse(t *testing.T) {
+	definitions, err := Parse([]byte(`{"default": "express", "workflows": [` + workflowJson("express", pickStep, packStep, doneStep, lostStep) + `]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	express := definitions.Workflows[0]
+	if definitions.Default != "express" || !reflect.DeepEqual(express.ProcessingSteps(), []string{"Pick", "Pack"}) {
+		t.Errorf("parsed definitions are %+v", definitions)
+	}
+	if !express.IsCompensatable("Pick") || express.IsCompensatable("Pack") || express.NextStep("Pick") != "Pack" {
+		t.Errorf("parsed workflow is %+v", express)
+	}
+
+	// The standard workflow is the default if not specified
+	if definitions, err = Parse([]byte(`{"workflows": []}`)); err != nil || definitions.Default != StandardWorkflow {
+		t.Errorf("parsed definitions are %+v [%v]", definitions, err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []struct {
+		name        string
+		definitions string
+		err         string
+	}{
+		{name: "malformed json", definitions: `{"workflows": [`, err: "unexpected end of JSON input"},
+		{name: "mistyped field", definitions: `{"workflows": [{"name": 1}]}`, err: "cannot unmarshal number"},
+		{
+			name:        "duplicate workflows",
+			definitions: `{"workflows": [` + workflowJson("express", pickStep, packStep, doneStep, lostStep) + `, ` + workflowJson("express", pickStep, packStep, doneStep, lostStep) + `]}`,
+			err:         "Workflow [express] is defined more than once",
+		},
+		{
+			name:        "duplicate steps",
+			definitions: `{"workflows": [` + workflowJson("express", pickStep, packStep, packStep, doneStep, lostStep) + `]}`,
+			err:         "Step [Pack] is defined more than once in workflow [express]",
+		},
+		{
+			name:        "unknown next step",
+			definitions: `{"workflows": [` + workflowJson("express", pickStep, `{"name": "Pack", "next": "Ship"}`, doneStep, lostStep) + `]}`,
+			err:         "Step [Ship] cannot lead to success step in workflow [express]",
+		},
+		{
+			name:        "unknown failure step",
+			definitions: `{"workflows": [` + workflowJson("express", pickStep, packStep, doneStep, "-") + `]}`,
+			err:         "Step [Lost] is not defined in workflow [express]",
+		},
+		{
+			name:        "unreachable step",
+			definitions: `{"workflows": [` + workflowJson("express", pickStep, packStep, doneStep, lostStep, `{"name": "Ship", "next": "Done"}`) + `]}`,
+			err:         "Some steps are not reachable in workflow [express]",
+		},
+		{
+			name:        "cycle of steps",
+			definitions: `{"workflows": [` + workflowJson("express", pickStep, `{"name": "Pack", "next": "Pick"}`, doneStep, lostStep) + `]}`,
+			err:         "Step [Pick] cannot lead to success step in workflow [express]",
+		},
+		{
+			name:        "unknown default workflow",
+			definitions: `{"default": "overnight", "workflows": [` + workflowJson("express", pickStep, packStep, doneStep, lostStep) + `]}`,
+			err:         "Default workflow [overnight] is not defined",
+		},
+	}
+
+	for _, c := range cases {
+		if _, err := Parse([]byte(c.definitions)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got [%v], expected [%s]", c.name, err, c.err)
+		}
+	}
+}
@@ -1,23 +1,32 @@
 package service
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 
 	"order_process/process/consumer"
+	"order_process/process/db"
 	"order_process/process/diagnostic"
 	"order_process/process/env"
 	"order_process/process/model/cluster"
+	"order_process/process/model/idempotency"
 	"order_process/process/model/order"
 	"order_process/process/model/pipeline"
+	"order_process/process/model/retention"
 	"order_process/process/model/transfer"
+	"order_process/process/model/workflow"
 	"order_process/process/util"
+	"order_process/process/validator"
 )
 
 // The max count pipeline of per Order Processing Service Instance
@@ -25,6 +34,9 @@ var (
 	MaxPipelineCount = 50
 )
 
+// The max length of the reason of cancellation
+const MaxCancelReasonLength = 1024
+
 // Order Processing Service
 type OrderProcessService struct {
 	serviceID string
@@ -39,17 +51,44 @@ type OrderProcessService struct {
 
 	pipelineManager pipeline.IPipelineManager
 
+	database db.IDatabase
+
+	archiveAfterDays int
+	archivePath      string
+	retention        *retention.Retention
+
+	orderSchemaPath string
+	orderSchema     *validator.Schema
+
+	idempotencyKeyTTL int
+	idempotencyKeys   *idempotency.Store
+
+	stepBudgets []string
+
+	workflowFile  string
+	simulateSteps bool
+
 	diagnostic *diagnostic.Diagnostic
 }
 
 // Creates a new server.
 // The constructor of Order Processing Service
-func NewOrderProcessService(serviceCfg *env.ServiceCfg) *OrderProcessService {
+func NewOrderProcessService(serviceCfg *env.ServiceCfg, database db.IDatabase) *OrderProcessService {
 	s := OrderProcessService{
-		host:   serviceCfg.IP,
-		port:   serviceCfg.Port,
-		path:   serviceCfg.Path,
-		router: mux.NewRouter(),
+		host:     serviceCfg.IP,
+		port:     serviceCfg.Port,
+		path:     serviceCfg.Path,
+		router:   mux.NewRouter(),
+		database: database,
+
+		archiveAfterDays: serviceCfg.ArchiveAfterDays,
+		archivePath:      serviceCfg.ArchivePath,
+		orderSchemaPath:  serviceCfg.OrderSchema,
+
+		idempotencyKeyTTL: serviceCfg.IdempotencyKeyTTL,
+		stepBudgets:       serviceCfg.StepBudget,
+		workflowFile:      serviceCfg.WorkflowFile,
+		simulateSteps:     serviceCfg.SimulateSteps,
 	}
 
 	// Read existing serviceID or generate a new one.
@@ -66,17 +105,64 @@ func NewOrderProcessService(serviceCfg *env.ServiceCfg) *OrderProcessService {
 
 // Starts the Service.
 func (this *OrderProcessService) Start(leader string) error {
+	// Load the schema of order payload
+	if this.orderSchemaPath != "" {
+		schema, err := validator.Load(this.orderSchemaPath)
+		if err != nil {
+			return err
+		}
+		this.orderSchema = schema
+	}
+
+	// Load the workflows of orders
+	if this.workflowFile != "" {
+		if err := workflow.Load(this.workflowFile); err != nil {
+			return err
+		}
+	}
+
+	// Load the time budgets of steps
+	stepBudgets, err := parseStepBudgets(this.stepBudgets)
+	if err != nil {
+		return err
+	}
+	pipeline.StepBudgets = stepBudgets
+
+	// The steps are simulated only if enabled, otherwise every step should have its executor registered
+	if this.simulateSteps {
+		pipeline.DefaultStepExecutor = pipeline.NewSimulatedExecutor(time.Second*pipeline.StepProcessTime, true)
+	}
+	if err = pipeline.VerifyStepExecutors(); err != nil {
+		return err
+	}
+
 	// Initialize and Start the Cluster Management
 	this.cluster = cluster.New(this.serviceID, this.host, this.port, this.path, this.router)
 	this.cluster.Start(leader)
 
 	// Initialize and start pipeline
-	this.pipelineManager = pipeline.NewProcessPipelineManager(this.serviceID, MaxPipelineCount,
+	this.pipelineManager = pipeline.NewProcessPipelineManager(this.database, this.serviceID, MaxPipelineCount,
 		pipeline.NewProcessPipeline, pipeline.NewStepTaskHandler)
-	this.pipelineManager.Start()
+	if err = this.pipelineManager.Start(); err != nil {
+		return err
+	}
+
+	// Initialize and start archiving of finished orders, the archived orders are readable even if archiving is disabled
+	order.ArchivePath = this.archivePath
+	if order.ArchivePath == "" {
+		order.ArchivePath = filepath.Join(this.path, "archive")
+	}
+	if this.archiveAfterDays > 0 {
+		this.retention = retention.New(this.database, this.serviceID, time.Duration(this.archiveAfterDays)*24*time.Hour)
+		this.retention.Start()
+	}
+
+	// Initialize and start purging of expired idempotency keys
+	this.idempotencyKeys = idempotency.New(this.database, time.Duration(this.idempotencyKeyTTL)*time.Second)
+	this.idempotencyKeys.Start()
 
 	// Initialize the diagnostic
-	this.diagnostic = diagnostic.New(this.serviceID, this.cluster)
+	this.diagnostic = diagnostic.New(this.serviceID, this.cluster, this.pipelineManager, this.database)
 
 	logrus.Println("Initializing HTTP server")
 
@@ -95,12 +181,32 @@ func (this *OrderProcessService) Start(leader string) error {
 	// Qurey specified order
 	this.router.HandleFunc("/orders/{id}", this.QureyOrder).Methods("GET")
 
+	// Amend the payload of specified order
+	this.router.HandleFunc("/orders/{id}", this.AmendOrder).Methods("PATCH")
+
+	// Cancel specified order
+	this.router.HandleFunc("/orders/{id}/cancel", this.CancelOrder).Methods("POST")
+
+	// Merge specified orders into new parent
+	this.router.HandleFunc("/orders/merge", this.MergeOrders).Methods("POST")
+
+	// Split specified order into children
+	this.router.HandleFunc("/orders/{id}/split", this.SplitOrder).Methods("POST")
+
+	// Retry specified failed order
+	this.router.HandleFunc("/orders/{id}/retry", this.RetryOrder).Methods("POST")
+
+	// Qurey the events of specified order
+	this.router.HandleFunc("/orders/{id}/events", this.QureyOrderEvents).Methods("GET")
+
 	// Transfer orders from specified service
 	this.router.HandleFunc("/service/transfer", this.Transfer).Methods("POST")
 
 	// Diagnostic handlers
 	this.router.HandleFunc("/diagnostic/cluster", this.diagnostic.ClusterStatusHandler).Methods("GET")
 	this.router.HandleFunc("/diagnostic/heartbeat", this.diagnostic.HeartBeatHandler).Methods("GET")
+	this.router.HandleFunc("/diagnostic/queues", this.diagnostic.QueueDepthHandler).Methods("GET")
+	this.router.HandleFunc("/diagnostic/timeouts", this.diagnostic.TimeoutsHandler).Methods("GET")
 
 	// Welcome infomation
 	this.router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -144,22 +250,124 @@ func (this *OrderProcessService) CreateOrder(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Parse request body
-	t, err := this.parseRequestBody(r)
+	// Parse and validate request body
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		fmt.Fprint(w, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, options, fieldErrors, err := this.parseOrderPayload(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, fieldErrors)
 		return
 	}
 
 	// TODO user Correlation-Id to track the request
 	logrus.Debug("POST /orders")
 
+	// Compute the totals of order
+	totals, err := order.ComputeTotals(payload)
+	if pricingErr, ok := err.(*order.PricingError); ok {
+		writeFieldErrors(w, []validator.FieldError{{Field: pricingErr.Field, Message: pricingErr.Message}})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The retried request with the same idempotency key gets the original response
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > idempotency.MaxKeyLength {
+		http.Error(w, fmt.Sprintf("Idempotency-Key is at most %d bytes", idempotency.MaxKeyLength),
+			http.StatusBadRequest)
+		return
+	}
+	var reservation *idempotency.Reservation
+	if idempotencyKey != "" {
+		keyRecord, reserved, err := this.idempotencyKeys.Reserve(tokenInfo.UserID, idempotencyKey, body)
+		switch err {
+		case nil:
+		case idempotency.ErrKeyReused:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case idempotency.ErrKeyInProgress:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, err.Error(), databaseErrorStatus(err))
+			return
+		}
+		if keyRecord != nil && keyRecord.State == idempotency.KS_Pending.String() {
+			// The order has been created by the request whose response is not completed
+			orderRecord, err := order.Get(this.database, keyRecord.OrderID)
+			if err != nil {
+				http.Error(w, err.Error(), databaseErrorStatus(err))
+				return
+			}
+			this.replyCreatedOrder(w, reserved, orderRecord)
+			return
+		}
+		if keyRecord != nil {
+			logrus.Debugf("Replay the response of order [%v] for idempotency key [%v]", keyRecord.OrderID, idempotencyKey)
+			w.Header().Add("Content-Type", "application/json")
+			w.Header().Add("Idempotent-Replayed", "true")
+			w.WriteHeader(keyRecord.StatusCode)
+			fmt.Fprint(w, keyRecord.Response)
+			return
+		}
+		reservation = reserved
+	}
+
 	// Generate order record
-	t["user_id"] = tokenInfo.UserID
-	t["service_id"] = this.serviceID
-	orderRecord, err := order.New(t)
+	t := map[string]interface{}{
+		"user_id":    tokenInfo.UserID,
+		"service_id": this.serviceID,
+		"priority":   options.Priority,
+		"payload":    payload,
+		"totals":     totals,
+	}
+	if options.Workflow != "" {
+		t["workflow"] = options.Workflow
+	}
+	if options.NotBefore != nil {
+		t["not_before"] = options.NotBefore.UTC()
+	}
+	if options.Deadline != nil {
+		t["deadline"] = options.Deadline.UTC()
+	}
+	// The idempotency key is bound to the order in the transaction creating it
+	conditions := []db.Condition{}
+	mutations := []db.Mutation{}
+	if reservation != nil {
+		t["order_id"] = util.NewUUID()
+		condition, mutation, err := reservation.Bind(t["order_id"].(string))
+		if err != nil {
+			reservation.Release()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		conditions = append(conditions, condition)
+		mutations = append(mutations, mutation)
+	}
+	orderRecord, err := order.NewWith(this.database, t, conditions, mutations)
+	if _, ok := err.(*order.VersionConflictError); ok && reservation != nil {
+		// The reservation has expired and been taken over by others
+		http.Error(w, idempotency.ErrKeyInProgress.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		logrus.Errorf("Error when CreateOrder [%v]", err)
+		if reservation != nil {
+			reservation.Release()
+		}
+		http.Error(w, err.Error(), databaseErrorStatus(err))
+		return
 	}
 	logrus.Debugf("New order created with ID: [%v]", orderRecord.OrderID)
 
@@ -167,12 +375,30 @@ func (this *OrderProcessService) CreateOrder(w http.ResponseWriter, r *http.Requ
 	// process asynchronously using selected pipeline by PipelineManager
 	this.pipelineManager.DispatchOrder(orderRecord)
 
-	// Generate response
+	this.replyCreatedOrder(w, reservation, orderRecord)
+}
+
+// Reply the order created, the response is completed with the idempotency key to be replayed.
+// The request fails if the response is not completed, the retry completes it with the order bound to the key.
+func (this *OrderProcessService) replyCreatedOrder(w http.ResponseWriter, reservation *idempotency.Reservation,
+	orderRecord *order.OrderRecord) {
 	response := map[string]string{
 		"order_id":   orderRecord.OrderID,
-		"start_time": orderRecord.StartTime,
+		"start_time": order.FormatTime(orderRecord.StartTime),
 	}
 	str, _ := json.Marshal(response)
+	if reservation != nil {
+		err := reservation.Complete(orderRecord.OrderID, http.StatusOK, string(str))
+		if err == idempotency.ErrKeyTakenOver {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logrus.Errorf("Error when saving idempotency key of order [%v] [%v]", orderRecord.OrderID, err)
+			http.Error(w, err.Error(), databaseErrorStatus(err))
+			return
+		}
+	}
 	w.Header().Add("Content-Type", "application/json")
 	fmt.Fprint(w, string(str))
 }
@@ -188,17 +414,434 @@ func (this *OrderProcessService) QureyOrder(w http.ResponseWriter, r *http.Reque
 	id := mux.Vars(r)["id"]
 	logrus.Debugf("Get /orders/[%v] ", id)
 
-	// Retrieve order record
-	record, err := order.Get(id)
+	// Only the order of current user is visible
+	record, err := order.Get(this.database, id)
+	if _, ok := err.(*db.ConnectionError); ok {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || record.UserID != tokenInfo.UserID {
+		w.WriteHeader(404)
+		return
+	}
+
+	str, _ := record.ToJsonForUser()
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(w, str)
+}
+
+// GET /orders/{order_id}/events?after={event_id}&limit={limit}
+func (this *OrderProcessService) QureyOrderEvents(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, err := this.retrieveToken(r)
+	if err != nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	logrus.Debugf("GET /orders/[%v]/events", id)
+
+	limit := order.DefaultEventsPerPage
+	if str := r.URL.Query().Get("limit"); str != "" {
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit <= 0 || limit > order.MaxEventsPerPage {
+			http.Error(w, fmt.Sprintf("The limit should be between 1 and %d", order.MaxEventsPerPage),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Only the events of the order of current user are visible
+	record, err := order.Get(this.database, id)
+	if _, ok := err.(*db.ConnectionError); ok {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || record.UserID != tokenInfo.UserID {
+		w.WriteHeader(404)
+		return
+	}
+
+	events, next, err := order.GetEvents(this.database, id, r.URL.Query().Get("after"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), databaseErrorStatus(err))
+		return
+	}
+
+	// Generate response
+	response := map[string]interface{}{
+		"order_id": id,
+		"events":   events,
+	}
+	if next != "" {
+		response["next"] = next
+	}
+	str, _ := json.Marshal(response)
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(w, string(str))
+}
+
+// Amend the payload of order before Scheduling is finished, the top level fields of payload in body
+// replace the ones of order, and the field set to null is removed.
+// PATCH /orders/{order_id}
+func (this *OrderProcessService) AmendOrder(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, err := this.retrieveToken(r)
 	if err != nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	logrus.Debugf("PATCH /orders/[%v]", id)
+
+	// Parse request body
+	defer r.Body.Close()
+	patch := make(map[string]json.RawMessage)
+	if err = json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the order of current user can be amended
+	record, err := order.Get(this.database, id)
+	if _, ok := err.(*db.ConnectionError); ok {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || record.UserID != tokenInfo.UserID {
 		w.WriteHeader(404)
 		return
 	}
+	if err = record.Amendable(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	// The amended payload is validated as submission
+	body, fields, err := order.PatchPayload(record.Payload, patch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, _, fieldErrors, err := this.parseOrderPayload(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(fieldErrors) > 0 {
+		writeFieldErrors(w, fieldErrors)
+		return
+	}
+	totals, err := order.ComputeTotals(payload)
+	if pricingErr, ok := err.(*order.PricingError); ok {
+		writeFieldErrors(w, []validator.FieldError{{Field: pricingErr.Field, Message: pricingErr.Message}})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The step being performed by the owner of order is aborted and performed again
+	err = record.Amend(tokenInfo.UserID, payload, totals, fields)
+	switch err {
+	case nil:
+	case order.ErrOrderStarted, order.ErrOrderCancelled, order.ErrOrderFailed, order.ErrOrderInFamily,
+		order.ErrOrderUpdated:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		logrus.Errorf("Error when AmendOrder [%v]", err)
+		http.Error(w, err.Error(), databaseErrorStatus(err))
+		return
+	}
+	logrus.Debugf("Order [%v] amended: [%v]", id, fields)
 
 	str, _ := record.ToJsonForUser()
-	//str, _ := record.ToJson()
 	w.Header().Add("Content-Type", "application/json")
-	fmt.Fprint(w, tokenInfo.UserID, str)
+	fmt.Fprint(w, str)
+}
+
+// POST /orders/{order_id}/cancel
+func (this *OrderProcessService) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, err := this.retrieveToken(r)
+	if err != nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	logrus.Debugf("POST /orders/[%v]/cancel", id)
+
+	// Parse request body
+	t, err := this.parseRequestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reason, _ := t["reason"].(string)
+	if reason == "" || len(reason) > MaxCancelReasonLength {
+		http.Error(w, fmt.Sprintf("The reason is required and at most %d bytes", MaxCancelReasonLength),
+			http.StatusBadRequest)
+		return
+	}
+
+	// Only the order of current user can be cancelled
+	record, err := order.Get(this.database, id)
+	if _, ok := err.(*db.ConnectionError); ok {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || record.UserID != tokenInfo.UserID {
+		w.WriteHeader(404)
+		return
+	}
+
+	// The order is failed and rolled back by the service owning it
+	record, err = order.Cancel(this.database, id, tokenInfo.UserID, reason)
+	switch err {
+	case nil:
+	case order.ErrOrderCompleted, order.ErrOrderCancelled, order.ErrOrderFailed, order.ErrOrderInFamily,
+		order.ErrWorkflowUndefined:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		logrus.Errorf("Error when CancelOrder [%v]", err)
+		http.Error(w, err.Error(), databaseErrorStatus(err))
+		return
+	}
+	logrus.Debugf("Order [%v] cancelled: [%v]", id, reason)
+
+	// Generate response
+	response := map[string]interface{}{
+		"order_id":      record.OrderID,
+		"cancelled":     record.Cancelled,
+		"cancel_reason": record.CancelReason,
+		"cancel_time":   order.FormatTime(record.CancelTime),
+	}
+	str, _ := json.Marshal(response)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, string(str))
+}
+
+// Create a new attempt of the failed order, which resumes from the failed step
+// if "resume" is set, otherwise starts from Scheduling again.
+// The attempt keeps the deadline of the order unless "deadline" is specified.
+// POST /orders/{order_id}/retry
+func (this *OrderProcessService) RetryOrder(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, err := this.retrieveToken(r)
+	if err != nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	logrus.Debugf("POST /orders/[%v]/retry", id)
+
+	// Parse request body, which is optional
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options := struct {
+		Resume   bool       `json:"resume"`
+		Deadline *time.Time `json:"deadline"`
+	}{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err = json.Unmarshal(body, &options); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if options.Deadline != nil && !options.Deadline.After(time.Now()) {
+		http.Error(w, "The deadline should be in the future", http.StatusBadRequest)
+		return
+	}
+
+	// Only the order of current user can be retried
+	record, err := order.Get(this.database, id)
+	if _, ok := err.(*db.ConnectionError); ok {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || record.UserID != tokenInfo.UserID {
+		w.WriteHeader(404)
+		return
+	}
+
+	deadline := record.Deadline
+	if options.Deadline != nil {
+		deadline = options.Deadline.UTC()
+	} else if !deadline.After(time.Now()) {
+		// The order has run out of time, the attempt is unbounded
+		deadline = time.Time{}
+	}
+
+	// The attempt is processed by current service
+	attempt, err := order.Retry(this.database, id, this.serviceID, order.UserActor(tokenInfo.UserID),
+		options.Resume, deadline)
+	switch err {
+	case nil:
+	case order.ErrOrderNotFailed, order.ErrOrderRetried, order.ErrOrderCancelled, order.ErrOrderArchived,
+		order.ErrOrderInFamily, order.ErrWorkflowUndefined:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		logrus.Errorf("Error when RetryOrder [%v]", err)
+		http.Error(w, err.Error(), databaseErrorStatus(err))
+		return
+	}
+	logrus.Debugf("Order [%v] retried by [%v]", id, attempt.OrderID)
+
+	this.pipelineManager.DispatchOrder(attempt)
+
+	// Generate response
+	response := map[string]interface{}{
+		"order_id":          attempt.OrderID,
+		"original_order_id": attempt.OriginalOrderID,
+		"retry_of":          attempt.RetryOf,
+		"attempt":           attempt.Attempt,
+		"current_step":      attempt.CurrentStep,
+		"start_time":        order.FormatTime(attempt.StartTime),
+	}
+	str, _ := json.Marshal(response)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(str))
+}
+
+// Split the order into children, each child holds the line items of the indexes in one group of "children".
+// POST /orders/{order_id}/split
+func (this *OrderProcessService) SplitOrder(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, err := this.retrieveToken(r)
+	if err != nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	logrus.Debugf("POST /orders/[%v]/split", id)
+
+	// Parse request body
+	defer r.Body.Close()
+	split := struct {
+		Children [][]int `json:"children"`
+	}{}
+	if err = json.NewDecoder(r.Body).Decode(&split); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the order of current user can be split
+	record, err := order.Get(this.database, id)
+	if _, ok := err.(*db.ConnectionError); ok {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || record.UserID != tokenInfo.UserID {
+		w.WriteHeader(404)
+		return
+	}
+
+	// The children are processed by current service
+	record, children, err := order.Split(this.database, id, this.serviceID, tokenInfo.UserID, split.Children)
+	switch err {
+	case nil:
+	case order.ErrInvalidSplit:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case order.ErrOrderCancelled, order.ErrOrderFailed, order.ErrOrderInFamily, order.ErrOrderStarted:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		logrus.Errorf("Error when SplitOrder [%v]", err)
+		http.Error(w, err.Error(), databaseErrorStatus(err))
+		return
+	}
+	logrus.Debugf("Order [%v] split into [%v]", id, record.ChildIDs)
+
+	for _, child := range children {
+		this.pipelineManager.DispatchOrder(child)
+	}
+
+	// Generate response
+	response := map[string]interface{}{
+		"order_id":  record.OrderID,
+		"child_ids": record.ChildIDs,
+	}
+	str, _ := json.Marshal(response)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(str))
+}
+
+// Merge the orders of "order_ids" into new parent, which is completed when all of them are completed.
+// POST /orders/merge
+func (this *OrderProcessService) MergeOrders(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, err := this.retrieveToken(r)
+	if err != nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	logrus.Debugf("POST /orders/merge")
+
+	// Parse request body
+	defer r.Body.Close()
+	merge := struct {
+		OrderIDs []string `json:"order_ids"`
+	}{}
+	if err = json.NewDecoder(r.Body).Decode(&merge); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the orders of current user can be merged
+	for _, id := range merge.OrderIDs {
+		record, err := order.Get(this.database, id)
+		if _, ok := err.(*db.ConnectionError); ok {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil || record.UserID != tokenInfo.UserID {
+			http.Error(w, fmt.Sprintf("Order [%s] not found", id), http.StatusNotFound)
+			return
+		}
+	}
+
+	// The parent is processed by current service
+	parent, err := order.Merge(this.database, this.serviceID, tokenInfo.UserID, merge.OrderIDs)
+	switch err {
+	case nil:
+	case order.ErrInvalidMerge, order.ErrMixedWorkflow:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case order.ErrOrderCompleted, order.ErrOrderCancelled, order.ErrOrderFailed, order.ErrOrderInFamily,
+		order.ErrWorkflowUndefined:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		logrus.Errorf("Error when MergeOrders [%v]", err)
+		http.Error(w, err.Error(), databaseErrorStatus(err))
+		return
+	}
+	logrus.Debugf("Orders [%v] merged into [%v]", merge.OrderIDs, parent.OrderID)
+
+	this.pipelineManager.DispatchOrder(parent)
+
+	// Generate response
+	response := map[string]interface{}{
+		"order_id":   parent.OrderID,
+		"child_ids":  parent.ChildIDs,
+		"start_time": order.FormatTime(parent.StartTime),
+	}
+	str, _ := json.Marshal(response)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, string(str))
 }
 
 // This API allows current service takes over the orders processing from some service which is down.
@@ -225,7 +868,7 @@ func (this *OrderProcessService) Transfer(w http.ResponseWriter, r *http.Request
 		fn := func(orderRecord *order.OrderRecord) {
 			this.pipelineManager.DispatchOrder(orderRecord)
 		}
-		go transfer.Transfer(this.serviceID, transferredServiceId, fn)
+		go transfer.Transfer(this.database, this.serviceID, transferredServiceId, fn)
 
 		// Generate response
 		response := map[string]string{
@@ -242,6 +885,36 @@ func (this *OrderProcessService) Transfer(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// The status code of database error
+func databaseErrorStatus(err error) int {
+	if _, ok := err.(*db.ConnectionError); ok {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Parse the time budgets of steps in "<step>=<seconds>", the step should be defined in any workflow
+func parseStepBudgets(entries []string) (map[string]time.Duration, error) {
+	steps := make(map[string]bool)
+	for _, step := range workflow.StepNames() {
+		steps[step] = true
+	}
+
+	budgets := make(map[string]time.Duration)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !steps[parts[0]] {
+			return nil, fmt.Errorf("Invalid step budget [%s]", entry)
+		}
+		seconds, err := strconv.Atoi(parts[1])
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("Invalid step budget [%s]", entry)
+		}
+		budgets[parts[0]] = time.Duration(seconds) * time.Second
+	}
+	return budgets, nil
+}
+
 // Get token information
 func (this *OrderProcessService) retrieveToken(r *http.Request) (*consumer.ConsumerInfo, error) {
 	token := r.Header.Get("Authorization")
@@ -252,6 +925,38 @@ func (this *OrderProcessService) retrieveToken(r *http.Request) (*consumer.Consu
 	return tokenInfo, nil
 }
 
+// Parse the order payload and options in request body, and validate them against the schema
+func (this *OrderProcessService) parseOrderPayload(body []byte) (*order.OrderPayload, *order.OrderOptions,
+	[]validator.FieldError, error) {
+	if this.orderSchema != nil {
+		var document interface{}
+		if err := json.Unmarshal(body, &document); err != nil {
+			return nil, nil, nil, err
+		}
+		if fieldErrors := this.orderSchema.Validate(document); len(fieldErrors) > 0 {
+			return nil, nil, fieldErrors, nil
+		}
+	}
+
+	payload, options, err := order.ParseSubmission(body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return payload, options, nil, nil
+}
+
+// Reply the validation errors of order payload
+func writeFieldErrors(w http.ResponseWriter, fieldErrors []validator.FieldError) {
+	response := map[string]interface{}{
+		"message": "Invalid order payload",
+		"errors":  fieldErrors,
+	}
+	str, _ := json.Marshal(response)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, string(str))
+}
+
 // Parse the body information of request
 func (this *OrderProcessService) parseRequestBody(r *http.Request) (map[string]interface{}, error) {
 	// Parse request body
@@ -0,0 +1,337 @@
+package validator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The definition of JSON Schema.
+// The supported keywords: type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+// minLength, maxLength and pattern. The other keywords are rejected except the annotations.
+type Schema struct {
+	root     map[string]interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// The definition of validation error of one field
+type FieldError struct {
+	// The JSON pointer of field, e.g. "/line_items/0/quantity"
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Load schema from file
+func Load(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse and verify schema from json
+func Parse(data []byte) (*Schema, error) {
+	root := make(map[string]interface{})
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	schema := Schema{
+		root:     root,
+		patterns: make(map[string]*regexp.Regexp),
+	}
+	if err := schema.compile(root, "#"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// Validate the document decoded by encoding/json, returns nil if valid
+func (this *Schema) Validate(document interface{}) []FieldError {
+	var errs []FieldError
+	this.validate(this.root, document, "", &errs)
+	return errs
+}
+
+// The types supported by keyword "type"
+var supportedTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// The keywords which only annotate the schema and are ignored in validation
+var annotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+// Verify the schema node at the JSON pointer and compile its patterns.
+// The unsupported keywords and types are rejected, so the schema never validates less than it looks.
+func (this *Schema) compile(node map[string]interface{}, path string) error {
+	keywords := make([]string, 0, len(node))
+	for keyword := range node {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+		value := node[keyword]
+		location := path + "/" + escapePointer(keyword)
+		invalid := fmt.Errorf("Invalid value of keyword [%s] at [%s]", keyword, path)
+
+		switch keyword {
+		case "type":
+			types, ok := value.([]interface{})
+			if !ok {
+				types = []interface{}{value}
+			}
+			for _, t := range types {
+				if name, ok := t.(string); !ok || !supportedTypes[name] {
+					return fmt.Errorf("Unsupported type [%v] at [%s]", t, location)
+				}
+			}
+		case "enum":
+			if _, ok := value.([]interface{}); !ok {
+				return invalid
+			}
+		case "const":
+		case "properties":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return invalid
+			}
+			for name, property := range properties {
+				child, ok := property.(map[string]interface{})
+				if !ok {
+					return invalid
+				}
+				if err := this.compile(child, location+"/"+escapePointer(name)); err != nil {
+					return err
+				}
+			}
+		case "required":
+			names, ok := value.([]interface{})
+			if !ok {
+				return invalid
+			}
+			for _, name := range names {
+				if _, ok := name.(string); !ok {
+					return invalid
+				}
+			}
+		case "additionalProperties":
+			switch additional := value.(type) {
+			case bool:
+			case map[string]interface{}:
+				if err := this.compile(additional, location); err != nil {
+					return err
+				}
+			default:
+				return invalid
+			}
+		case "items":
+			// The tuple form of items is not supported
+			items, ok := value.(map[string]interface{})
+			if !ok {
+				return invalid
+			}
+			if err := this.compile(items, location); err != nil {
+				return err
+			}
+		case "minItems", "maxItems", "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "minLength", "maxLength":
+			if _, ok := value.(float64); !ok {
+				return invalid
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return invalid
+			}
+			regex, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("Invalid pattern at [%s] [%v]", path, err)
+			}
+			this.patterns[pattern] = regex
+		default:
+			if !annotations[keyword] {
+				return fmt.Errorf("Unsupported keyword [%s] at [%s]", keyword, path)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate the value against schema node, the errors are appended to errs
+func (this *Schema) validate(node map[string]interface{}, value interface{}, field string, errs *[]FieldError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if expected, found := node["type"]; found && !matchType(expected, value) {
+		fail("should be %v", describeType(expected))
+		return
+	}
+	if enum, ok := node["enum"].([]interface{}); ok {
+		matched := false
+		for _, item := range enum {
+			if reflect.DeepEqual(item, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("should be one of %v", enum)
+		}
+	}
+	if constant, found := node["const"]; found && !reflect.DeepEqual(constant, value) {
+		fail("should be %v", constant)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		this.validateObject(node, v, field, errs)
+	case []interface{}:
+		if min, ok := node["minItems"].(float64); ok && float64(len(v)) < min {
+			fail("should have at least %v items", min)
+		}
+		if max, ok := node["maxItems"].(float64); ok && float64(len(v)) > max {
+			fail("should have at most %v items", max)
+		}
+		if items, ok := node["items"].(map[string]interface{}); ok {
+			for index, item := range v {
+				this.validate(items, item, field+"/"+strconv.Itoa(index), errs)
+			}
+		}
+	case float64:
+		if min, ok := node["minimum"].(float64); ok && v < min {
+			fail("should be >= %v", min)
+		}
+		if max, ok := node["maximum"].(float64); ok && v > max {
+			fail("should be <= %v", max)
+		}
+		if min, ok := node["exclusiveMinimum"].(float64); ok && v <= min {
+			fail("should be > %v", min)
+		}
+		if max, ok := node["exclusiveMaximum"].(float64); ok && v >= max {
+			fail("should be < %v", max)
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := node["minLength"].(float64); ok && length < min {
+			fail("should have at least %v characters", min)
+		}
+		if max, ok := node["maxLength"].(float64); ok && length > max {
+			fail("should have at most %v characters", max)
+		}
+		if pattern, ok := node["pattern"].(string); ok && !this.patterns[pattern].MatchString(v) {
+			fail("should match pattern %s", pattern)
+		}
+	}
+}
+
+// Validate the properties of object
+func (this *Schema) validateObject(node map[string]interface{}, object map[string]interface{}, field string, errs *[]FieldError) {
+	if required, ok := node["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, found := object[key]; !found {
+					*errs = append(*errs, FieldError{Field: field + "/" + escapePointer(key), Message: "is required"})
+				}
+			}
+		}
+	}
+
+	properties, _ := node["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		child := field + "/" + escapePointer(key)
+		if property, ok := properties[key].(map[string]interface{}); ok {
+			this.validate(property, object[key], child, errs)
+			continue
+		}
+		switch additional := node["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				*errs = append(*errs, FieldError{Field: child, Message: "is not allowed"})
+			}
+		case map[string]interface{}:
+			this.validate(additional, object[key], child, errs)
+		}
+	}
+}
+
+// Check whether the value matches the type, or any of the types
+func matchType(expected interface{}, value interface{}) bool {
+	if types, ok := expected.([]interface{}); ok {
+		for _, t := range types {
+			if matchType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch expected {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+// Describe the expected type in message
+func describeType(expected interface{}) string {
+	if types, ok := expected.([]interface{}); ok {
+		var names []string
+		for _, t := range types {
+			names = append(names, fmt.Sprint(t))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(expected)
+}
+
+// Escape the property name in JSON pointer
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,114 @@
+package validator
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		schema   string
+		document string
+		errors   []FieldError
+	}{
+		{"type matched", `{"type": "string"}`, `"a"`, nil},
+		{"type mismatched", `{"type": "string"}`, `1`, []FieldError{{"", "should be string"}}},
+		{"type in list", `{"type": ["string", "null"]}`, `null`, nil},
+		{"type not in list", `{"type": ["string", "null"]}`, `true`, []FieldError{{"", "should be string or null"}}},
+		{"integer", `{"type": "integer"}`, `2`, nil},
+		{"integer with fraction", `{"type": "integer"}`, `2.5`, []FieldError{{"", "should be integer"}}},
+		{"number", `{"type": "number"}`, `2.5`, nil},
+		{"boolean", `{"type": "boolean"}`, `"true"`, []FieldError{{"", "should be boolean"}}},
+		{"object", `{"type": "object"}`, `[]`, []FieldError{{"", "should be object"}}},
+		{"array", `{"type": "array"}`, `{}`, []FieldError{{"", "should be array"}}},
+		{"enum matched", `{"enum": ["low", "high"]}`, `"low"`, nil},
+		{"enum mismatched", `{"enum": ["low", "high"]}`, `"normal"`, []FieldError{{"", "should be one of [low high]"}}},
+		{"const matched", `{"const": 1}`, `1`, nil},
+		{"const mismatched", `{"const": 1}`, `2`, []FieldError{{"", "should be 1"}}},
+		{"required", `{"required": ["a", "b"]}`, `{"a": 1}`, []FieldError{{"/b", "is required"}}},
+		{"properties", `{"properties": {"a": {"type": "string"}}}`, `{"a": 1}`, []FieldError{{"/a", "should be string"}}},
+		{"additional properties allowed", `{"properties": {"a": {}}}`, `{"b": 1}`, nil},
+		{"additional properties denied", `{"properties": {"a": {}}, "additionalProperties": false}`, `{"a/b": 1}`,
+			[]FieldError{{"/a~1b", "is not allowed"}}},
+		{"additional properties schema", `{"additionalProperties": {"type": "string"}}`, `{"b": 1}`,
+			[]FieldError{{"/b", "should be string"}}},
+		{"items", `{"items": {"type": "integer"}}`, `[1, "a"]`, []FieldError{{"/1", "should be integer"}}},
+		{"minItems", `{"minItems": 1}`, `[]`, []FieldError{{"", "should have at least 1 items"}}},
+		{"maxItems", `{"maxItems": 1}`, `[1, 2]`, []FieldError{{"", "should have at most 1 items"}}},
+		{"minimum", `{"minimum": 1}`, `0`, []FieldError{{"", "should be >= 1"}}},
+		{"maximum", `{"maximum": 1}`, `2`, []FieldError{{"", "should be <= 1"}}},
+		{"exclusiveMinimum", `{"exclusiveMinimum": 1}`, `1`, []FieldError{{"", "should be > 1"}}},
+		{"exclusiveMaximum", `{"exclusiveMaximum": 1}`, `1`, []FieldError{{"", "should be < 1"}}},
+		{"minLength", `{"minLength": 2}`, `"é"`, []FieldError{{"", "should have at least 2 characters"}}},
+		{"maxLength", `{"maxLength": 1}`, `"ab"`, []FieldError{{"", "should have at most 1 characters"}}},
+		{"pattern matched", `{"pattern": "^[A-Z]{3}$"}`, `"USD"`, nil},
+		{"pattern mismatched", `{"pattern": "^[A-Z]{3}$"}`, `"usd"`, []FieldError{{"", "should match pattern ^[A-Z]{3}$"}}},
+		{"annotations", `{"$schema": "http://json-schema.org/draft-07/schema#", "title": "t", "description": "d"}`, `1`, nil},
+	}
+
+	for _, c := range cases {
+		schema, err := Parse([]byte(c.schema))
+		if err != nil {
+			t.Errorf("%s: parse failed [%v]", c.name, err)
+			continue
+		}
+		var document interface{}
+		if err = json.Unmarshal([]byte(c.document), &document); err != nil {
+			t.Fatalf("%s: invalid document [%v]", c.name, err)
+		}
+		if errs := schema.Validate(document); !reflect.DeepEqual(errs, c.errors) {
+			t.Errorf("%s: got %v, want %v", c.name, errs, c.errors)
+		}
+	}
+}
+
+func TestParseRejectsUnsupportedSchema(t *testing.T) {
+	cases := []struct {
+		name    string
+		schema  string
+		message string
+	}{
+		{"$ref", `{"$ref": "#/definitions/a"}`, "Unsupported keyword [$ref] at [#]"},
+		{"oneOf", `{"oneOf": [{"type": "string"}]}`, "Unsupported keyword [oneOf]"},
+		{"anyOf", `{"anyOf": [{"type": "string"}]}`, "Unsupported keyword [anyOf]"},
+		{"allOf", `{"allOf": [{"type": "string"}]}`, "Unsupported keyword [allOf]"},
+		{"format", `{"type": "string", "format": "date-time"}`, "Unsupported keyword [format]"},
+		{"nested keyword", `{"properties": {"a": {"items": {"format": "email"}}}}`,
+			"Unsupported keyword [format] at [#/properties/a/items]"},
+		{"unknown type", `{"type": "date"}`, "Unsupported type [date] at [#/type]"},
+		{"unknown type in list", `{"type": ["string", "int"]}`, "Unsupported type [int]"},
+		{"tuple items", `{"items": [{"type": "string"}]}`, "Invalid value of keyword [items]"},
+		{"invalid required", `{"required": "a"}`, "Invalid value of keyword [required]"},
+		{"invalid minimum", `{"minimum": "1"}`, "Invalid value of keyword [minimum]"},
+		{"invalid additionalProperties", `{"additionalProperties": "no"}`, "Invalid value of keyword [additionalProperties]"},
+		{"invalid pattern", `{"pattern": "("}`, "Invalid pattern at [#]"},
+	}
+
+	for _, c := range cases {
+		_, err := Parse([]byte(c.schema))
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: got [%v], want [%s]", c.name, err, c.message)
+		}
+	}
+}
+
+func TestLoadOrderSchema(t *testing.T) {
+	schema, err := Load("../../config/order_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var document interface{}
+	json.Unmarshal([]byte(`{"priority": "rush", "line_items": [{"sku": "A-100", "quantity": 0, "unit_price": "19.99"}]}`), &document)
+	errs := schema.Validate(document)
+	expected := []FieldError{
+		{"/line_items/0/quantity", "should be >= 1"},
+		{"/priority", "should be one of [low normal high urgent]"},
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("got %v, want %v", errs, expected)
+	}
+}